@@ -0,0 +1,373 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	minPasswordLength = 8
+	// bcrypt ignores the rest
+	maxPasswordLength = 72
+	// Per IP, between two account commands that check or hash a password
+	loginInterval = time.Second
+	// Failed attempts in a row before the IP is locked out
+	maxLoginFailures = 5
+	loginLockout = 15*time.Minute
+)
+
+var (
+	errAccountExists = errors.New("account exists")
+	errWrongLogin = errors.New("wrong nick or password")
+)
+
+// Compared against when the nick has no account, so a wrong nick takes as
+// long to turn down as a wrong password
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	return hash
+})
+
+// AccountDB keeps the registered nicks with the bcrypt hashes of their
+// passwords in SQLite. Everything but Registered hits the disk and runs
+// bcrypt, it's for the account workers, never for server() itself.
+type AccountDB struct {
+	db *sql.DB
+	mu sync.RWMutex
+	// Lowercased, so server() can protect the nicks without a query
+	nicks map[string]bool
+}
+
+func OpenAccountDB(path string) (*AccountDB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS accounts (
+		nick TEXT PRIMARY KEY COLLATE NOCASE,
+		hash TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		last_login INTEGER
+	)`)
+	if err == nil {
+		err = createOfflineTable(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	a := &AccountDB{db: db, nicks: map[string]bool{}}
+	rows, err := db.Query("SELECT nick FROM accounts")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var nick string
+		if err := rows.Scan(&nick); err != nil {
+			db.Close()
+			return nil, err
+		}
+		a.nicks[strings.ToLower(nick)] = true
+	}
+	if err := rows.Err(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Registered tells whether the nick belongs to an account, ignoring case
+func (a *AccountDB) Registered(nick string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.nicks[strings.ToLower(nick)]
+}
+
+// Register creates the account, errAccountExists when the nick is taken
+func (a *AccountDB) Register(nick string, password string, now time.Time) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.nicks[strings.ToLower(nick)] {
+		return errAccountExists
+	}
+	if _, err := a.db.Exec("INSERT INTO accounts (nick, hash, created_at, last_login) VALUES (?, ?, ?, ?)", nick, string(hash), now.UnixNano(), now.UnixNano()); err != nil {
+		return err
+	}
+	a.nicks[strings.ToLower(nick)] = true
+	return nil
+}
+
+// Login checks the password of the account and notes the time of the
+// login. It returns the nick as registered, errWrongLogin when either the
+// nick or the password is wrong.
+func (a *AccountDB) Login(nick string, password string, now time.Time) (string, error) {
+	nick, err := a.check(nick, password)
+	if err != nil {
+		return "", err
+	}
+	_, err = a.db.Exec("UPDATE accounts SET last_login = ? WHERE nick = ?", now.UnixNano(), nick)
+	return nick, err
+}
+
+// Passwd replaces the password of the account once the old one checks out
+func (a *AccountDB) Passwd(nick string, old string, password string) error {
+	if _, err := a.check(nick, old); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = a.db.Exec("UPDATE accounts SET hash = ? WHERE nick = ?", string(hash), nick)
+	return err
+}
+
+func (a *AccountDB) check(nick string, password string) (string, error) {
+	var registered, hash string
+	err := a.db.QueryRow("SELECT nick, hash FROM accounts WHERE nick = ?", nick).Scan(&registered, &hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return "", errWrongLogin
+	}
+	if err != nil {
+		return "", err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return "", errWrongLogin
+	}
+	return registered, nil
+}
+
+func (a *AccountDB) Close() error {
+	return a.db.Close()
+}
+
+// AccountReply is what an account worker reports back to server() with an
+// AccountChecked
+type AccountReply struct {
+	// :register, :login, :passwd, :msg or :offline, see takeOffline
+	Command string
+	// As registered, once the password checked out
+	Nick string
+	Err error
+	// The messages of an :offline, oldest first
+	Offline []OfflineMessage
+	// The offline messages that expired or didn't fit, see QueueOffline
+	Dropped int
+}
+
+// loginAttempts is the recent history of the account commands of an IP
+type loginAttempts struct {
+	last time.Time
+	failures int
+	lockedUntil time.Time
+}
+
+// loginWait tells how long the IP has to wait before it may try a password
+// again, and notes the attempt when it doesn't have to
+func (s *Server) loginWait(ip string, now time.Time) time.Duration {
+	attempts := s.logins[ip]
+	if attempts == nil {
+		attempts = &loginAttempts{}
+		s.logins[ip] = attempts
+	}
+	if wait := max(attempts.lockedUntil.Sub(now), attempts.last.Add(loginInterval).Sub(now)); wait > 0 {
+		return wait
+	}
+	attempts.last = now
+	return 0
+}
+
+// forgetLogins drops the IPs that aren't locked out and haven't failed
+// lately
+func (s *Server) forgetLogins(now time.Time) {
+	for ip, attempts := range s.logins {
+		if now.After(attempts.lockedUntil) && now.Sub(attempts.last) > loginLockout {
+			delete(s.logins, ip)
+		}
+	}
+}
+
+// passwordLength tells the client when its new password won't do
+func (s *Server) passwordLength(client *Client, password string) bool {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		s.tell(client, "password_length", CatalogData{Count: minPasswordLength, Limit: maxPasswordLength})
+		return false
+	}
+	return true
+}
+
+// account runs the account commands. Checking and hashing the passwords
+// is slow on purpose, it's done by workers reporting back with an
+// AccountChecked. The passwords don't go anywhere else, least of all the
+// log.
+func (s *Server) account(author *Client, name string, args []string, now time.Time) {
+	if s.accounts == nil {
+		s.tell(author, "accounts_disabled", CatalogData{})
+		return
+	}
+	ip := clientIP(author.Conn)
+	accounts := s.accounts
+	send := s.accountReply(author, name)
+	reply := func(nick string, err error) {
+		send(AccountReply{Nick: nick, Err: err})
+	}
+	switch name {
+	case ":register":
+		if len(args) != 2 {
+			s.tell(author, "usage", CatalogData{Text: ":register <nick> <password>"})
+			return
+		}
+		nick, password := args[0], args[1]
+		if !validNick(nick) {
+			s.tell(author, "usage", CatalogData{Text: ":register <nick> <password>, the nick is up to 20 letters, digits, - or _"})
+			return
+		}
+		if accounts.Registered(nick) {
+			s.tell(author, "account_exists", CatalogData{Nick: nick})
+			return
+		}
+		if other := s.findByNick(nick); other != nil && other != author {
+			s.tell(author, "nick_taken", CatalogData{Nick: nick})
+			return
+		}
+		if !s.passwordLength(author, password) {
+			return
+		}
+		if wait := s.loginWait(ip, now); wait > 0 {
+			s.tell(author, "login_wait", CatalogData{Wait: wait})
+			return
+		}
+		go func() {
+			reply(nick, accounts.Register(nick, password, now))
+		}()
+	case ":login":
+		if len(args) != 2 {
+			s.tell(author, "usage", CatalogData{Text: ":login <nick> <password>"})
+			return
+		}
+		if wait := s.loginWait(ip, now); wait > 0 {
+			s.tell(author, "login_wait", CatalogData{Wait: wait})
+			return
+		}
+		nick, password := args[0], args[1]
+		go func() {
+			reply(accounts.Login(nick, password, now))
+		}()
+	case ":msg":
+		s.msg(author, args, now)
+	case ":passwd":
+		if len(args) != 2 {
+			s.tell(author, "usage", CatalogData{Text: ":passwd <old> <new>"})
+			return
+		}
+		if author.Account == "" {
+			s.tell(author, "not_logged_in", CatalogData{})
+			return
+		}
+		if wait := s.loginWait(ip, now); wait > 0 {
+			s.tell(author, "login_wait", CatalogData{Wait: wait})
+			return
+		}
+		if !s.passwordLength(author, args[1]) {
+			return
+		}
+		nick, old, password := author.Account, args[0], args[1]
+		go func() {
+			reply(nick, accounts.Passwd(nick, old, password))
+		}()
+	}
+}
+
+// accountReply is how a worker of the command of the client reports back
+// to server()
+func (s *Server) accountReply(client *Client, command string) func(AccountReply) {
+	id := client.ID
+	ctx, messages := s.ctx, s.messages
+	return func(reply AccountReply) {
+		reply.Command = command
+		select {
+		case messages <- Message{
+			Type: AccountChecked,
+			ConnID: id,
+			Account: &reply,
+		}:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// accountChecked finishes an account command once its worker is done
+func (s *Server) accountChecked(client *Client, reply AccountReply, now time.Time) {
+	// Neither checks a password
+	if reply.Command == ":msg" || reply.Command == ":offline" {
+		s.offlineChecked(client, reply, now)
+		return
+	}
+	addr := s.cfg.sensitive(clientKey(client.Conn))
+	ip := clientIP(client.Conn)
+	switch {
+	case errors.Is(reply.Err, errAccountExists):
+		s.tell(client, "account_exists", CatalogData{Nick: reply.Nick})
+		return
+	case errors.Is(reply.Err, errWrongLogin):
+		attempts := s.logins[ip]
+		if attempts == nil {
+			attempts = &loginAttempts{last: now}
+			s.logins[ip] = attempts
+		}
+		attempts.failures += 1
+		client.log.Warn("Client failed to log in", "event", "login_failed", "client", addr, "command", reply.Command, "failures", attempts.failures)
+		securityEvent("login_failed", "account_password", s.cfg.sensitive(ip), "cid", client.CorrelationID, "failures", attempts.failures)
+		if attempts.failures >= maxLoginFailures {
+			attempts.failures = 0
+			attempts.lockedUntil = now.Add(loginLockout)
+			securityEvent("login_lockout", "account_password", s.cfg.sensitive(ip), "duration", loginLockout.String())
+			s.tell(client, "login_wait", CatalogData{Wait: loginLockout})
+			return
+		}
+		s.tell(client, "login_failed", CatalogData{})
+		return
+	case reply.Err != nil:
+		client.log.Error("Account command failed", "event", "account", "client", addr, "command", reply.Command, "err", reply.Err)
+		s.tell(client, "account_failed", CatalogData{})
+		return
+	}
+	if attempts := s.logins[ip]; attempts != nil {
+		attempts.failures = 0
+	}
+	if reply.Command == ":passwd" {
+		client.log.Info("Client changed its password", "event", "passwd", "client", addr, "account", reply.Nick)
+		s.tell(client, "passwd_changed", CatalogData{})
+		return
+	}
+	// Logged in elsewhere already, one session per account
+	if other := s.findByNick(reply.Nick); other != nil && other != client {
+		s.tell(client, "nick_taken", CatalogData{Nick: reply.Nick})
+		return
+	}
+	client.log.Info("Client logged in", "event", "login", "client", addr, "account", reply.Nick, "command", reply.Command)
+	old := clientDisplayName(client, s.cfg)
+	client.Account = reply.Nick
+	client.Username = reply.Nick
+	s.tell(client, "logged_in", CatalogData{Nick: reply.Nick})
+	if old != client.Username {
+		s.announceRename(client, old)
+	}
+	if reply.Command == ":login" {
+		s.takeOffline(client, now)
+	}
+}
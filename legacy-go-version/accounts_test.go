@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterAndLogin(t *testing.T) {
+	log := captureLog(t)
+	ts := startServer(t, testConfig(), nil)
+	withAccounts(ts, filepath.Join(t.TempDir(), "accounts.db"))
+	register(ts, "bob")
+
+	mallory := ts.connect("10.0.0.9:1009")
+	mallory.Play(ScriptStep{After: time.Second, Line: ":register bob hunter22"})
+	if !mallory.Got("The nick bob is registered already") {
+		t.Errorf("registered twice, got %q", mallory.Received())
+	}
+	mallory.Play(ScriptStep{After: time.Second, Line: ":login bob hunter22"})
+	mallory.WaitFor("Wrong nick or password")
+	if mallory.Got("You are logged in") {
+		t.Errorf("logged in with the wrong password")
+	}
+
+	bob := login(ts, "10.0.0.2:1002", "bob")
+	bob.Play(ScriptStep{After: time.Second, Line: ":passwd " + testAccountPassword + " battery-staple"})
+	bob.WaitFor("Your password is changed")
+	bob.Close()
+	c := ts.connect("10.0.0.2:1003")
+	c.Play(ScriptStep{After: time.Second, Line: ":login bob battery-staple"})
+	c.WaitFor("You are logged in as bob")
+
+	for _, password := range []string{testAccountPassword, "hunter22", "battery-staple"} {
+		if strings.Contains(log.String(), password) {
+			t.Errorf("the password %q is in the log", password)
+		}
+	}
+}
+
+func TestRegisteredNicksAreProtected(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	withAccounts(ts, filepath.Join(t.TempDir(), "accounts.db"))
+	register(ts, "bob")
+	mallory := ts.connect("10.0.0.9:1009")
+
+	mallory.Play(ScriptStep{After: time.Second, Line: ":nick bob"})
+	mallory.Play(ScriptStep{After: time.Minute, Line: ":nick BOB"})
+	if n := strings.Count(mallory.Conn.Written(), "The nick "); n != 2 || !mallory.Got("The nick bob is registered, :login to use it") {
+		t.Errorf("took a registered nick, got %q", mallory.Received())
+	}
+
+	// Logged in, the nick is the account's to use
+	bob := login(ts, "10.0.0.2:1002", "bob")
+	bob.Play(ScriptStep{After: time.Minute, Line: ":nick bob"})
+	if bob.Got("is registered") {
+		t.Errorf("the account can't use its own nick, got %q", bob.Received())
+	}
+	// And one session at a time
+	other := ts.connect("10.0.0.3:1003")
+	other.Play(ScriptStep{After: time.Second, Line: ":login bob " + testAccountPassword})
+	other.WaitFor("The nick bob is taken")
+}
+
+func TestLoginLockout(t *testing.T) {
+	security := captureSecurityLog(t)
+	ts := startServer(t, testConfig(), nil)
+	withAccounts(ts, filepath.Join(t.TempDir(), "accounts.db"))
+	register(ts, "bob")
+	mallory := ts.connect("10.0.0.9:1009")
+
+	for i := 0; i < maxLoginFailures-1; i++ {
+		mallory.Forget()
+		mallory.Play(ScriptStep{After: time.Second, Line: fmt.Sprintf(":login bob wrong-guess-%d", i)})
+		mallory.WaitFor("Wrong nick or password")
+	}
+	mallory.Forget()
+	mallory.Play(ScriptStep{After: time.Second, Line: ":login bob one-more-guess"})
+	mallory.WaitFor("Too many attempts, try again in 15m")
+
+	// Not even the right password gets in while it lasts
+	mallory.Forget()
+	mallory.Play(ScriptStep{After: time.Minute, Line: ":login bob " + testAccountPassword})
+	if !mallory.Got("Too many attempts, try again in 14m") || mallory.Got("You are logged in") {
+		t.Errorf("got %q during the lockout", mallory.Received())
+	}
+	// Another IP isn't locked out
+	login(ts, "10.0.0.2:1002", "bob").Close()
+
+	mallory.Play(ScriptStep{After: loginLockout, Line: ":login bob " + testAccountPassword})
+	mallory.WaitFor("You are logged in as bob")
+
+	if len(security.withEvent(t, "login_failed")) != maxLoginFailures || len(security.withEvent(t, "login_lockout")) != 1 {
+		t.Errorf("the security log has %s", security)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// The actor of the moderation actions the server takes on its own
+const AutoStrikeLimit = "auto/strike-limit"
+
+type AuditEntry struct {
+	Time time.Time `json:"ts"`
+	Actor string `json:"actor"`
+	Action string `json:"action"`
+	Target string `json:"target,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// MarshalJSON spells the duration out like the config does
+func (entry AuditEntry) MarshalJSON() ([]byte, error) {
+	type plain AuditEntry
+	var duration string
+	if entry.Duration != 0 {
+		duration = entry.Duration.String()
+	}
+	return json.Marshal(struct {
+		plain
+		Duration string `json:"duration,omitempty"`
+	}{plain(entry), duration})
+}
+
+func (entry AuditEntry) String() string {
+	s := fmt.Sprintf("%s %s %s", entry.Time.Format("2006-01-02 15:04:05"), entry.Actor, entry.Action)
+	if entry.Target != "" {
+		s += " " + entry.Target
+	}
+	if entry.Duration != 0 {
+		s += " for " + entry.Duration.String()
+	}
+	if entry.Reason != "" {
+		s += ": " + entry.Reason
+	}
+	return s
+}
+
+// AuditLog keeps the last moderation actions in memory for the :audit
+// command and optionally appends all of them to a file. It belongs to the
+// server() goroutine.
+type AuditLog struct {
+	entries []AuditEntry
+	max int
+	file *os.File
+}
+
+func (audit *AuditLog) Record(entry AuditEntry) {
+	slog.Info("Moderation action", "event", "audit", "actor", entry.Actor, "action", entry.Action, "target", entry.Target, "reason", entry.Reason)
+	audit.entries = append(audit.entries, entry)
+	if len(audit.entries) > audit.max {
+		audit.entries = audit.entries[len(audit.entries)-audit.max:]
+	}
+	if audit.file != nil {
+		data, err := json.Marshal(entry)
+		if err == nil {
+			_, err = audit.file.Write(append(data, '\n'))
+		}
+		if err != nil {
+			slog.Error("Could not write the audit file", "path", audit.file.Name(), "err", err)
+		}
+	}
+}
+
+// Last returns up to n most recent entries, oldest first
+func (audit *AuditLog) Last(n int) []AuditEntry {
+	if n > len(audit.entries) {
+		n = len(audit.entries)
+	}
+	return audit.entries[len(audit.entries)-n:]
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAutomaticAndManualBansAreAudited(t *testing.T) {
+	cfg := adminConfig(t)
+	cfg.StrikeLimit = 1
+	ts := startServer(t, cfg, nil)
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	ts.s.audit.file = file
+	admin := ts.connect("10.0.0.1:1001")
+	admin.Auth()
+	mallory := ts.connect("10.0.0.9:1009")
+
+	mallory.Play(ScriptStep{After: time.Second, Line: garbage})
+	// The hang up comes back as a ClientDisconnected of its own
+	admin.WaitFor("10.0.0.9 left " + defaultRoom)
+	admin.Play(ScriptStep{After: time.Second, Line: ":ban 10.0.0.8 spam bot"})
+	admin.Forget()
+	admin.Play(ScriptStep{After: time.Second, Line: ":audit"})
+
+	lines := admin.Received()
+	if len(lines) != 2 || !strings.Contains(lines[0], AutoStrikeLimit+" ban 10.0.0.9") || !strings.Contains(lines[1], "ban 10.0.0.8") || !strings.HasSuffix(lines[1], ": spam bot") {
+		t.Errorf("want the automatic ban, then the manual one, got %q", lines)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actors []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry struct {
+			Actor string `json:"actor"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("not an audit entry: %s", line)
+		}
+		actors = append(actors, entry.Actor)
+	}
+	if len(actors) != 2 || actors[0] != AutoStrikeLimit || actors[1] == AutoStrikeLimit {
+		t.Errorf("the audit file has the actors %q", actors)
+	}
+}
+
+func TestAuditKeepsTheLastEntries(t *testing.T) {
+	audit := &AuditLog{max: 3}
+	for _, target := range []string{"a", "b", "c", "d"} {
+		audit.Record(AuditEntry{Actor: "test", Action: "ban", Target: target})
+	}
+	var targets []string
+	for _, entry := range audit.Last(10) {
+		targets = append(targets, entry.Target)
+	}
+	if strings.Join(targets, "") != "bcd" {
+		t.Errorf("got %q, want the last three oldest first", targets)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// newBudget is the bucket of the outbound chat lines of a client, nil for
+// no limit. It holds at least two of the longest messages, a line longer
+// than the bucket would never get through.
+func newBudget(bandwidth int) *rate.Limiter {
+	if bandwidth <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bandwidth), max(bandwidth, 2*maxMessageSize))
+}
+
+// deliver writes a chat line to the client within its -bandwidth. A client
+// on a link too slow for the chat gets the lines that fit, and instead of
+// the rest a count of how many it missed, right before the next line that
+// fits. Only the chat lines are budgeted, the notices and announcements
+// are always written.
+func (s *Server) deliver(client *Client, text string) {
+	if client.budget != nil && !client.budget.AllowN(time.Now(), len(text)) {
+		client.skipped += 1
+		s.stats.Skipped += 1
+		return
+	}
+	if client.skipped > 0 {
+		client.Send(s.notice("skipped", CatalogData{Count: client.skipped}))
+		client.skipped = 0
+	}
+	client.Write(text)
+	client.MessagesReceived += 1
+	s.stats.BytesBroadcast += len(text)
+}
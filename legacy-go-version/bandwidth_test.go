@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandwidthSkipsAndCounts(t *testing.T) {
+	cfg := testConfig()
+	// The bucket holds 2*maxMessageSize then, refilled by 1000 bytes a
+	// second of the real clock
+	cfg.Bandwidth = 1000
+	ts := startServer(t, cfg, nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+
+	// 500 bytes and the newline, 32 of them fit the bucket
+	const sent, fit = 40, 2*maxMessageSize/501
+	for i := 0; i < sent; i++ {
+		alice.Play(ScriptStep{After: time.Second, Line: fmt.Sprintf("%03d %s", i, strings.Repeat("x", 496))})
+	}
+	if got := strings.Count(bob.Conn.Written(), strings.Repeat("x", 496)); got != fit {
+		t.Errorf("got %d lines through the budget, want %d", got, fit)
+	}
+
+	// The notices don't count against the budget
+	ts.connect("10.0.0.3:1003")
+	if !bob.Got("10.0.0.3 joined " + defaultRoom) {
+		t.Errorf("a notice was skipped, got %q", bob.Received()[len(bob.Received())-1])
+	}
+
+	time.Sleep(600*time.Millisecond)
+	bob.Forget()
+	alice.Play(ScriptStep{After: time.Second, Line: "back"})
+	if got := bob.Received(); len(got) != 2 || got[0] != fmt.Sprintf("[Server] …skipped %d messages…", sent-fit) || got[1] != "back" {
+		t.Errorf("want the count of the skipped messages then the line, got %q", got)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// loadBans reads the ban list saved by saveBans. A missing file is an empty
+// list. If the file is corrupt the backup of the previous version is used.
+func loadBans(path string) (map[string]time.Time, error) {
+	bans, err := readBans(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]time.Time{}, nil
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		slog.Warn("The ban list is corrupt, falling back to its backup", "path", path, "err", err)
+		return readBans(path + ".bak")
+	}
+	return bans, err
+}
+
+func readBans(path string) (map[string]time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	bans := map[string]time.Time{}
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+// saveBans replaces the ban list atomically, so a crash midway leaves
+// either the old or the new list but never a truncated one. The previous
+// list is kept as path.bak.
+func saveBans(path string, bans map[string]time.Time) error {
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "banlist-*.json.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// A hard link keeps the current list in place while the backup is made
+	os.Remove(path + ".bak")
+	if err := os.Link(path, path+".bak"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// banCleanupInterval is how often server() forgets the expired bans, once
+// per ban duration but not more often than once a minute
+func banCleanupInterval(banLimit time.Duration) time.Duration {
+	return max(time.Minute, banLimit)
+}
+
+// expireBans drops the bans which ran out. An expired ban is otherwise
+// only noticed when the IP connects again, and most never do.
+func (s *Server) expireBans(now time.Time) {
+	expired := 0
+	for ip, bannedAt := range s.bannedMfs {
+		if now.Sub(bannedAt) >= s.cfg.BanLimit {
+			delete(s.bannedMfs, ip)
+			s.audit.Record(AuditEntry{
+				Time: now,
+				Actor: AutoStrikeLimit,
+				Action: "unban",
+				Target: s.cfg.sensitive(ip),
+				Reason: "ban expired",
+			})
+			expired += 1
+		}
+	}
+	if expired > 0 {
+		s.saveBans()
+	}
+	slog.Debug("Cleaned up the expired bans", "event", "ban_cleanup", "expired", expired, "bans", len(s.bannedMfs))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// The cleanup runs on a ticker of at least a minute, so this calls what it
+// fires from the test goroutine instead
+func TestExpiredBansAreCleanedUp(t *testing.T) {
+	log := captureLog(t)
+	cfg := testConfig()
+	cfg.BanLimit = time.Millisecond
+	s := NewServer(cfg, &Files{})
+	now := time.Date(2024, 1, 14, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 100; i++ {
+		s.bannedMfs[fmt.Sprintf("10.0.%d.%d", i/256, i%256)] = now.Add(-2*time.Millisecond)
+	}
+	s.bannedMfs["10.1.0.1"] = now
+
+	s.expireBans(now)
+
+	if len(s.bannedMfs) != 1 {
+		t.Errorf("%d bans left, want the one still running", len(s.bannedMfs))
+	}
+	if _, ok := s.bannedMfs["10.1.0.1"]; !ok {
+		t.Errorf("the running ban was cleaned up")
+	}
+	if logged := log.withEvent(t, "ban_cleanup"); len(logged) != 1 || logged[0]["expired"] != 100.0 {
+		t.Errorf("logged the cleanup as %v", logged)
+	}
+}
+
+func TestBanCleanupInterval(t *testing.T) {
+	for banLimit, want := range map[time.Duration]time.Duration{
+		time.Millisecond: time.Minute,
+		10*time.Minute: 10*time.Minute,
+	} {
+		if got := banCleanupInterval(banLimit); got != want {
+			t.Errorf("%s: got %s, want %s", banLimit, got, want)
+		}
+	}
+}
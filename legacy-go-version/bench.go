@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+type benchResult struct {
+	sent int
+	// Of the messages of the quiet and the noisy clients
+	latencies []time.Duration
+	noisyLatencies []time.Duration
+}
+
+// bench spins up the real server on a loopback port and hammers it with
+// simulated clients. Every client sends its own timestamp so the receivers
+// can measure the end-to-end delivery latency. The messages are padded to
+// size bytes, which shows what -readbufsize costs for long messages. The
+// first noisy clients send at noisyRate instead, to see how the quiet ones
+// fare next to them with -fairshare.
+func bench(cfg Config, clients int, rate float64, size int, noisy int, noisyRate float64, duration time.Duration) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fatal("Could not start the benchmark server", "err", err)
+	}
+	if max(rate, noisyRate) > 1.0/cfg.MessageRate.Seconds() {
+		slog.Warn("The rate exceeds the server limit, the clients are going to get banned", "rate", max(rate, noisyRate), "limit", 1.0/cfg.MessageRate.Seconds())
+	}
+	// All the simulated clients connect at once, let them through the
+	// connection rate limiter and the clients limit
+	if cfg.ConnBurst < clients {
+		cfg.ConnBurst = clients
+	}
+	if cfg.MaxClients > 0 && cfg.MaxClients < clients {
+		cfg.MaxClients = clients
+	}
+	slog.Info("Benchmarking", "clients", clients, "rate", rate, "noisy", noisy, "noisyrate", noisyRate, "size", size, "readbufsize", cfg.ReadBufSize, "fairshare", cfg.FairShare, "duration", duration)
+
+	// The server logs every single message which would dominate the run
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages := make(chan Message)
+	s := NewServer(cfg, &Files{})
+	go server(ctx, s, messages)
+	go accept(ctx, cfg, &s.files.Catalog, ln, s.connected, messages)
+
+	results := make(chan benchResult)
+	start := time.Now()
+	deadline := start.Add(duration)
+	for i := 0; i < clients; i++ {
+		if i < noisy {
+			go benchClient(ln.Addr().String(), noisyRate, true, size, deadline, results)
+		} else {
+			go benchClient(ln.Addr().String(), rate, false, size, deadline, results)
+		}
+	}
+
+	total := benchResult{}
+	for i := 0; i < clients; i++ {
+		result := <-results
+		total.sent += result.sent
+		total.latencies = append(total.latencies, result.latencies...)
+		total.noisyLatencies = append(total.noisyLatencies, result.noisyLatencies...)
+	}
+	elapsed := time.Since(start)
+	snapshot, _ := queryStats(ctx, messages)
+	slog.SetDefault(logger)
+
+	fmt.Printf("Clients:   %d (%d noisy)\n", clients, noisy)
+	fmt.Printf("Duration:  %s\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("Sent:      %d (%.2f msg/s)\n", total.sent, float64(total.sent)/elapsed.Seconds())
+	delivered := len(total.latencies) + len(total.noisyLatencies)
+	fmt.Printf("Delivered: %d (%.2f msg/s)\n", delivered, float64(delivered)/elapsed.Seconds())
+	fmt.Printf("Dropped:   %d, peak depth %d\n", snapshot.Stats.Dropped, snapshot.Stats.PeakDepth)
+	printLatency("Latency:  ", total.latencies)
+	printLatency("Noisy:    ", total.noisyLatencies)
+}
+
+func printLatency(label string, latencies []time.Duration) {
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	fmt.Printf("%s p50=%s p95=%s p99=%s\n", label,
+		percentile(latencies, 0.50),
+		percentile(latencies, 0.95),
+		percentile(latencies, 0.99))
+}
+
+func benchClient(addr string, rate float64, noisy bool, size int, deadline time.Time, results chan benchResult) {
+	result := benchResult{}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		results <- result
+		return
+	}
+
+	received := make(chan benchResult)
+	go func() {
+		latencies := benchResult{}
+		scanner := bufio.NewScanner(conn)
+		scanner.Buffer(make([]byte, 4096), maxMessageSize+1)
+		for scanner.Scan() {
+			// A padded message longer than maxLineLength arrives in
+			// pieces, the first one has the timestamp
+			text := scanner.Text()
+			if strings.HasPrefix(text, "[1/") {
+				_, text, _ = strings.Cut(text, "] ")
+			}
+			var sentAt int64
+			var class string
+			if _, err := fmt.Sscanf(text, "bench %d %s", &sentAt, &class); err == nil {
+				latency := time.Since(time.Unix(0, sentAt))
+				if strings.HasPrefix(class, "noisy") {
+					latencies.noisyLatencies = append(latencies.noisyLatencies, latency)
+				} else {
+					latencies.latencies = append(latencies.latencies, latency)
+				}
+			}
+		}
+		received <- latencies
+	}()
+
+	interval := time.Duration(float64(time.Second)/rate)
+	// Spread the clients out so they don't all fire on the same tick
+	time.Sleep(time.Duration(rand.Int63n(int64(interval))))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	timeout := time.After(time.Until(deadline))
+loop:
+	for {
+		class := "quiet"
+		if noisy {
+			class = "noisy"
+		}
+		line := fmt.Sprintf("bench %d %s ", time.Now().UnixNano(), class)
+		if pad := size - len(line) - 1; pad > 0 {
+			line += strings.Repeat("x", pad)
+		}
+		if _, err := fmt.Fprint(conn, line+"\n"); err != nil {
+			break
+		}
+		result.sent += 1
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			break loop
+		}
+	}
+	conn.Close()
+	latencies := <-received
+	result.latencies = latencies.latencies
+	result.noisyLatencies = latencies.noisyLatencies
+	results <- result
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	return sorted[int(p*float64(len(sorted)-1))]
+}
@@ -0,0 +1,151 @@
+// Package bot runs a chat bot on top of the client package: handlers are
+// registered for messages, joins and !commands, and their replies are sent
+// within the limits of the server.
+package bot
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/tsoding/4at/client"
+)
+
+// How many replies wait for the rate limit before new ones are dropped
+const replyQueueSize = 16
+
+// Reply is what a handler answers, nil for nothing
+type Reply struct {
+	Text string
+}
+
+// Join is the notice of the server about someone joining the room of the
+// bot. Nick is the name the server shows for them, their address if they
+// have no nick yet.
+type Join struct {
+	Nick string
+	Room string
+	Members int
+}
+
+var joinNotice = regexp.MustCompile(`^\[Server\] (\S+) joined (#\S+), (\d+) members now$`)
+
+func parseJoin(line string) (Join, bool) {
+	match := joinNotice.FindStringSubmatch(line)
+	if match == nil {
+		return Join{}, false
+	}
+	members, err := strconv.Atoi(match[3])
+	if err != nil {
+		return Join{}, false
+	}
+	return Join{Nick: match[1], Room: match[2], Members: members}, true
+}
+
+// Command is a message like "!quote 3" for the handler registered as
+// "quote"
+type Command struct {
+	Name string
+	Args []string
+	Message client.Incoming
+}
+
+// Bot dispatches the lines of the server to the handlers. Register them
+// before Run.
+type Bot struct {
+	// What the commands start with, "!" by default
+	Prefix string
+	onMessage []func(msg client.Incoming) *Reply
+	onJoin []func(join Join) *Reply
+	commands map[string]func(cmd Command) *Reply
+}
+
+func New() *Bot {
+	return &Bot{
+		Prefix: "!",
+		commands: map[string]func(cmd Command) *Reply{},
+	}
+}
+
+// OnMessage is called for every message of the other clients, commands
+// included
+func (bot *Bot) OnMessage(handler func(msg client.Incoming) *Reply) {
+	bot.onMessage = append(bot.onMessage, handler)
+}
+
+// OnJoin is called whenever someone joins the room of the bot
+func (bot *Bot) OnJoin(handler func(join Join) *Reply) {
+	bot.onJoin = append(bot.onJoin, handler)
+}
+
+// Command registers the handler of Prefix+name, replacing the previous one
+func (bot *Bot) Command(name string, handler func(cmd Command) *Reply) {
+	bot.commands[name] = handler
+}
+
+func (bot *Bot) dispatch(incoming client.Incoming) []*Reply {
+	var replies []*Reply
+	if incoming.Notice {
+		if join, ok := parseJoin(incoming.Text); ok {
+			for _, handler := range bot.onJoin {
+				replies = append(replies, handler(join))
+			}
+		}
+		return replies
+	}
+	for _, handler := range bot.onMessage {
+		replies = append(replies, handler(incoming))
+	}
+	if fields := strings.Fields(incoming.Text); len(fields) > 0 && strings.HasPrefix(fields[0], bot.Prefix) {
+		if handler := bot.commands[strings.TrimPrefix(fields[0], bot.Prefix)]; handler != nil {
+			replies = append(replies, handler(Command{
+				Name: strings.TrimPrefix(fields[0], bot.Prefix),
+				Args: fields[1:],
+				Message: incoming,
+			}))
+		}
+	}
+	return replies
+}
+
+// Run connects to the server and answers until ctx is done or the session
+// gives up reconnecting. The replies wait for the rate limit the server
+// advertised, so the bot never gets a strike, and the ones that can't wait
+// are dropped.
+func (bot *Bot) Run(ctx context.Context, addr string, opts ...client.Option) error {
+	session, err := client.Dial(addr, opts...)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		session.Close()
+	})
+	defer stop()
+
+	replies := make(chan string, replyQueueSize)
+	defer close(replies)
+	go func() {
+		for text := range replies {
+			if err := session.Send(text); err != nil {
+				slog.Warn("Bot could not send a reply", "err", err)
+			}
+		}
+	}()
+
+	for incoming := range session.Messages() {
+		for _, reply := range bot.dispatch(incoming) {
+			if reply == nil || reply.Text == "" {
+				continue
+			}
+			select {
+			case replies <- reply.Text:
+			default:
+				slog.Warn("Bot is replying too fast, dropping a reply")
+			}
+		}
+	}
+	session.Close()
+	return ctx.Err()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"time"
+)
+
+// ByeCode tells a client why the server hung up on it, so it can decide
+// whether and when to dial again. The codes are part of the protocol, the
+// bots match on them, don't rename them.
+type ByeCode string
+
+const (
+	ByeBanned ByeCode = "banned"
+	// Kicked out of #general, there is no room left to go back to
+	ByeKicked ByeCode = "kicked"
+	ByeIdle ByeCode = "idle"
+	ByeShutdown ByeCode = "shutdown"
+	// -maxclients
+	ByeFull ByeCode = "full"
+	// -connrate
+	ByeConnRate ByeCode = "connrate"
+	// Didn't take its lines within writeTimeout
+	ByeSlowConsumer ByeCode = "slow_consumer"
+	// -handshakedeadline
+	ByeHandshake ByeCode = "handshake_timeout"
+	ByeLineTooLong ByeCode = "line_too_long"
+	// Not speaking the protocol at all, like TLS on the plaintext port or
+	// a broken relay
+	ByeProtocol ByeCode = "protocol"
+	// A bug in the server, see the log
+	ByeServerError ByeCode = "server_error"
+)
+
+// A dead peer mustn't hold up server() while it's being hung up on
+const byeTimeout = 250*time.Millisecond
+
+// How long the clients are asked to wait after a shutdown, a restart
+// usually takes less
+const shutdownRetryAfter = 5*time.Second
+
+// How long the clients turned away by -maxclients are asked to wait, about
+// how long it takes for somebody to leave on a busy server
+const fullRetryAfter = 10*time.Second
+
+// bye is the last line a client gets, e.g. "BYE code=banned
+// retry_after=600". retry_after is in whole seconds, 0 when the client
+// may dial again right away.
+func bye(code ByeCode, retryAfter time.Duration) string {
+	return fmt.Sprintf("%s%s retry_after=%d\n", byePrefix, code, int(math.Ceil(max(retryAfter, 0).Seconds())))
+}
+
+// hangUp is how the server closes a connection on its own: it says why,
+// without waiting long for a peer that may be gone, and closes it. The
+// ClientDisconnected of the connection cleans up after it as usual.
+func hangUp(conn net.Conn, code ByeCode, retryAfter time.Duration) {
+	writeWithTimeout(conn, []byte(bye(code, retryAfter)), byeTimeout)
+	conn.Close()
+}
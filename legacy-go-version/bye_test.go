@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tsoding/4at/testutil"
+)
+
+// runClient runs client() on the conn, admitted or not yet
+func runClient(t *testing.T, cfg Config, conn net.Conn, admitted bool) chan Message {
+	t.Helper()
+	messages := make(chan Message, 16)
+	admittedCh := make(chan struct{})
+	if admitted {
+		close(admittedCh)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go client(ctx, cfg, &CatalogFile{}, conn, nextConnID(), messages, admittedCh)
+	return messages
+}
+
+// waitForBye waits for the connection to be hung up on and checks the last
+// line it got
+func waitForBye(t *testing.T, conn *testutil.FakeConn, want string) {
+	t.Helper()
+	select {
+	case <-conn.Done():
+	case <-time.After(5*time.Second):
+		t.Fatalf("not hung up on, got %q", conn.Written())
+	}
+	if !strings.HasSuffix(conn.Written(), want) {
+		t.Errorf("want it to end with %q, got %q", want, conn.Written())
+	}
+}
+
+// failOnceConn fails its first write like a client that stopped reading
+type failOnceConn struct {
+	*testutil.FakeConn
+	failed bool
+}
+
+func (c *failOnceConn) Write(b []byte) (int, error) {
+	if !c.failed {
+		c.failed = true
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.FakeConn.Write(b)
+}
+
+// Every way the server closes a connection on its own tells the client why
+func TestEveryHangUpSaysWhy(t *testing.T) {
+	t.Run("banned", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.StrikeLimit = 1
+		ts := startServer(t, cfg, nil)
+		mallory := ts.connect("10.0.0.1:1001")
+		mallory.Play(ScriptStep{After: time.Second, Line: garbage})
+		waitForBye(t, mallory.Conn, bye(ByeBanned, cfg.BanLimit))
+		again := ts.connect("10.0.0.1:1002")
+		waitForBye(t, again.Conn, bye(ByeBanned, cfg.BanLimit))
+	})
+
+	t.Run("kicked", func(t *testing.T) {
+		ts := startServer(t, adminConfig(t), nil)
+		admin := ts.connect("10.0.0.1:1001")
+		admin.Auth()
+		bob := ts.connect("10.0.0.2:1002")
+		bob.Play(ScriptStep{After: time.Second, Line: ":nick bob"})
+		admin.Play(ScriptStep{After: time.Second, Line: ":kick bob"})
+		waitForBye(t, bob.Conn, bye(ByeKicked, 0))
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.IdleTimeout = time.Second
+		clock := &fakeClock{now: time.Date(2024, 1, 14, 12, 0, 0, 0, time.UTC)}
+		s := NewServer(cfg, &Files{})
+		s.now = clock.Now
+		conn := connectIdleTest(t, s, "10.0.0.1:1001", 1)
+		clock.Advance(time.Minute)
+		s.disconnectIdle(clock.Now())
+		waitForBye(t, conn, bye(ByeIdle, 0))
+	})
+
+	t.Run("slow_consumer", func(t *testing.T) {
+		ts := startServer(t, testConfig(), nil)
+		// The greeting is the first write that fails
+		slow := &failOnceConn{FakeConn: testutil.NewFakeConn("10.0.0.2:1002")}
+		ts.s.connected.Add(1)
+		ts.messages <- Message{Type: ClientConnected, Conn: slow, ConnID: nextConnID(), Admitted: make(chan struct{})}
+		ts.sync()
+		waitForBye(t, slow.FakeConn, bye(ByeSlowConsumer, 0))
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		s := NewServer(testConfig(), &Files{})
+		conn := connectIdleTest(t, s, "10.0.0.1:1001", 1)
+		s.close()
+		waitForBye(t, conn, bye(ByeShutdown, shutdownRetryAfter))
+	})
+
+	t.Run("full", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.MaxClients = 1
+		first, second := testutil.NewFakeConn("10.0.0.1:1001"), testutil.NewFakeConn("10.0.0.2:1002")
+		ln := &scriptedListener{script: []any{first, second}}
+		var connected atomic.Int32
+		accept(context.Background(), cfg, &CatalogFile{}, ln, &connected, make(chan Message, 1))
+		waitForBye(t, second, bye(ByeFull, fullRetryAfter))
+	})
+
+	t.Run("connrate", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.ConnRate = 0.1
+		cfg.ConnBurst = 1
+		first, second := testutil.NewFakeConn("10.0.0.1:1001"), testutil.NewFakeConn("10.0.0.2:1002")
+		ln := &scriptedListener{script: []any{first, second}}
+		var connected atomic.Int32
+		accept(context.Background(), cfg, &CatalogFile{}, ln, &connected, make(chan Message, 1))
+		waitForBye(t, second, bye(ByeConnRate, 10*time.Second))
+	})
+
+	t.Run("handshake_timeout", func(t *testing.T) {
+		conn := testutil.NewFakeConn("10.0.0.1:1001")
+		conn.SetReadDeadline(time.Now().Add(10*time.Millisecond))
+		runClient(t, testConfig(), conn, false)
+		waitForBye(t, conn, bye(ByeHandshake, 0))
+	})
+
+	t.Run("line_too_long", func(t *testing.T) {
+		cfg := testConfig()
+		conn := testutil.NewFakeConn("10.0.0.1:1001")
+		runClient(t, cfg, conn, true)
+		// The length is checked a full buffer at a time
+		conn.Feed(strings.Repeat("x", maxClientLine+2*cfg.ReadBufSize))
+		waitForBye(t, conn, bye(ByeLineTooLong, 0))
+	})
+
+	t.Run("protocol", func(t *testing.T) {
+		conn := testutil.NewFakeConn("10.0.0.1:1001")
+		runClient(t, testConfig(), conn, true)
+		conn.Feed(string(clientHello(t)))
+		waitForBye(t, conn, bye(ByeProtocol, 0))
+	})
+
+	t.Run("server_error", func(t *testing.T) {
+		conn := panickingConn{testutil.NewFakeConn("10.0.0.1:1001")}
+		runClient(t, testConfig(), conn, true)
+		conn.Feed("boom\n")
+		waitForBye(t, conn.FakeConn, bye(ByeServerError, 0))
+	})
+}
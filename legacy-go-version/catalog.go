@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// CatalogData is what the catalog templates are rendered with, every
+// message uses the few fields it needs, e.g. "You are in {{.Room}} now"
+type CatalogData struct {
+	Nick string
+	Room string
+	// A topic, a setting, a command name
+	Text string
+	Count int
+	Limit int
+	Duration time.Duration
+	// How long the client has to wait, next to a Duration that says why
+	Wait time.Duration
+	InviteOnly bool
+}
+
+var catalogFuncs = template.FuncMap{
+	// "30 minutes" rather than "30m0s"
+	"human": humanDuration,
+	// The largest unit only, "3h"
+	"coarse": coarseDuration,
+	// Whole seconds, "42s"
+	"round": func(d time.Duration) string {
+		return d.Round(time.Second).String()
+	},
+	// Fractional seconds, "41.900000"
+	"seconds": func(d time.Duration) string {
+		return fmt.Sprintf("%f", d.Seconds())
+	},
+}
+
+// builtinCatalog is every line the server says to the clients in plain
+// words, by key. The protocol lines the bots parse, LIMITS, BYE and the
+// history markers, are not here, they must not change. A -messages file
+// overrides any of these, the keys are the same.
+var builtinCatalog = map[string]string{
+	// Connections
+	"server_full": "Server full, try again later",
+	"tls_on_plaintext": "This is the plaintext port, there is no TLS here",
+	"banned": "You are banned MF{{if .Text}}: {{.Text}}{{end}}",
+	"ban_countdown": "You are banned MF: {{seconds .Duration}} secs left",
+	"idle_disconnect": "Disconnecting due to inactivity for more than {{human .Duration}}",
+	"motd_updated": "MOTD updated. Use :motd to view it.",
+	"no_motd": "There is no MOTD",
+	"busy_dropped": "The server is busy, your messages are dropped until the ones before them are delivered",
+	"skipped": "…skipped {{.Count}} messages…",
+
+	// Messages
+	"too_fast": "Your message was not delivered: you are sending too fast",
+	"invalid_utf8": "Your message was not delivered: it is not valid UTF-8",
+	"binary": "This doesn't look like text, the server only takes lines of UTF-8 text",
+	"too_long": "Your message was not delivered: it is longer than {{.Limit}} bytes",
+	"blocked_word": "Your message contains a blocked word",
+	"blocked_pattern": "Your message is not allowed here",
+	"muted": "You are muted in {{.Room}} for {{round .Wait}} more",
+	"room_slow_mode": "{{.Room}} is in slow mode: 1 message per {{.Duration}}, wait {{round .Wait}}",
+	"permission_denied": "Permission denied",
+
+	// Admin
+	"wrong_password": "Wrong password",
+	"admin": "You are an admin now",
+	"admin_disabled": "Admin access is disabled on this server",
+	"reloading": "Reloading the configuration, see the server log for the result",
+	"banned_ok": "Banned",
+	"not_banned": "Not banned",
+	"unbanned": "Unbanned",
+	"audit_empty": "No moderation actions yet",
+	"log_level": "Log level is {{.Text}} now",
+	"slow_mode_on": "Slow mode activated: 1 message per {{.Count}} seconds",
+	"slow_mode_off": "Slow mode deactivated",
+	"export_busy": "Another export is running, try again later",
+	"exported": "Exported {{.Count}} messages to {{.Text}}",
+	"export_failed": "Export failed: {{.Text}}",
+
+	// History and search
+	"history_on": "The history will be replayed when you join",
+	"history_off": "The history won't be replayed when you join",
+	"history_wait": "You can ask for the history again in {{round .Wait}}",
+	"history_empty": "The history is empty",
+	"history_short": "Only {{.Count}} messages in the history",
+	"search_disabled": "Search is disabled on this server",
+	"search_failed": "Search failed",
+	"search_nothing": "Nothing found",
+
+	// Nicks and settings
+	"nick_taken": "The nick {{.Nick}} is taken",
+	"nick_set": "You are known as {{.Nick}} now",
+	"nick_wait": "You can change your nick again in {{round .Wait}}",
+	"nick_changed": "{{.Text}} is now known as {{.Nick}}",
+	"ignored": "You ignore {{.Nick}} now",
+	"unignored": "You don't ignore {{.Nick}} any more",
+	"echo": "Echo is {{.Text}} now",
+	"format": "Format is {{.Text}} now",
+	"relay_disabled": "Relaying is disabled on this server",
+	"relay_wrong_token": "Wrong relay token",
+
+	// Accounts
+	"accounts_disabled": "Accounts are disabled on this server",
+	"account_exists": "The nick {{.Nick}} is registered already",
+	"account_failed": "Something went wrong with the accounts, try again later",
+	"nick_registered": "The nick {{.Nick}} is registered, :login to use it",
+	"password_length": "The password must be {{.Count}} to {{.Limit}} bytes long",
+	"login_wait": "Too many attempts, try again in {{round .Wait}}",
+	"login_failed": "Wrong nick or password",
+	"logged_in": "You are logged in as {{.Nick}}",
+	"not_logged_in": "You are not logged in",
+	"passwd_changed": "Your password is changed",
+	"msg_unregistered": "{{.Nick}} is not a registered nick, :msg only reaches those",
+	"msg_sent": "Message sent to {{.Nick}}",
+	"msg_queued": "{{.Nick}} is offline, the message waits for their next login",
+	"private_message": "[message from {{.Nick}}] {{.Text}}",
+	"offline_message": "[offline message from {{.Nick}}, {{coarse .Duration}} ago] {{.Text}}",
+
+	// Rooms
+	"room_joined": "You are in {{.Room}} now",
+	"room_already": "You are already in {{.Room}}",
+	"room_default": "You can't leave {{.Room}}, :join another room instead",
+	"room_back": "You are back in {{.Room}}",
+	"room_someone_joined": "{{.Nick}} joined {{.Room}}, {{.Count}} members now",
+	"room_someone_left": "{{.Nick}} left {{.Room}}, {{.Count}} members now",
+	"room_limit": "Room limit reached: cannot create more than {{.Limit}} rooms",
+	"room_invite_only": "{{.Room}} is invite only",
+	"room_full": "Room {{.Room}} is full (max {{.Limit}} users)",
+	"room_unknown": "There is no room {{.Room}}",
+	"room_info": "{{.Room}}: {{.Count}} members{{if .Limit}} out of {{.Limit}}{{end}}{{if .InviteOnly}}, invite only{{end}}{{if .Duration}}, slow mode: 1 message per {{.Duration}}{{end}}{{if .Text}}, topic: {{.Text}}{{end}}",
+	"topic": "Topic of {{.Room}}: {{.Text}}",
+	"no_topic": "{{.Room}} has no topic",
+	"topic_set": "Topic of {{.Room}} set by {{.Nick}}: {{.Text}}",
+	"room_slow_mode_on": "Slow mode in {{.Room}}: 1 message per {{.Duration}}",
+	"room_slow_mode_off": "Slow mode in {{.Room}} deactivated",
+	"nobody": "Nobody is called {{.Nick}}",
+	"nobody_in_room": "Nobody is called {{.Nick}} in {{.Room}}",
+	"invited": "Invited {{.Nick}} to {{.Room}}",
+	"invitation": "You are invited to {{.Room}}, :join {{.Room}} to accept",
+	"op": "{{.Nick}} is an operator of {{.Room}} now",
+	"deop": "{{.Nick}} is no longer an operator of {{.Room}}",
+	"kicked": "You were kicked from {{.Room}}",
+	"room_muted": "You are muted in {{.Room}} for {{.Duration}}",
+	"room_unmuted": "You can talk in {{.Room}} again",
+
+	// Usage of the commands
+	"usage": "Usage: {{.Text}}",
+}
+
+// The built-in templates are part of the binary, a broken one is a bug
+var builtinTemplates = func() map[string]*template.Template {
+	templates, err := parseCatalog(builtinCatalog)
+	if err != nil {
+		panic(err)
+	}
+	return templates
+}()
+
+// parseCatalog parses every template and renders it once with empty data,
+// so a misspelled field is caught on load rather than in front of a client
+func parseCatalog(texts map[string]string) (map[string]*template.Template, error) {
+	templates := map[string]*template.Template{}
+	var errs []string
+	for key, text := range texts {
+		tmpl, err := template.New(key).Funcs(catalogFuncs).Option("missingkey=error").Parse(text)
+		if err == nil {
+			err = tmpl.Execute(&strings.Builder{}, CatalogData{})
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		templates[key] = tmpl
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return templates, nil
+}
+
+// CatalogFile is the -messages file, a JSON object of the messages to
+// override by key, see builtinCatalog. The keys it leaves out keep their
+// built-in text.
+type CatalogFile struct {
+	mu sync.RWMutex
+	templates map[string]*template.Template
+}
+
+// Load replaces the overrides only if every one of them is valid, a broken
+// file keeps the previous ones
+func (catalog *CatalogFile) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var texts map[string]string
+	if err := json.Unmarshal(data, &texts); err != nil {
+		return err
+	}
+	var unknown []string
+	for key := range texts {
+		if _, ok := builtinCatalog[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown keys: %s", strings.Join(unknown, ", "))
+	}
+	templates, err := parseCatalog(texts)
+	if err != nil {
+		return err
+	}
+	catalog.mu.Lock()
+	defer catalog.mu.Unlock()
+	catalog.templates = templates
+	return nil
+}
+
+// Render says the message of the key, without a trailing newline
+func (catalog *CatalogFile) Render(key string, data CatalogData) string {
+	catalog.mu.RLock()
+	tmpl, ok := catalog.templates[key]
+	catalog.mu.RUnlock()
+	if !ok {
+		tmpl, ok = builtinTemplates[key]
+		if !ok {
+			panic("unknown catalog key " + key)
+		}
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		slog.Error("Could not render a message, using the built-in one", "event", "catalog", "key", key, "err", err)
+		sb.Reset()
+		builtinTemplates[key].Execute(&sb, data)
+	}
+	return sb.String()
+}
+
+// Notice renders the message of the key as a line from the server
+func (catalog *CatalogFile) Notice(key string, data CatalogData) Line {
+	return Line{Kind: SystemLine, Text: catalog.Render(key, data)}
+}
+
+// say renders the message of the key, see CatalogFile.Render
+func (s *Server) say(key string, data CatalogData) string {
+	return s.files.Catalog.Render(key, data)
+}
+
+// tell writes the message of the key to the client as a line of its own
+func (s *Server) tell(client *Client, key string, data CatalogData) {
+	client.Write(s.say(key, data) + "\n")
+}
+
+// notice renders the message of the key as a line from the server
+func (s *Server) notice(key string, data CatalogData) Line {
+	return s.files.Catalog.Notice(key, data)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEveryMessageRendersWithEdgeCaseData(t *testing.T) {
+	for name, data := range map[string]CatalogData{
+		"zero": {},
+		"huge": {
+			Nick: "alice",
+			Room: "#general",
+			Text: "reason",
+			Count: math.MaxInt,
+			Limit: math.MaxInt,
+			Duration: time.Duration(math.MaxInt64),
+			Wait: time.Duration(math.MaxInt64),
+			InviteOnly: true,
+		},
+		"empty nick": {
+			Room: "#general",
+			Count: 1,
+			Limit: 1,
+			Duration: time.Second,
+			Wait: time.Millisecond,
+		},
+	} {
+		for key := range builtinCatalog {
+			var sb strings.Builder
+			if err := builtinTemplates[key].Execute(&sb, data); err != nil {
+				t.Errorf("%s with %s data: %s", key, name, err)
+				continue
+			}
+			if text := sb.String(); text == "" || strings.Contains(text, "<no value>") {
+				t.Errorf("%s with %s data gives %q", key, name, text)
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// startupCheck is one thing the server needs to start, checked with the
+// same function the startup uses
+type startupCheck struct {
+	name string
+	run func() error
+}
+
+// startupChecks lists what -check and -dryrun verify. The checks only read
+// files and release the ports they bind, nothing is served or written.
+func startupChecks(cfg Config) []startupCheck {
+	checks := []startupCheck{
+		{"configuration", cfg.Validate},
+		{"port " + cfg.Port, func() error {
+			ln, _, err := listen(cfg.Port, cfg.PortRetry)
+			if err != nil {
+				return errors.New(listenError(cfg.Port, err))
+			}
+			return ln.Close()
+		}},
+	}
+	files := &Files{}
+	for _, file := range files.reloadables(cfg) {
+		file := file
+		if file.path != "" {
+			checks = append(checks, startupCheck{file.name + " " + file.path, func() error {
+				return file.load(file.path)
+			}})
+		}
+	}
+	if cfg.RegexFilterPath != "" {
+		// A broken pattern doesn't stop the startup, but it's still a
+		// mistake worth catching before a restart
+		checks = append(checks, startupCheck{"regex patterns", func() error {
+			if compileErrors := files.RegexFilter.RegexCompileErrors(); len(compileErrors) > 0 {
+				return errors.New(strings.Join(compileErrors, "; "))
+			}
+			return nil
+		}})
+	}
+	if cfg.AdminCA != "" {
+		checks = append(checks, startupCheck{"admin CA " + cfg.AdminCA, func() error {
+			_, err := loadCertPool(cfg.AdminCA)
+			return err
+		}})
+	}
+	if cfg.LetsEncrypt != "" && cfg.CertCacheDir != "" {
+		checks = append(checks, startupCheck{"certificate cache " + cfg.CertCacheDir, func() error {
+			return existingDir(cfg.CertCacheDir, true)
+		}})
+	}
+	for _, path := range []string{cfg.TranscriptPath, cfg.AuditFile, cfg.HistoryDB, cfg.AccountsDB} {
+		path := path
+		if path != "" {
+			checks = append(checks, startupCheck{"directory of " + path, func() error {
+				return existingDir(filepath.Dir(path), false)
+			}})
+		}
+	}
+	if cfg.DebugAddr != "" {
+		checks = append(checks, startupCheck{"debug address " + cfg.DebugAddr, func() error {
+			ln, err := net.Listen("tcp", cfg.DebugAddr)
+			if err != nil {
+				return err
+			}
+			return ln.Close()
+		}})
+	}
+	return checks
+}
+
+// existingDir fails unless path is a directory, or may still be created
+// when missing is fine
+func existingDir(path string, missingOk bool) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) && missingOk {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	return nil
+}
+
+// runChecks runs every check, even after a failure, and returns the
+// failures
+func runChecks(checks []startupCheck, report func(check startupCheck, err error)) []error {
+	var errs []error
+	for _, check := range checks {
+		err := check.run()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", check.name, err))
+		}
+		report(check, err)
+	}
+	return errs
+}
+
+// check is -check: it reports on every startup check and exits with 1 if
+// any failed, ready for systemd's ExecStartPre
+func check(cfg Config) int {
+	errs := runChecks(startupChecks(cfg), func(check startupCheck, err error) {
+		if err != nil {
+			fmt.Printf("FAIL  %s: %s\n", check.name, err)
+		} else {
+			fmt.Printf("ok    %s\n", check.name)
+		}
+	})
+	if len(errs) > 0 {
+		fmt.Printf("%d of the checks failed\n", len(errs))
+		return 1
+	}
+	fmt.Println("Everything is ready to start")
+	return 0
+}
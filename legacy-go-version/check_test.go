@@ -0,0 +1,69 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// checkConfig is a configuration every startup check passes with
+func checkConfig(t *testing.T) Config {
+	t.Helper()
+	cfg := testConfig()
+	cfg.Port = "0"
+	cfg.MotdPath = writeFile(t, "motd.txt", "Hello\n")
+	cfg.WordlistPath = writeFile(t, "wordlist.txt", "spam\n")
+	cfg.RegexFilterPath = writeFile(t, "patterns.txt", "^buy .* now$\n")
+	cfg.LetsEncrypt = "chat.example.com"
+	cfg.CertCacheDir = t.TempDir()
+	cfg.AdminCA = newTestCA(t, "4at admins").pemFile(t)
+	cfg.TranscriptPath = filepath.Join(t.TempDir(), "transcript.jsonl")
+	return cfg
+}
+
+// failedChecks runs the startup checks and returns the failures
+func failedChecks(cfg Config) []error {
+	return runChecks(startupChecks(cfg), func(startupCheck, error) {})
+}
+
+func TestCheckPassesAGoodConfig(t *testing.T) {
+	if testing.Short() {
+		t.Skip("binds a real port")
+	}
+	if errs := failedChecks(checkConfig(t)); len(errs) > 0 {
+		t.Errorf("a good config failed %v", errs)
+	}
+	if code := check(checkConfig(t)); code != 0 {
+		t.Errorf("-check exited with %d", code)
+	}
+}
+
+func TestCheckReportsAMissingCertificate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("binds a real port")
+	}
+	cfg := checkConfig(t)
+	cfg.AdminCA = filepath.Join(t.TempDir(), "missing.pem")
+	errs := failedChecks(cfg)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "admin CA "+cfg.AdminCA) {
+		t.Errorf("got %v", errs)
+	}
+	if code := check(cfg); code != 1 {
+		t.Errorf("-check exited with %d", code)
+	}
+}
+
+func TestCheckReportsAnUnparseableFilter(t *testing.T) {
+	if testing.Short() {
+		t.Skip("binds a real port")
+	}
+	cfg := checkConfig(t)
+	cfg.RegexFilterPath = writeFile(t, "patterns.txt", "fine\n(unclosed\n")
+	errs := failedChecks(cfg)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "regex patterns") || !strings.Contains(errs[0].Error(), "unclosed") {
+		t.Errorf("got %v", errs)
+	}
+	if code := check(cfg); code != 1 {
+		t.Errorf("-check exited with %d", code)
+	}
+}
@@ -0,0 +1,374 @@
+// Package client talks to a 4at server: it dials it, splits what the server
+// sends into lines, keeps the messages within the advertised limits and
+// dials again with a backoff when the connection is lost.
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The lines starting with one of these come from the server itself, the
+// server escapes them when a client sends them
+var noticePrefixes = []string{"[Server]", "[Announcement]", "---", byePrefix}
+
+const limitsPrefix = "LIMITS "
+
+const byePrefix = "BYE code="
+
+// The longest line Messages delivers, longer ones end the connection
+const maxLineSize = 1024*1024
+
+var ErrClosed = errors.New("client: session closed")
+var ErrDisconnected = errors.New("client: not connected")
+
+// Incoming is one line from the server, without its newline
+type Incoming struct {
+	Text string
+	// Notice is set for the lines of the server itself: joins, kicks,
+	// announcements, history markers
+	Notice bool
+}
+
+// Limits are the ones the server advertised with its LIMITS line
+type Limits struct {
+	Rate time.Duration
+	MaxLen int
+	Strikes int
+	Ban time.Duration
+	// Between two nick changes, 0 when the server doesn't say
+	Nick time.Duration
+}
+
+// Bye is why the server closed the connection, from the last line it sent
+type Bye struct {
+	// Stable, like "banned", "shutdown" or "full"
+	Code string
+	// How long the server asks to wait before dialing again
+	RetryAfter time.Duration
+}
+
+func parseBye(line string) (Bye, bool) {
+	var bye Bye
+	if !strings.HasPrefix(line, byePrefix) {
+		return bye, false
+	}
+	fields := strings.Fields(line[len(byePrefix):])
+	if len(fields) == 0 {
+		return bye, false
+	}
+	bye.Code = fields[0]
+	for _, field := range fields[1:] {
+		name, value, _ := strings.Cut(field, "=")
+		if name == "retry_after" {
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return bye, false
+			}
+			bye.RetryAfter = time.Duration(seconds)*time.Second
+		}
+	}
+	return bye, true
+}
+
+func parseLimits(line string) (Limits, bool) {
+	var limits Limits
+	if !strings.HasPrefix(line, limitsPrefix) {
+		return limits, false
+	}
+	for _, field := range strings.Fields(line[len(limitsPrefix):]) {
+		name, value, _ := strings.Cut(field, "=")
+		var err error
+		switch name {
+		case "rate":
+			limits.Rate, err = time.ParseDuration(value)
+		case "max_len":
+			limits.MaxLen, err = strconv.Atoi(value)
+		case "strikes":
+			limits.Strikes, err = strconv.Atoi(value)
+		case "ban":
+			limits.Ban, err = time.ParseDuration(value)
+		case "nick":
+			limits.Nick, err = time.ParseDuration(value)
+		}
+		if err != nil {
+			return limits, false
+		}
+	}
+	return limits, true
+}
+
+type options struct {
+	tls *tls.Config
+	nick string
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	dialTimeout time.Duration
+}
+
+type Option func(*options)
+
+// WithTLS dials the server with TLS
+func WithTLS(cfg *tls.Config) Option {
+	return func(o *options) {
+		o.tls = cfg
+	}
+}
+
+// WithNick picks the nick on every connection, reconnects included
+func WithNick(nick string) Option {
+	return func(o *options) {
+		o.nick = nick
+	}
+}
+
+// WithReconnect sets the wait before dialing again, doubled on every
+// failure in a row up to max. A zero max never reconnects.
+func WithReconnect(min time.Duration, max time.Duration) Option {
+	return func(o *options) {
+		o.minBackoff = min
+		o.maxBackoff = max
+	}
+}
+
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.dialTimeout = timeout
+	}
+}
+
+// Session is a connection to a server that survives reconnects. Its methods
+// are safe to call from several goroutines.
+type Session struct {
+	addr string
+	opts options
+	messages chan Incoming
+	done chan struct{}
+
+	mu sync.Mutex
+	conn net.Conn
+	closed bool
+	limits Limits
+	// Of the last connection the server closed, see Bye
+	bye *Bye
+	// The server counts the connection as the first message
+	connected time.Time
+
+	// Held for the whole Send, so the waits for the rate limit queue up
+	sendMu sync.Mutex
+	lastSent time.Time
+}
+
+// Dial connects to addr, failing if the first connection does. The later
+// ones are retried in the background.
+func Dial(addr string, opts ...Option) (*Session, error) {
+	session := &Session{
+		addr: addr,
+		opts: options{
+			minBackoff: time.Second,
+			maxBackoff: 30*time.Second,
+			dialTimeout: 10*time.Second,
+		},
+		messages: make(chan Incoming, 64),
+		done: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&session.opts)
+	}
+	conn, err := session.dial()
+	if err != nil {
+		return nil, err
+	}
+	go session.run(conn)
+	return session, nil
+}
+
+func (session *Session) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: session.opts.dialTimeout}
+	var conn net.Conn
+	var err error
+	if session.opts.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", session.addr, session.opts.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", session.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.closed {
+		conn.Close()
+		return nil, ErrClosed
+	}
+	session.conn = conn
+	// A new connection starts from the default rate of the server until
+	// its LIMITS line comes
+	session.limits = Limits{Rate: time.Second}
+	session.connected = time.Now()
+	return conn, nil
+}
+
+// Messages delivers the lines from the server. It is closed once the
+// session is closed or gives up reconnecting.
+func (session *Session) Messages() <-chan Incoming {
+	return session.messages
+}
+
+// Limits returns the limits the server sent on the current connection
+func (session *Session) Limits() Limits {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.limits
+}
+
+// Bye returns why the server closed the last connection it closed, false
+// when it never did. The session waits RetryAfter before dialing again.
+func (session *Session) Bye() (Bye, bool) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.bye == nil {
+		return Bye{}, false
+	}
+	return *session.bye, true
+}
+
+// Send sends one message. It waits for the rate limit of the server so the
+// session doesn't collect strikes, and fails while reconnecting.
+func (session *Session) Send(text string) error {
+	session.sendMu.Lock()
+	defer session.sendMu.Unlock()
+	session.mu.Lock()
+	limits, last := session.limits, session.connected
+	session.mu.Unlock()
+	if session.lastSent.After(last) {
+		last = session.lastSent
+	}
+	if limits.MaxLen > 0 && len(text)+1 > limits.MaxLen {
+		return errors.New("client: message is longer than " + strconv.Itoa(limits.MaxLen) + " bytes")
+	}
+	// Some headroom keeps the clock of the server from seeing the
+	// messages closer than they were sent
+	if wait := time.Until(last.Add(limits.Rate + limits.Rate/10)); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-session.done:
+			return ErrClosed
+		}
+	}
+	session.mu.Lock()
+	conn, closed := session.conn, session.closed
+	session.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if conn == nil {
+		return ErrDisconnected
+	}
+	_, err := conn.Write([]byte(text + "\n"))
+	session.lastSent = time.Now()
+	return err
+}
+
+// Close ends the session and its connection
+func (session *Session) Close() error {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.closed {
+		return ErrClosed
+	}
+	session.closed = true
+	close(session.done)
+	if session.conn != nil {
+		return session.conn.Close()
+	}
+	return nil
+}
+
+func (session *Session) run(conn net.Conn) {
+	defer close(session.messages)
+	backoff := session.opts.minBackoff
+	for {
+		if session.opts.nick != "" {
+			go session.Send(":nick " + session.opts.nick)
+		}
+		bye, received := session.read(conn)
+		if received {
+			backoff = session.opts.minBackoff
+		}
+		session.mu.Lock()
+		session.conn = nil
+		session.mu.Unlock()
+		conn.Close()
+		if session.opts.maxBackoff <= 0 {
+			return
+		}
+		// A banned client dialing again every second only gets
+		// turned away, the server says how long to wait
+		wait := backoff
+		if bye != nil {
+			wait = max(wait, bye.RetryAfter)
+		}
+		for {
+			select {
+			case <-time.After(wait):
+			case <-session.done:
+				return
+			}
+			backoff = min(backoff*2, session.opts.maxBackoff)
+			wait = backoff
+			var err error
+			conn, err = session.dial()
+			if errors.Is(err, ErrClosed) {
+				return
+			}
+			if err == nil {
+				break
+			}
+		}
+	}
+}
+
+// read delivers the lines until the connection breaks and tells whether
+// any line came through, and the BYE of the server if it sent one
+func (session *Session) read(conn net.Conn) (*Bye, bool) {
+	var last *Bye
+	received := false
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxLineSize)
+	for scanner.Scan() {
+		received = true
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if limits, ok := parseLimits(line); ok {
+			session.mu.Lock()
+			session.limits = limits
+			session.mu.Unlock()
+			continue
+		}
+		if bye, ok := parseBye(line); ok {
+			last = &bye
+			session.mu.Lock()
+			session.bye = &bye
+			session.mu.Unlock()
+		}
+		incoming := Incoming{Text: line}
+		for _, prefix := range noticePrefixes {
+			if strings.HasPrefix(line, prefix) {
+				incoming.Notice = true
+				break
+			}
+		}
+		select {
+		case session.messages <- incoming:
+		case <-session.done:
+			return last, received
+		}
+	}
+	return last, received
+}
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBye(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want Bye
+		ok bool
+	}{
+		{"BYE code=kicked", Bye{Code: "kicked"}, true},
+		{"BYE code=banned retry_after=600", Bye{Code: "banned", RetryAfter: 10*time.Minute}, true},
+		{"BYE code=full retry_after=30 reason=busy", Bye{Code: "full", RetryAfter: 30*time.Second}, true},
+		{"BYE code=banned retry_after=soon", Bye{}, false},
+		{"BYE code=", Bye{}, false},
+		{"BYE everybody", Bye{}, false},
+		{"[Server] BYE code=banned", Bye{}, false},
+	} {
+		got, ok := parseBye(tc.line)
+		if ok != tc.ok || ok && got != tc.want {
+			t.Errorf("parseBye(%q) = %+v, %t, want %+v, %t", tc.line, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	got, ok := parseLimits("LIMITS rate=1s max_len=8192 strikes=10 ban=10m0s nick=1m0s")
+	want := Limits{Rate: time.Second, MaxLen: 8192, Strikes: 10, Ban: 10*time.Minute, Nick: time.Minute}
+	if !ok || got != want {
+		t.Errorf("got %+v, %t, want %+v", got, ok, want)
+	}
+	// The fields a newer server adds are skipped, the older servers don't
+	// say the nick interval
+	got, ok = parseLimits("LIMITS rate=500ms max_len=512 strikes=3 ban=1h0m0s rooms=5")
+	want = Limits{Rate: 500*time.Millisecond, MaxLen: 512, Strikes: 3, Ban: time.Hour}
+	if !ok || got != want {
+		t.Errorf("got %+v, %t, want %+v", got, ok, want)
+	}
+	for _, line := range []string{"LIMITS rate=fast", "LIMITS max_len=-", "limits rate=1s", "[Server] LIMITS rate=1s"} {
+		if _, ok := parseLimits(line); ok {
+			t.Errorf("parseLimits(%q) parsed", line)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// 4at-client is a line oriented terminal client for 4at: every line typed
+// is sent as a message and every line of the server is printed.
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/tsoding/4at/client"
+)
+
+func main() {
+	nick := flag.String("nick", "", "Nick to pick on every connection")
+	useTLS := flag.Bool("tls", false, "Connect with TLS")
+	insecure := flag.Bool("insecure", false, "With -tls, accept any certificate the server presents")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <host:port>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var opts []client.Option
+	if *nick != "" {
+		opts = append(opts, client.WithNick(*nick))
+	}
+	if *useTLS {
+		opts = append(opts, client.WithTLS(&tls.Config{InsecureSkipVerify: *insecure}))
+	}
+	session, err := client.Dial(flag.Arg(0), opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	go func() {
+		for incoming := range session.Messages() {
+			fmt.Println(incoming.Text)
+		}
+		fmt.Fprintln(os.Stderr, "Disconnected")
+		os.Exit(0)
+	}()
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		if err := session.Send(scanner.Text()); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		}
+	}
+	session.Close()
+}
@@ -0,0 +1,65 @@
+// 4at-quotebot is an example of the bot package: it greets whoever joins
+// its room and answers !quote, !uptime and !help.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"github.com/tsoding/4at/bot"
+	"github.com/tsoding/4at/client"
+)
+
+var quotes = []string{
+	"Premature optimization is the root of all evil.",
+	"Simplicity is prerequisite for reliability.",
+	"Make it work, make it right, make it fast.",
+	"Talk is cheap. Show me the code.",
+	"Clear is better than clever.",
+}
+
+func main() {
+	nick := flag.String("nick", "quotebot", "Nick of the bot")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <host:port>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	started := time.Now()
+	b := bot.New()
+	b.OnJoin(func(join bot.Join) *bot.Reply {
+		return &bot.Reply{Text: fmt.Sprintf("Welcome to %s, %s! Type !help to see what I can do", join.Room, join.Nick)}
+	})
+	b.Command("quote", func(cmd bot.Command) *bot.Reply {
+		if len(cmd.Args) > 0 {
+			if n, err := strconv.Atoi(cmd.Args[0]); err == nil && n >= 1 && n <= len(quotes) {
+				return &bot.Reply{Text: quotes[n-1]}
+			}
+		}
+		return &bot.Reply{Text: quotes[rand.Intn(len(quotes))]}
+	})
+	b.Command("uptime", func(cmd bot.Command) *bot.Reply {
+		return &bot.Reply{Text: "Up for " + time.Since(started).Round(time.Second).String()}
+	})
+	b.Command("help", func(cmd bot.Command) *bot.Reply {
+		return &bot.Reply{Text: fmt.Sprintf("!quote [1-%d], !uptime, !help", len(quotes))}
+	})
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if err := b.Run(ctx, flag.Arg(0), client.WithNick(*nick)); err != nil && err != context.Canceled {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,54 @@
+// transcript-dump prints the transcripts written by the server with
+// -transcript in a human readable form.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tsoding/4at/transcript"
+)
+
+func dump(r io.Reader) error {
+	reader := transcript.NewReader(r)
+	for {
+		entry, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		room := ""
+		if entry.Room != "" {
+			room = " " + entry.Room
+		}
+		fmt.Printf("%s #%s%s %s: %s\n", entry.Time.Format("2006-01-02 15:04:05"), entry.ID, room, entry.Sender, strings.TrimRight(entry.Text, "\r\n"))
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		if err := dump(os.Stdin); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	for _, path := range os.Args[1:] {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			os.Exit(1)
+		}
+		err = dump(file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %s\n", path, err)
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsoding/4at/transcript"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Cmd int
+const (
+	Version Cmd = iota + 1
+	Auth
+	Motd
+	NoHistory
+	ShowHistory
+	Search
+	Join
+	Part
+	Rooms
+	Topic
+	Nick
+	Invite
+	RoomSet
+	RoomInfo
+	Op
+	Deop
+	Kick
+	Mute
+	Names
+	Echo
+	RelayAuth
+	Format
+	Register
+	Login
+	Passwd
+	Msg
+	Ignore
+	Unignore
+)
+
+// How often a client may ask for the history, replaying it is a big write
+const historyRate = 10*time.Second
+
+var commands = map[string]Cmd{
+	":version": Version,
+	":auth": Auth,
+	":motd": Motd,
+	":nohistory": NoHistory,
+	":history": ShowHistory,
+	":search": Search,
+	":join": Join,
+	":part": Part,
+	":rooms": Rooms,
+	":topic": Topic,
+	":nick": Nick,
+	":invite": Invite,
+	":roomset": RoomSet,
+	":roominfo": RoomInfo,
+	":op": Op,
+	":deop": Deop,
+	":kick": Kick,
+	":mute": Mute,
+	":names": Names,
+	":echo": Echo,
+	":relay": RelayAuth,
+	":format": Format,
+	":register": Register,
+	":login": Login,
+	":passwd": Passwd,
+	":msg": Msg,
+	":ignore": Ignore,
+	":unignore": Unignore,
+}
+
+type AdminCmd int
+const (
+	Reload AdminCmd = iota + 1
+	Ban
+	Unban
+	Audit
+	SetLogLevel
+	Export
+	SlowMode
+	Announce
+	Capacity
+)
+
+const maxAnnouncementLength = 400
+
+// The longest server-wide slow mode :slowmode sets
+const maxSlowMode = 24*time.Hour
+
+var adminCommands = map[string]AdminCmd{
+	":reload": Reload,
+	":ban": Ban,
+	":unban": Unban,
+	":audit": Audit,
+	":loglevel": SetLogLevel,
+	":export": Export,
+	":slowmode": SlowMode,
+	":announce": Announce,
+	":capacity": Capacity,
+}
+
+// parseCommand recognizes a message that invokes one of the commands.
+// Anything else, including unknown words starting with a colon like ":)",
+// is an ordinary chat message.
+func parseCommand(text string) (string, []string, bool) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return "", nil, false
+	}
+	_, isCmd := commands[fields[0]]
+	_, isAdminCmd := adminCommands[fields[0]]
+	return fields[0], fields[1:], isCmd || isAdminCmd
+}
+
+// actor names the client in the audit log
+func (s *Server) actor(client *Client) string {
+	role := "user"
+	if client.IsAdmin {
+		role = "admin"
+	}
+	return role + "/" + clientDisplayName(client, s.cfg)
+}
+
+// authChecked finishes an :auth once its password has been checked
+func (s *Server) authChecked(author *Client, granted bool, now time.Time) {
+	if !granted {
+		author.log.Warn("Client failed to authenticate as admin", "event", "auth_failed", "client", s.cfg.sensitive(clientKey(author.Conn)))
+		securityEvent("auth_failed", "admin_password", s.cfg.sensitive(clientKey(author.Conn)), "cid", author.CorrelationID)
+		s.tell(author, "wrong_password", CatalogData{})
+		s.strike(author, "auth_failed", now)
+		return
+	}
+	author.log.Info("Client authenticated as admin", "event", "auth", "client", s.cfg.sensitive(clientKey(author.Conn)))
+	author.IsAdmin = true
+	s.tell(author, "admin", CatalogData{})
+}
+
+func (s *Server) command(author *Client, name string, args []string, now time.Time) {
+	if cmd, ok := commands[name]; ok {
+		switch cmd {
+		case Version:
+			author.Write(versionString() + "\n")
+		case Auth:
+			if s.cfg.AdminPassword == "" {
+				s.tell(author, "admin_disabled", CatalogData{})
+				return
+			}
+			// bcrypt is slow on purpose, checking the password here would
+			// let a few clients spamming :auth stall everybody
+			hash := s.cfg.AdminPassword
+			id := author.ID
+			ctx, messages := s.ctx, s.messages
+			go func() {
+				granted := len(args) == 1 && bcrypt.CompareHashAndPassword([]byte(hash), []byte(args[0])) == nil
+				select {
+				case messages <- Message{
+					Type: AuthChecked,
+					ConnID: id,
+					Granted: granted,
+				}:
+				case <-ctx.Done():
+				}
+			}()
+		case Motd:
+			if motd := s.files.Motd.Text(); motd != "" {
+				author.Write(motd)
+			} else {
+				s.tell(author, "no_motd", CatalogData{})
+			}
+		case NoHistory:
+			// Remembered per address, like the bans, so it applies to the
+			// next time the client joins
+			ip := clientIP(author.Conn)
+			if s.noHistory[ip] {
+				delete(s.noHistory, ip)
+				s.tell(author, "history_on", CatalogData{})
+			} else {
+				s.noHistory[ip] = true
+				s.tell(author, "history_off", CatalogData{})
+			}
+		case ShowHistory:
+			entries := s.roomHistory(author.Room)
+			n := len(entries)
+			if len(args) > 0 {
+				var err error
+				if n, err = strconv.Atoi(args[0]); err != nil || n < 1 {
+					s.tell(author, "usage", CatalogData{Text: ":history [count]"})
+					return
+				}
+			}
+			if wait := historyRate - now.Sub(author.LastHistory); wait > 0 {
+				s.tell(author, "history_wait", CatalogData{Wait: wait})
+				return
+			}
+			author.LastHistory = now
+			if len(entries) == 0 {
+				s.tell(author, "history_empty", CatalogData{})
+				return
+			}
+			if n > len(entries) {
+				s.tell(author, "history_short", CatalogData{Count: len(entries)})
+				n = len(entries)
+			}
+			s.replay(author, entries[len(entries)-n:])
+		case Search:
+			if s.historyDB == nil {
+				s.tell(author, "search_disabled", CatalogData{})
+				return
+			}
+			if s.cfg.SearchAdminOnly && !author.IsAdmin {
+				s.tell(author, "permission_denied", CatalogData{})
+				return
+			}
+			if len(args) == 0 {
+				s.tell(author, "usage", CatalogData{Text: ":search <terms>"})
+				return
+			}
+			found, err := s.historyDB.Search(author.Room, args, 10)
+			if err != nil {
+				author.log.Error("Could not search the history database", "event", "search", "err", err)
+				s.tell(author, "search_failed", CatalogData{})
+				return
+			}
+			if len(found) == 0 {
+				s.tell(author, "search_nothing", CatalogData{})
+				return
+			}
+			s.replay(author, found)
+		case Join:
+			if len(args) != 1 || !validRoomName(args[0]) {
+				s.tell(author, "usage", CatalogData{Text: ":join #room, the name is up to 31 letters, digits, - or _"})
+				return
+			}
+			if args[0] == author.Room {
+				s.tell(author, "room_already", CatalogData{Room: args[0]})
+				return
+			}
+			if reason, ok := s.canJoinRoom(author, args[0]); !ok {
+				author.Write(reason + "\n")
+				return
+			}
+			if room := s.rooms[args[0]]; room != nil {
+				delete(room.Invited, author.ID)
+			}
+			author.log.Debug("Client joined a room", "event", "join", "client", s.cfg.sensitive(clientKey(author.Conn)), "room", args[0])
+			s.joinRoom(author, args[0])
+			s.tell(author, "room_joined", CatalogData{Room: args[0]})
+			s.replayOnJoin(author)
+		case Part:
+			if len(args) != 1 || args[0] != author.Room {
+				s.tell(author, "usage", CatalogData{Text: ":part #room, where #room is the one you are in"})
+				return
+			}
+			if author.Room == defaultRoom {
+				s.tell(author, "room_default", CatalogData{Room: defaultRoom})
+				return
+			}
+			author.log.Debug("Client left a room", "event", "part", "client", s.cfg.sensitive(clientKey(author.Conn)), "room", args[0])
+			s.joinRoom(author, defaultRoom)
+			s.tell(author, "room_back", CatalogData{Room: defaultRoom})
+		case Rooms:
+			author.Write(s.roomList())
+		case Register, Login, Passwd, Msg:
+			s.account(author, name, args, now)
+		case Nick:
+			if len(args) != 1 {
+				s.tell(author, "usage", CatalogData{Text: ":nick <name>"})
+				return
+			}
+			s.setNick(author, args[0], now)
+		case Ignore, Unignore:
+			if len(args) != 1 {
+				s.tell(author, "usage", CatalogData{Text: name + " <nick>"})
+				return
+			}
+			s.ignore(author, args[0], name == ":ignore")
+		case Invite:
+			if len(args) != 1 {
+				s.tell(author, "usage", CatalogData{Text: ":invite <nick>"})
+				return
+			}
+			s.invite(author, args[0])
+		case RoomSet:
+			s.roomSet(author, args)
+		case RoomInfo:
+			author.Write(s.roomInfo(s.rooms[author.Room]))
+		case Op, Deop:
+			if len(args) != 1 {
+				s.tell(author, "usage", CatalogData{Text: name + " <nick>"})
+				return
+			}
+			s.setOp(author, args[0], cmd == Op)
+		case Kick:
+			if len(args) < 1 {
+				s.tell(author, "usage", CatalogData{Text: ":kick <nick> [reason]"})
+				return
+			}
+			s.kick(author, s.actor(author), args[0], strings.Join(args[1:], " "), now)
+		case Mute:
+			duration := 5*time.Minute
+			var err error
+			if len(args) == 2 {
+				duration, err = time.ParseDuration(args[1])
+			}
+			if len(args) < 1 || len(args) > 2 || err != nil || duration < 0 {
+				s.tell(author, "usage", CatalogData{Text: ":mute <nick> [duration], 0 lifts the mute"})
+				return
+			}
+			s.mute(author, s.actor(author), args[0], duration, now)
+		case Names:
+			author.Write(s.names(s.rooms[author.Room]))
+		case Echo:
+			if len(args) != 1 || args[0] != "on" && args[0] != "off" {
+				s.tell(author, "usage", CatalogData{Text: ":echo on|off"})
+				return
+			}
+			author.Echo = args[0] == "on"
+			s.tell(author, "echo", CatalogData{Text: args[0]})
+		case Format:
+			if len(args) != 1 || args[0] != string(PlainOutput) && args[0] != string(VerboseOutput) {
+				s.tell(author, "usage", CatalogData{Text: ":format plain|verbose"})
+				return
+			}
+			author.Format = OutputFormat(args[0])
+			s.tell(author, "format", CatalogData{Text: args[0]})
+		case RelayAuth:
+			if len(args) != 1 {
+				s.tell(author, "usage", CatalogData{Text: ":relay <token>"})
+				return
+			}
+			s.acceptRelay(author, args[0], now)
+		case Topic:
+			if len(args) > 0 {
+				s.setTopic(author, strings.Join(args, " "))
+			} else if topic := s.rooms[author.Room].Topic; topic != "" {
+				author.Send(s.notice("topic", CatalogData{Room: author.Room, Text: topic}))
+			} else {
+				s.tell(author, "no_topic", CatalogData{Room: author.Room})
+			}
+		}
+		return
+	}
+
+	if !author.IsAdmin {
+		s.tell(author, "permission_denied", CatalogData{})
+		return
+	}
+	actor := s.actor(author)
+	switch adminCommands[name] {
+	case Reload:
+		author.log.Info("Client requested a reload", "event", "reload", "client", s.cfg.sensitive(clientKey(author.Conn)))
+		s.reload(actor)
+		s.tell(author, "reloading", CatalogData{})
+	case Ban:
+		if len(args) < 1 || net.ParseIP(args[0]) == nil {
+			s.tell(author, "usage", CatalogData{Text: ":ban <ip> [reason]"})
+			return
+		}
+		s.ban(actor, args[0], strings.Join(args[1:], " "), now)
+		s.tell(author, "banned_ok", CatalogData{})
+	case Unban:
+		if len(args) < 1 {
+			s.tell(author, "usage", CatalogData{Text: ":unban <ip> [reason]"})
+			return
+		}
+		if _, banned := s.bannedMfs[args[0]]; !banned {
+			s.tell(author, "not_banned", CatalogData{})
+			return
+		}
+		s.unban(actor, args[0], strings.Join(args[1:], " "), now)
+		s.tell(author, "unbanned", CatalogData{})
+	case Audit:
+		n := 10
+		if len(args) > 0 {
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil || n < 1 {
+				s.tell(author, "usage", CatalogData{Text: ":audit [count]"})
+				return
+			}
+		}
+		entries := s.audit.Last(n)
+		if len(entries) == 0 {
+			s.tell(author, "audit_empty", CatalogData{})
+		}
+		for _, entry := range entries {
+			author.Write(entry.String() + "\n")
+		}
+	case SetLogLevel:
+		var level slog.Level
+		if len(args) != 1 || level.UnmarshalText([]byte(args[0])) != nil {
+			s.tell(author, "usage", CatalogData{Text: ":loglevel debug|info|warn|error"})
+			return
+		}
+		logLevel.Set(level)
+		author.log.Warn("Changed the log level", "event", "loglevel", "level", level.String(), "actor", actor)
+		s.tell(author, "log_level", CatalogData{Text: level.String()})
+	case Export:
+		var window time.Duration
+		if len(args) == 1 {
+			window, _ = time.ParseDuration(args[0])
+		}
+		if window <= 0 {
+			s.tell(author, "usage", CatalogData{Text: ":export <duration>, e.g. :export 2h"})
+			return
+		}
+		s.export(author, window, now)
+	case SlowMode:
+		seconds := -1
+		if len(args) == 1 {
+			if n, err := strconv.Atoi(args[0]); err == nil {
+				seconds = n
+			}
+		}
+		// Bounded, so the duration can't overflow
+		if seconds < 0 || seconds > int(maxSlowMode/time.Second) {
+			s.tell(author, "usage", CatalogData{Text: ":slowmode <seconds>, up to a day, 0 disables it"})
+			return
+		}
+		s.slowMode = time.Duration(seconds)*time.Second
+		s.audit.Record(AuditEntry{
+			Time: now,
+			Actor: actor,
+			Action: "slowmode",
+			Duration: s.slowMode,
+		})
+		if seconds > 0 {
+			s.broadcast(s.notice("slow_mode_on", CatalogData{Count: seconds}))
+		} else {
+			s.broadcast(s.notice("slow_mode_off", CatalogData{}))
+		}
+		s.announceLimits()
+	case Announce:
+		text := sanitizeLine(strings.Join(args, " "), maxAnnouncementLength)
+		if text == "" {
+			s.tell(author, "usage", CatalogData{Text: ":announce <text>"})
+			return
+		}
+		s.audit.Record(AuditEntry{
+			Time: now,
+			Actor: actor,
+			Action: "announce",
+			Reason: text,
+		})
+		line := announcement(text)
+		s.broadcast(line)
+		// One entry shows up in the history of every room
+		s.history.Push(transcript.Entry{
+			Time: now,
+			Sender: noticePrefix,
+			Room: allRooms,
+			Text: render(line, PlainOutput),
+		})
+	case Capacity:
+		size := -1
+		if len(args) == 2 {
+			size, _ = strconv.Atoi(args[1])
+		}
+		if size < 0 {
+			s.tell(author, "usage", CatalogData{Text: ":capacity #room <members>, 0 for the server default"})
+			return
+		}
+		room := s.rooms[args[0]]
+		if room == nil {
+			s.tell(author, "room_unknown", CatalogData{Room: args[0]})
+			return
+		}
+		room.MaxSize = size
+		s.audit.Record(AuditEntry{
+			Time: now,
+			Actor: actor,
+			Action: "capacity",
+			Target: room.Name,
+			Reason: strconv.Itoa(size),
+		})
+		author.Write(s.roomInfo(room))
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowModeSurvivesAReload(t *testing.T) {
+	cfg := adminConfig(t)
+	ts := startServer(t, cfg, nil)
+	admin := ts.connect("10.0.0.1:1001")
+	admin.Auth()
+	alice := ts.connect("10.0.0.2:1002")
+	bob := ts.connect("10.0.0.3:1003")
+
+	admin.Play(ScriptStep{After: time.Second, Line: ":slowmode 30"})
+	// A reload that doesn't touch the slow mode
+	cfg.StrikeLimit += 1
+	alice.Forget()
+	ts.reload(cfg)
+	if !alice.Got(limitsPrefix + " rate=30s") {
+		t.Errorf("the reload announced other limits, got %q", alice.Received())
+	}
+	alice.Play(
+		ScriptStep{After: 30*time.Second, Line: "hello"},
+		ScriptStep{After: 10*time.Second, Line: "again"},
+	)
+	if !bob.Got("hello") || bob.Got("again") {
+		t.Errorf("the slow mode is gone after the reload, got %q", bob.Received())
+	}
+
+	// A reload that does
+	cfg.SlowMode = 5*time.Second
+	alice.Forget()
+	ts.reload(cfg)
+	if !alice.Got(limitsPrefix + " rate=5s") {
+		t.Errorf("the configured slow mode didn't apply, got %q", alice.Received())
+	}
+}
+
+func TestMuteWithABadDurationKeepsTheMute(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+	// The first one in a room is its operator
+	alice.Play(ScriptStep{After: time.Second, Line: ":join #den"})
+	bob.Play(
+		ScriptStep{After: time.Second, Line: ":nick bob"},
+		ScriptStep{After: time.Second, Line: ":join #den"},
+	)
+	alice.Play(
+		ScriptStep{After: time.Second, Line: ":mute bob 10m"},
+		ScriptStep{After: time.Second, Line: ":mute bob soon"},
+	)
+	if !alice.Got(":mute <nick> [duration]") {
+		t.Errorf("no usage for a bad duration, got %q", alice.Received())
+	}
+	bob.Play(ScriptStep{After: time.Second, Line: "can I talk?"})
+	if alice.Got("can I talk?") {
+		t.Errorf("a bad duration lifted the mute")
+	}
+}
+
+func TestNoTopicGoesThroughTheCatalog(t *testing.T) {
+	files := &Files{}
+	if err := files.Catalog.Load(writeFile(t, "messages.json", `{"no_topic": "Nothing to talk about in {{.Room}}"}`)); err != nil {
+		t.Fatal(err)
+	}
+	ts := startServer(t, testConfig(), files)
+	alice := ts.connect("10.0.0.1:1001")
+
+	alice.Play(ScriptStep{After: time.Second, Line: ":topic"})
+
+	if !alice.Got("Nothing to talk about in " + defaultRoom) {
+		t.Errorf("the catalog wasn't used, got %q", alice.Received())
+	}
+}
+
+func TestTopicNamesTheSetter(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+	alice.Play(
+		ScriptStep{After: time.Second, Line: ":nick alice"},
+		ScriptStep{After: time.Second, Line: ":join #den"},
+	)
+	bob.Play(ScriptStep{After: time.Second, Line: ":join #den"})
+
+	alice.Play(ScriptStep{After: time.Second, Line: ":topic cats\x07 and   dogs"})
+
+	if !bob.Got("Topic of #den set by alice: cats and dogs") {
+		t.Errorf("the topic wasn't announced with the setter, got %q", bob.Received())
+	}
+	bob.Forget()
+	bob.Play(ScriptStep{After: time.Second, Line: ":topic dogs only"})
+	if bob.Got("set by") {
+		t.Errorf("a member who isn't an operator set the topic")
+	}
+}
+
+func TestWorkersGiveUpOnAStoppedServer(t *testing.T) {
+	s := NewServer(testConfig(), &Files{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.ctx = ctx
+	// server() is gone, nobody reads it any more
+	s.messages = make(chan Message)
+
+	done := make(chan struct{})
+	go func() {
+		s.accountReply(&Client{ID: 1}, ":login")(AccountReply{Nick: "bob"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5*time.Second):
+		t.Fatal("the worker is stuck reporting back")
+	}
+}
+
+func TestVersionCommand(t *testing.T) {
+	defer func(version, commit string) {
+		buildVersion, buildCommit = version, commit
+	}(buildVersion, buildCommit)
+	buildVersion, buildCommit = "1.2.3", "abc1234"
+	ts := startServer(t, testConfig(), nil)
+	alice := ts.connect("10.0.0.1:1001")
+
+	alice.Play(ScriptStep{After: time.Second, Line: ":version"})
+
+	if !alice.Got("4at v1.2.3 (abc1234)") {
+		t.Errorf("got %q", alice.Received())
+	}
+}
+
+func TestAnnounceReachesEveryRoomOnce(t *testing.T) {
+	ts := startServer(t, adminConfig(t), nil)
+	admin := ts.connect("10.0.0.1:1001")
+	admin.Auth()
+	var clients []*ScriptedClient
+	for i, room := range []string{"#general", "#golang", "#golang", "#rust"} {
+		c := ts.connect(fmt.Sprintf("10.0.0.%d:%d", i+2, 1002+i))
+		if room != defaultRoom {
+			c.Play(ScriptStep{After: time.Second, Line: ":join " + room})
+		}
+		clients = append(clients, c)
+	}
+	mallory := clients[0]
+
+	// Right after :auth, the rate limit doesn't hold an announcement up
+	admin.Queue(":announce restarting in 5 minutes")
+	ts.sync()
+	for i, c := range append(clients, admin) {
+		if n := strings.Count(c.Conn.Written(), "[Announcement] restarting in 5 minutes\n"); n != 1 {
+			t.Errorf("client %d got the announcement %d times: %q", i, n, c.Received())
+		}
+	}
+
+	// Late joiners of any room find it in the history
+	late := ts.connect("10.0.0.9:1009")
+	late.Play(ScriptStep{After: time.Second, Line: ":join #haskell"})
+	if !late.Got("[Announcement] restarting in 5 minutes") {
+		t.Errorf("not in the history of a new room, got %q", late.Received())
+	}
+
+	// Sanitized all the same
+	admin.Play(ScriptStep{After: time.Second, Line: ":announce \x1b[2Jback soon"})
+	if !clients[3].Got("back soon") || clients[3].Got("\x1b") {
+		t.Errorf("got %q", clients[3].Received())
+	}
+
+	mallory.Forget()
+	mallory.Play(ScriptStep{After: time.Second, Line: ":announce free crypto"})
+	if !mallory.Got("Permission denied") || clients[1].Got("free crypto") {
+		t.Errorf("a non-admin announced, got %q", mallory.Received())
+	}
+}
+
+func TestEcho(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+
+	alice.Play(ScriptStep{After: time.Second, Line: ":echo on"})
+	if !alice.Got("Echo is on now") {
+		t.Fatalf("got %q", alice.Received())
+	}
+	alice.Play(ScriptStep{After: time.Second, Line: "loud"})
+	if !alice.Got("loud") || !bob.Got("loud") {
+		t.Errorf("the message wasn't echoed, alice got %q", alice.Received())
+	}
+	alice.Send("too soon")
+	if !alice.Got("Your message was not delivered: you are sending too fast") {
+		t.Errorf("the throttled message wasn't told, got %q", alice.Received())
+	}
+	if bob.Got("too soon") {
+		t.Errorf("the throttled message was delivered")
+	}
+
+	alice.Play(ScriptStep{After: time.Minute, Line: ":echo off"})
+	if !alice.Got("Echo is off now") {
+		t.Fatalf("got %q", alice.Received())
+	}
+	alice.Forget()
+	alice.Play(ScriptStep{After: time.Second, Line: "quiet"})
+	alice.Send("quieter")
+	if !bob.Got("quiet") {
+		t.Errorf("bob got %q", bob.Received())
+	}
+	if alice.Got("quiet") || alice.Got("too fast") {
+		t.Errorf("alice got %q with echo off", alice.Received())
+	}
+
+	alice.Play(ScriptStep{After: time.Minute, Line: ":echo maybe"})
+	if !alice.Got(":echo on|off") {
+		t.Errorf("got %q", alice.Received())
+	}
+}
+
+func TestSlowModeOutOfRange(t *testing.T) {
+	ts := startServer(t, adminConfig(t), nil)
+	admin := ts.connect("10.0.0.1:1001")
+	admin.Auth()
+
+	admin.Play(ScriptStep{After: time.Second, Line: ":slowmode 60"})
+	for _, arg := range []string{"-1", "86401", "9223372036", "99999999999999999999", "soon"} {
+		admin.Forget()
+		admin.Play(ScriptStep{After: time.Second, Line: ":slowmode " + arg})
+		if !admin.Got(":slowmode <seconds>, up to a day, 0 disables it") {
+			t.Errorf(":slowmode %s got %q", arg, admin.Received())
+		}
+	}
+	if ts.sync(); ts.s.slowMode != time.Minute {
+		t.Errorf("the slow mode changed to %s", ts.s.slowMode)
+	}
+	admin.Play(ScriptStep{After: time.Second, Line: ":slowmode 86400"})
+	if ts.sync(); ts.s.slowMode != maxSlowMode {
+		t.Errorf("the slow mode is %s", ts.s.slowMode)
+	}
+}
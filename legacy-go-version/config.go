@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Config struct {
+	Port string
+	// How many of the following ports to try when Port is taken
+	PortRetry int
+	SafeMode string
+	MessageRate time.Duration
+	// Overrides MessageRate when longer, see Server.effectiveRate
+	SlowMode time.Duration
+	BanLimit time.Duration
+	StrikeLimit int
+	ConnRate float64
+	ConnBurst int
+	MaxClients int
+	// How many rooms the clients may create, 0 for no limit
+	MaxRooms int
+	// How many members a room takes, 0 for no limit. :capacity overrides
+	// it for a room.
+	MaxRoomSize int
+	// The bufio.Reader of every client. The early 64 bytes cut every
+	// longer message into pieces, each one a message and a rate limit
+	// strike of its own. Now that the messages are lines it only trades
+	// memory per client for reads per line, 4096 takes a typical line in
+	// one read. See -bench with -benchsize.
+	ReadBufSize int
+	// How many messages of every sender server() broadcasts per round
+	// when it falls behind, 0 broadcasts them in the order they arrive in.
+	// See FairQueue.
+	FairShare int
+	// How many messages of a sender wait for their round before the
+	// following ones are dropped
+	FairQueue int
+	// Bytes per second of chat lines every client gets at most, the rest
+	// is skipped, see deliver. 0 for no limit.
+	Bandwidth int
+	MotdPath string
+	WordlistPath string
+	RegexFilterPath string
+	// JSON object of the client-facing messages to override, see
+	// builtinCatalog
+	MessagesPath string
+	TranscriptPath string
+	// How many recovered panics within a minute make the server give up,
+	// 0 for no limit
+	MaxPanics int
+	// sequence or uuid, see MsgIDGenerator
+	MsgIDType string
+	BanFile string
+	AuditFile string
+	AuditSize int
+	StatusInterval time.Duration
+	IdleTimeout time.Duration
+	// Least time between two :nick of a client once it has a nick, 0 for
+	// no limit
+	NickInterval time.Duration
+	// How long a connection may take from being accepted to being set up
+	// by server(), TLS handshake included. 0 disables it.
+	HandshakeDeadline time.Duration
+	// How long the goroutine of a client waits in a read before checking
+	// on the connection, see client(). 0 waits forever.
+	ReadDeadline time.Duration
+	// Per room
+	HistorySize int
+	// In all the rooms together, see History. 0 for no limit.
+	HistoryLimit int
+	// How long the history keeps the messages, 0 for as long as they fit
+	RetentionDuration time.Duration
+	HistoryDB string
+	AccountsDB string
+	SearchAdminOnly bool
+	TopicAdminOnly bool
+	ExportDir string
+	DebugAddr string
+	LetsEncrypt string
+	LetsEncryptEmail string
+	CertCacheDir string
+	AdminCA string
+	AdminPassword string `secret:"true"`
+	// The servers to relay the messages to and from, see relay.go
+	RelayAddrs []string
+	// The reverse proxies whose forwarding headers name the client, see
+	// forwardedFor
+	TrustedProxies []string
+	// Both sides of a relay need the same one, empty refuses the relays
+	// dialing in
+	RelayAuthToken string `secret:"true"`
+	// Every message is posted there as JSON, see webhook.go
+	WebhookURL string
+	// Signs the posts with HMAC-SHA256 when set
+	WebhookSecret string `secret:"true"`
+	// Sent with every post, usually carrying an API key
+	WebhookHeaders map[string]string `secret:"true"`
+	SafeModeKey string `secret:"true"`
+	LogLevel string
+	LogFormat string
+	LogFile string
+	// Where the security events go on top of the ordinary log, see
+	// securityEvent
+	SecurityLog string
+	LogMaxSize int
+	LogMaxFiles int
+	LogRotate string
+	LogKeep int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Port: "6969",
+		SafeMode: "redact",
+		MessageRate: 1*time.Second,
+		BanLimit: 10*time.Minute,
+		StrikeLimit: 10,
+		ConnRate: 10.0,
+		ConnBurst: 20,
+		MaxClients: 100,
+		MaxRooms: 50,
+		MsgIDType: "sequence",
+		MaxPanics: 10,
+		ReadBufSize: 4096,
+		FairShare: 1,
+		FairQueue: 8,
+		LogLevel: "info",
+		LogFormat: "text",
+		LogMaxSize: 100,
+		LogMaxFiles: 5,
+		LogRotate: "size",
+		AuditSize: 100,
+		StatusInterval: 15*time.Minute,
+		IdleTimeout: 30*time.Minute,
+		NickInterval: time.Minute,
+		HandshakeDeadline: 5*time.Second,
+		ReadDeadline: 5*time.Minute,
+		HistorySize: 50,
+		HistoryLimit: 1000,
+		CertCacheDir: "certs",
+		ExportDir: "exports",
+	}
+}
+
+// Validate catches the settings that would make the server misbehave in
+// confusing ways instead of failing right away. It reports every problem at
+// once rather than making the operator fix them one restart at a time.
+func (cfg Config) Validate() error {
+	errs := []error{}
+	if cfg.SafeMode != "off" && cfg.SafeMode != "redact" && cfg.SafeMode != "hash" {
+		errs = append(errs, fmt.Errorf("safe mode must be off, redact or hash, got %q", cfg.SafeMode))
+	}
+	port, err := strconv.Atoi(cfg.Port)
+	if err != nil || port < 0 || port > 65535 {
+		errs = append(errs, fmt.Errorf("port must be a number between 0 and 65535, got %q", cfg.Port))
+	}
+	if cfg.PortRetry < 0 || err == nil && port+cfg.PortRetry > 65535 {
+		errs = append(errs, fmt.Errorf("port retry must not be negative nor go past port 65535, got %d", cfg.PortRetry))
+	}
+	if cfg.SlowMode < 0 {
+		errs = append(errs, fmt.Errorf("slow mode must not be negative, got %s", cfg.SlowMode))
+	}
+	if cfg.MessageRate < 0 {
+		errs = append(errs, fmt.Errorf("message rate must not be negative, got %s", cfg.MessageRate))
+	}
+	if cfg.BanLimit <= 0 {
+		errs = append(errs, fmt.Errorf("ban limit must be positive, got %s", cfg.BanLimit))
+	}
+	if cfg.StrikeLimit < 1 {
+		errs = append(errs, fmt.Errorf("strike limit must be at least 1, got %d", cfg.StrikeLimit))
+	}
+	if cfg.ConnRate <= 0 {
+		errs = append(errs, fmt.Errorf("connection rate must be positive, got %f", cfg.ConnRate))
+	}
+	if cfg.ConnBurst < 1 {
+		errs = append(errs, fmt.Errorf("connection burst must be at least 1, got %d", cfg.ConnBurst))
+	}
+	if cfg.MaxClients < 0 {
+		errs = append(errs, fmt.Errorf("max clients must not be negative, got %d", cfg.MaxClients))
+	}
+	if cfg.MaxRooms < 0 {
+		errs = append(errs, fmt.Errorf("max rooms must not be negative, got %d", cfg.MaxRooms))
+	}
+	if cfg.MaxPanics < 0 {
+		errs = append(errs, fmt.Errorf("max panics must not be negative, got %d", cfg.MaxPanics))
+	}
+	if cfg.MsgIDType != "sequence" && cfg.MsgIDType != "uuid" {
+		errs = append(errs, fmt.Errorf("message ID type must be sequence or uuid, got %q", cfg.MsgIDType))
+	}
+	if cfg.WebhookURL != "" {
+		if u, err := url.Parse(cfg.WebhookURL); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("webhook URL must be an http or https URL, got %q", cfg.WebhookURL))
+		}
+	}
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.MaxRoomSize < 0 {
+		errs = append(errs, fmt.Errorf("max room size must not be negative, got %d", cfg.MaxRoomSize))
+	}
+	if cfg.LetsEncrypt != "" && cfg.CertCacheDir == "" {
+		errs = append(errs, errors.New("-letsencrypt needs a -certcachedir, otherwise every restart asks for new certificates"))
+	}
+	if isBcryptHash(cfg.AdminPassword) {
+		if _, err := bcrypt.Cost([]byte(cfg.AdminPassword)); err != nil {
+			errs = append(errs, fmt.Errorf("admin password looks like a bcrypt hash but isn't a valid one: %w", err))
+		}
+	}
+	if cfg.AdminCA != "" && cfg.LetsEncrypt == "" {
+		errs = append(errs, errors.New("-adminca needs TLS, see -letsencrypt"))
+	}
+	if cfg.HistorySize < 0 {
+		errs = append(errs, fmt.Errorf("history size must not be negative, got %d", cfg.HistorySize))
+	}
+	if cfg.HistoryLimit < 0 {
+		errs = append(errs, fmt.Errorf("history limit must not be negative, got %d", cfg.HistoryLimit))
+	}
+	if cfg.RetentionDuration < 0 {
+		errs = append(errs, fmt.Errorf("retention must not be negative, got %s", cfg.RetentionDuration))
+	}
+	if cfg.IdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("idle timeout must not be negative, got %s", cfg.IdleTimeout))
+	}
+	if cfg.NickInterval < 0 {
+		errs = append(errs, fmt.Errorf("nick interval must not be negative, got %s", cfg.NickInterval))
+	}
+	if cfg.HandshakeDeadline < 0 {
+		errs = append(errs, fmt.Errorf("handshake deadline must not be negative, got %s", cfg.HandshakeDeadline))
+	}
+	if cfg.ReadDeadline < 0 {
+		errs = append(errs, fmt.Errorf("read deadline must not be negative, got %s", cfg.ReadDeadline))
+	}
+	if cfg.StatusInterval < 0 {
+		errs = append(errs, fmt.Errorf("status interval must not be negative, got %s", cfg.StatusInterval))
+	}
+	if cfg.AuditSize < 1 {
+		errs = append(errs, fmt.Errorf("audit size must be at least 1, got %d", cfg.AuditSize))
+	}
+	if cfg.ReadBufSize < 1 {
+		errs = append(errs, fmt.Errorf("read buffer size must be at least 1, got %d", cfg.ReadBufSize))
+	}
+	if cfg.FairShare < 0 {
+		errs = append(errs, fmt.Errorf("fair share must not be negative, got %d", cfg.FairShare))
+	}
+	if cfg.Bandwidth < 0 {
+		errs = append(errs, fmt.Errorf("bandwidth must not be negative, got %d", cfg.Bandwidth))
+	}
+	if cfg.FairQueue < 1 {
+		errs = append(errs, fmt.Errorf("fair queue must be at least 1, got %d", cfg.FairQueue))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("log level must be debug, info, warn or error, got %q", cfg.LogLevel))
+	}
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("log format must be text or json, got %q", cfg.LogFormat))
+	}
+	if cfg.LogMaxSize < 0 {
+		errs = append(errs, fmt.Errorf("log max size must not be negative, got %d", cfg.LogMaxSize))
+	}
+	if cfg.LogMaxFiles < 0 {
+		errs = append(errs, fmt.Errorf("log max files must not be negative, got %d", cfg.LogMaxFiles))
+	}
+	if cfg.LogRotate != "size" && cfg.LogRotate != "daily" {
+		errs = append(errs, fmt.Errorf("log rotation must be size or daily, got %q", cfg.LogRotate))
+	}
+	if cfg.LogKeep < 0 {
+		errs = append(errs, fmt.Errorf("log keep must not be negative, got %d", cfg.LogKeep))
+	}
+	return errors.Join(errs...)
+}
+
+// MarshalJSON spells the durations out the same way the flags take them
+// instead of as raw nanoseconds. The secrets are left out altogether, a
+// placeholder in their place would be taken for the secret itself when the
+// output is loaded back as a config file.
+func (cfg Config) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	value := reflect.ValueOf(cfg)
+	written := 0
+	for i := 0; i < value.NumField(); i++ {
+		if value.Type().Field(i).Tag.Get("secret") == "true" {
+			continue
+		}
+		field := value.Field(i).Interface()
+		if duration, ok := field.(time.Duration); ok {
+			field = duration.String()
+		}
+		key, err := json.Marshal(value.Type().Field(i).Name)
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(field)
+		if err != nil {
+			return nil, err
+		}
+		if written > 0 {
+			buf.WriteString(",")
+		}
+		written += 1
+		buf.Write(key)
+		buf.WriteString(":")
+		buf.Write(data)
+	}
+	buf.WriteString("}")
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON accepts the same keys MarshalJSON produces. Unknown keys
+// are rejected so a typo in the config file doesn't go unnoticed.
+func (cfg *Config) UnmarshalJSON(data []byte) error {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	value := reflect.ValueOf(cfg).Elem()
+	for key, raw := range fields {
+		field := value.FieldByName(key)
+		if !field.IsValid() {
+			return fmt.Errorf("unknown key %q", key)
+		}
+		if field.Type() == reflect.TypeOf(time.Duration(0)) {
+			var text string
+			if err := json.Unmarshal(raw, &text); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			if err := setField(field, text); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			continue
+		}
+		if err := json.Unmarshal(raw, field.Addr().Interface()); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// LoadConfig reads the JSON config file at path on top of the defaults, so
+// a partial file only overrides the keys it mentions
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// envName maps a Config field to its environment variable, e.g.
+// MessageRate to FOURAT_MESSAGE_RATE
+func envName(field string) string {
+	var name strings.Builder
+	name.WriteString("FOURAT")
+	for i, r := range field {
+		if i == 0 || unicode.IsUpper(r) {
+			name.WriteString("_")
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return name.String()
+}
+
+// ApplyEnv overrides the fields that have their environment variable set
+func (cfg *Config) ApplyEnv() error {
+	value := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := envName(value.Type().Field(i).Name)
+		text, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(value.Field(i), text); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, text string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		duration, err := time.ParseDuration(text)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(duration))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(text)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", field.Type())
+		}
+		var list stringList
+		list.Set(text)
+		field.Set(reflect.ValueOf([]string(list)))
+	case reflect.Map:
+		if field.Type() != reflect.TypeOf(map[string]string(nil)) {
+			return fmt.Errorf("unsupported type %s", field.Type())
+		}
+		var headers headerMap
+		if err := headers.Set(text); err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(map[string]string(headers)))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// Configure layers the configuration sources on top of each other:
+// defaults < config file < environment variables < flags explicitly given
+// on the command line. The flags of fs must be bound to the fields of cfg
+// and already parsed.
+func Configure(cfg *Config, fs *flag.FlagSet, path string) error {
+	explicit := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	base := DefaultConfig()
+	if path != "" {
+		var err error
+		base, err = LoadConfig(path)
+		if err != nil {
+			return err
+		}
+	}
+	if err := base.ApplyEnv(); err != nil {
+		return err
+	}
+	*cfg = base
+
+	for name, value := range explicit {
+		if err := fs.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reloaded takes the settings of next that can change while the server
+// is running. The names of the ones that only take effect after a restart
+// are returned so they can be reported.
+func (cfg Config) reloaded(next Config) (Config, []string) {
+	restart := []string{}
+	if next.Port != cfg.Port || next.PortRetry != cfg.PortRetry {
+		restart = append(restart, "Port")
+		next.Port = cfg.Port
+		next.PortRetry = cfg.PortRetry
+	}
+	if next.ConnRate != cfg.ConnRate {
+		restart = append(restart, "ConnRate")
+		next.ConnRate = cfg.ConnRate
+	}
+	if next.HandshakeDeadline != cfg.HandshakeDeadline {
+		restart = append(restart, "HandshakeDeadline")
+		next.HandshakeDeadline = cfg.HandshakeDeadline
+	}
+	if next.ConnBurst != cfg.ConnBurst {
+		restart = append(restart, "ConnBurst")
+		next.ConnBurst = cfg.ConnBurst
+	}
+	if next.MaxClients != cfg.MaxClients {
+		restart = append(restart, "MaxClients")
+		next.MaxClients = cfg.MaxClients
+	}
+	if next.ReadDeadline != cfg.ReadDeadline {
+		restart = append(restart, "ReadDeadline")
+		next.ReadDeadline = cfg.ReadDeadline
+	}
+	if next.ReadBufSize != cfg.ReadBufSize {
+		restart = append(restart, "ReadBufSize")
+		next.ReadBufSize = cfg.ReadBufSize
+	}
+	if next.LetsEncrypt != cfg.LetsEncrypt || next.LetsEncryptEmail != cfg.LetsEncryptEmail || next.CertCacheDir != cfg.CertCacheDir {
+		restart = append(restart, "LetsEncrypt")
+		next.LetsEncrypt = cfg.LetsEncrypt
+		next.LetsEncryptEmail = cfg.LetsEncryptEmail
+		next.CertCacheDir = cfg.CertCacheDir
+	}
+	if next.AdminCA != cfg.AdminCA {
+		restart = append(restart, "AdminCA")
+		next.AdminCA = cfg.AdminCA
+	}
+	if next.MsgIDType != cfg.MsgIDType {
+		restart = append(restart, "MsgIDType")
+		next.MsgIDType = cfg.MsgIDType
+	}
+	if next.DebugAddr != cfg.DebugAddr {
+		restart = append(restart, "DebugAddr")
+		next.DebugAddr = cfg.DebugAddr
+	}
+	if next.HistoryDB != cfg.HistoryDB {
+		restart = append(restart, "HistoryDB")
+		next.HistoryDB = cfg.HistoryDB
+	}
+	if next.AccountsDB != cfg.AccountsDB {
+		restart = append(restart, "AccountsDB")
+		next.AccountsDB = cfg.AccountsDB
+	}
+	if next.StatusInterval != cfg.StatusInterval {
+		restart = append(restart, "StatusInterval")
+		next.StatusInterval = cfg.StatusInterval
+	}
+	if next.AuditFile != cfg.AuditFile || next.AuditSize != cfg.AuditSize {
+		restart = append(restart, "AuditFile")
+		next.AuditFile = cfg.AuditFile
+		next.AuditSize = cfg.AuditSize
+	}
+	if next.TranscriptPath != cfg.TranscriptPath {
+		restart = append(restart, "TranscriptPath")
+		next.TranscriptPath = cfg.TranscriptPath
+	}
+	if next.LogFormat != cfg.LogFormat {
+		restart = append(restart, "LogFormat")
+		next.LogFormat = cfg.LogFormat
+	}
+	if next.LogFile != cfg.LogFile || next.LogMaxSize != cfg.LogMaxSize || next.LogMaxFiles != cfg.LogMaxFiles || next.LogRotate != cfg.LogRotate || next.LogKeep != cfg.LogKeep {
+		restart = append(restart, "LogFile")
+		next.LogFile = cfg.LogFile
+		next.LogMaxSize = cfg.LogMaxSize
+		next.LogMaxFiles = cfg.LogMaxFiles
+		next.LogRotate = cfg.LogRotate
+		next.LogKeep = cfg.LogKeep
+	}
+	if next.SecurityLog != cfg.SecurityLog {
+		restart = append(restart, "SecurityLog")
+		next.SecurityLog = cfg.SecurityLog
+	}
+	return next, restart
+}
+
+// safeModeRunKey is used by the hash safe mode when no key is configured.
+// Being random per run, the hashes can be correlated within one run but
+// can't be brute forced back into addresses without access to the process.
+var safeModeRunKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// sensitiveContent is sensitive for what the clients say rather than who
+// they are. Hashing a short message would hide nothing, anyone can hash
+// the likely ones and compare, so the hash mode redacts it as well.
+func (cfg Config) sensitiveContent(text string) string {
+	if cfg.SafeMode == "off" {
+		return text
+	}
+	return "[REDACTED]"
+}
+
+func (cfg Config) sensitive(message string) string {
+	switch cfg.SafeMode {
+	case "off":
+		return message
+	case "hash":
+		key := safeModeRunKey
+		if cfg.SafeModeKey != "" {
+			key = []byte(cfg.SafeModeKey)
+		}
+		// Hashing only the host of an address keeps the different
+		// connections of the same client recognizable as such
+		port := ""
+		if host, p, err := net.SplitHostPort(message); err == nil {
+			message = host
+			port = ":" + p
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(message))
+		return fmt.Sprintf("[%x]%s", mac.Sum(nil)[:6], port)
+	default:
+		return "[REDACTED]"
+	}
+}
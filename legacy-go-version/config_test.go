@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseFlags binds the flags to a DefaultConfig like main does
+func parseFlags(t *testing.T, args ...string) (*Config, *flag.FlagSet, error) {
+	t.Helper()
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("4at", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	configFlags(fs, &cfg)
+	err := fs.Parse(args)
+	return &cfg, fs, err
+}
+
+func TestFlagsDefaultToDefaultConfig(t *testing.T) {
+	cfg, _, err := parseFlags(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*cfg, DefaultConfig()) {
+		t.Errorf("no flags changed the config to %+v", cfg)
+	}
+}
+
+func TestFlagsSetTheConfig(t *testing.T) {
+	cfg, _, err := parseFlags(t, "-port", "7000", "-safe-mode", "hash", "-message-rate", "250ms", "-ban-limit", "1h", "-strike-limit", "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultConfig()
+	want.Port = "7000"
+	want.SafeMode = "hash"
+	want.MessageRate = 250*time.Millisecond
+	want.BanLimit = time.Hour
+	want.StrikeLimit = 3
+	if !reflect.DeepEqual(*cfg, want) {
+		t.Errorf("got %+v, want %+v", cfg, want)
+	}
+}
+
+func TestFlagsRejectBadValues(t *testing.T) {
+	for _, args := range [][]string{
+		{"-message-rate", "fast"},
+		{"-ban-limit", "10"},
+		{"-strike-limit", "many"},
+		{"-no-such-flag"},
+	} {
+		if _, _, err := parseFlags(t, args...); err == nil {
+			t.Errorf("%q parsed without an error", args)
+		}
+	}
+}
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Errorf("the defaults don't validate: %s", err)
+	}
+}
+
+func TestValidateFailsFast(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		err string
+	}{
+		{[]string{"-strike-limit", "0"}, "strike limit must be at least 1"},
+		{[]string{"-message-rate", "-1s"}, "message rate must not be negative"},
+		{[]string{"-ban-limit", "0s"}, "ban limit must be positive"},
+		{[]string{"-safe-mode", "paranoid"}, "safe mode must be off, redact or hash"},
+		{[]string{"-port", "65536"}, "port must be a number between 0 and 65535"},
+		{[]string{"-port", "http"}, "port must be a number between 0 and 65535"},
+	} {
+		cfg, _, err := parseFlags(t, tc.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: got %v, want %q", tc.args, err, tc.err)
+		}
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg, _, err := parseFlags(t, "-strike-limit", "0", "-message-rate", "-1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "strike limit") || !strings.Contains(err.Error(), "message rate") {
+		t.Errorf("want both problems reported, got %v", err)
+	}
+}
+
+func TestLoadConfigPartialFile(t *testing.T) {
+	cfg, err := LoadConfig(writeFile(t, "chat.json", `{"Port": "7000", "BanLimit": "1h", "RelayAddrs": ["a:1", "b:2"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultConfig()
+	want.Port = "7000"
+	want.BanLimit = time.Hour
+	want.RelayAddrs = []string{"a:1", "b:2"}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v, want %+v", cfg, want)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		err string
+	}{
+		{`{"Prot": "7000"}`, `unknown key "Prot"`},
+		{`{"StrikeLimit": "3"}`, "StrikeLimit"},
+		{`{"MessageRate": 1000}`, "MessageRate"},
+		{`{"MessageRate": "fast"}`, "MessageRate"},
+		{`{"TopicAdminOnly": "yes"}`, "TopicAdminOnly"},
+		{`{"Port": "7000",}`, "invalid character"},
+		{`["Port"]`, "cannot unmarshal array"},
+	} {
+		if _, err := LoadConfig(writeFile(t, "chat.json", tc.text)); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: got %v, want %q", tc.text, err, tc.err)
+		}
+	}
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("a missing file gave %v", err)
+	}
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SlowMode = 90*time.Second
+	cfg.RelayAddrs = []string{"a:1"}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back Config
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back, cfg) {
+		t.Errorf("got %+v back from %s", back, data)
+	}
+}
+
+func TestConfigLeavesOutTheSecrets(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AdminPassword = "$2a$10$hash"
+	cfg.RelayAuthToken = "token"
+	cfg.WebhookSecret = "secret"
+	cfg.WebhookHeaders = map[string]string{"X-Api-Key": "key"}
+	cfg.SafeModeKey = "key"
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		t.Fatalf("not valid JSON: %s", data)
+	}
+	for _, key := range []string{"AdminPassword", "RelayAuthToken", "WebhookSecret", "WebhookHeaders", "SafeModeKey"} {
+		if value, ok := keys[key]; ok {
+			t.Errorf("%s is printed as %s", key, value)
+		}
+	}
+	if _, ok := keys["MessageRate"]; !ok {
+		t.Errorf("the other keys are gone too: %s", data)
+	}
+
+	// The output is a valid config file, with the secrets unset
+	var back Config
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.AdminPassword != "" || back.WebhookHeaders != nil {
+		t.Errorf("secrets came back from %s", data)
+	}
+}
+
+func TestConfigurePrecedence(t *testing.T) {
+	path := writeFile(t, "chat.json", `{"Port": "7000", "StrikeLimit": 3, "MaxClients": 5}`)
+	t.Setenv("FOURAT_STRIKE_LIMIT", "4")
+	t.Setenv("FOURAT_MAX_CLIENTS", "6")
+	cfg, flags, err := parseFlags(t, "-maxclients", "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Configure(cfg, flags, path); err != nil {
+		t.Fatal(err)
+	}
+	// file < environment < flags
+	if cfg.Port != "7000" || cfg.StrikeLimit != 4 || cfg.MaxClients != 7 {
+		t.Errorf("got port %s, strike limit %d and max clients %d, want 7000, 4 and 7", cfg.Port, cfg.StrikeLimit, cfg.MaxClients)
+	}
+	if cfg.BanLimit != DefaultConfig().BanLimit {
+		t.Errorf("a setting given nowhere isn't the default, got %s", cfg.BanLimit)
+	}
+}
+
+func TestApplyEnvBadValue(t *testing.T) {
+	t.Setenv("FOURAT_MESSAGE_RATE", "fast")
+	cfg := DefaultConfig()
+	if err := cfg.ApplyEnv(); err == nil || !strings.Contains(err.Error(), "FOURAT_MESSAGE_RATE") {
+		t.Errorf("got %v, want an error naming the variable", err)
+	}
+}
+
+func TestSensitiveHash(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SafeMode = "hash"
+	first := cfg.sensitive("10.0.0.1:1001")
+	if first != cfg.sensitive("10.0.0.1:1001") {
+		t.Errorf("the hash of the same address changed within a run")
+	}
+	if strings.Contains(first, "10.0.0.1") {
+		t.Errorf("the address shows through the hash: %s", first)
+	}
+	// The port is kept so the connections of one client stay apart
+	if other := cfg.sensitive("10.0.0.1:1002"); !strings.HasSuffix(other, ":1002") || strings.TrimSuffix(other, ":1002") != strings.TrimSuffix(first, ":1001") {
+		t.Errorf("got %s and %s for two connections from one host", first, other)
+	}
+
+	cfg.SafeModeKey = "one key"
+	keyed := cfg.sensitive("10.0.0.1:1001")
+	cfg.SafeModeKey = "another key"
+	if keyed == first || keyed == cfg.sensitive("10.0.0.1:1001") {
+		t.Errorf("the hash doesn't depend on the key")
+	}
+}
+
+func TestSensitiveModes(t *testing.T) {
+	cfg := DefaultConfig()
+	for mode, want := range map[string]string{"off": "10.0.0.1:1001", "redact": "[REDACTED]"} {
+		cfg.SafeMode = mode
+		if got := cfg.sensitive("10.0.0.1:1001"); got != want {
+			t.Errorf("%s: got %s, want %s", mode, got, want)
+		}
+	}
+}
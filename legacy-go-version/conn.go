@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+)
+
+// safeConn closes the connection once, however many of client(), server()
+// and the commands get to it. *net.TCPConn shrugs off a second Close, but
+// not every wrapper around it promises to.
+type safeConn struct {
+	net.Conn
+	closeOnce sync.Once
+	closeErr error
+}
+
+func (c *safeConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.Conn.Close()
+	})
+	return c.closeErr
+}
+
+// NetConn is the wrapped connection, like the one of tls.Conn
+func (c *safeConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// asTLS looks through the safeConn for a TLS connection
+func asTLS(conn net.Conn) (*tls.Conn, bool) {
+	if safe, ok := conn.(*safeConn); ok {
+		conn = safe.Conn
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	return tlsConn, ok
+}
+
+// clientKey is the address of the peer as a whole, for the logs. Every
+// kind of connection has one, a connection without an address gets "".
+func clientKey(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// clientIP is the host part of the peer's address, what the bans and
+// :nohistory are kept by. The peers of a Unix socket are all on this
+// machine and share one.
+func clientIP(conn net.Conn) string {
+	switch addr := conn.RemoteAddr().(type) {
+	case nil:
+		return ""
+	case *net.TCPAddr:
+		// A closed or fake conn may have a nil one
+		if addr == nil {
+			return addr.String()
+		}
+		return addr.IP.String()
+	case *net.UnixAddr:
+		return "unix"
+	default:
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			return host
+		}
+		return addr.String()
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tsoding/4at/testutil"
+)
+
+func TestReusedAddressIsANewClient(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	bob := ts.connect("10.0.0.2:1002")
+	first := ts.connect("10.0.0.1:4242")
+	first.Play(ScriptStep{After: time.Second, Line: ":nick alice"})
+	first.Close()
+
+	// A NAT handing the same source port out again right away
+	second := ts.connect("10.0.0.1:4242")
+	if first.ID == second.ID {
+		t.Fatalf("both connections got the ID %d", first.ID)
+	}
+	second.Play(ScriptStep{After: time.Second, Line: "who am I"})
+
+	if bob.Got("alice: who am I") {
+		t.Errorf("the second connection inherited the nick of the first, got %q", bob.Received())
+	}
+	if !bob.Got("who am I") {
+		t.Errorf("the second connection can't talk, got %q", bob.Received())
+	}
+	if snapshot := ts.sync(); snapshot.Clients != 2 {
+		t.Errorf("%d clients, want 2", snapshot.Clients)
+	}
+}
+
+func TestDisconnectOnlyForgetsItsOwnConnection(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	bob := ts.connect("10.0.0.2:1002")
+	// The same address string twice at once, the peers of a Unix socket
+	// all look like this
+	first := ts.connect("@")
+	second := ts.connect("@")
+
+	first.Close()
+	bob.Play(ScriptStep{After: time.Second, Line: "still there?"})
+
+	if !second.Got("still there?") {
+		t.Errorf("the other connection on the address was dropped, got %q", second.Received())
+	}
+	if second.Conn.IsClosed() {
+		t.Errorf("the other connection on the address was hung up on")
+	}
+	if snapshot := ts.sync(); snapshot.Clients != 2 {
+		t.Errorf("%d clients, want 2", snapshot.Clients)
+	}
+}
+
+func TestAdmitNeverGoesOverTheLimit(t *testing.T) {
+	const max = 10
+	var connected atomic.Int32
+	var admitted atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if admit(&connected, max) {
+				admitted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if admitted.Load() != max || connected.Load() != max {
+		t.Errorf("%d admitted, %d connected, want %d", admitted.Load(), connected.Load(), max)
+	}
+}
+
+// freePorts finds a port that is free along with the one after it
+func freePorts(t *testing.T) int {
+	t.Helper()
+	for i := 0; i < 20; i++ {
+		ln, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := ln.Addr().(*net.TCPAddr).Port
+		next, err := net.Listen("tcp", ":"+strconv.Itoa(port+1))
+		ln.Close()
+		if err == nil {
+			next.Close()
+			return port
+		}
+	}
+	t.Skip("no two free ports in a row")
+	return 0
+}
+
+func TestListenFallsBackToTheNextPort(t *testing.T) {
+	if testing.Short() {
+		t.Skip("binds real ports")
+	}
+	port := freePorts(t)
+	taken, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		t.Skip("the port went away: ", err)
+	}
+	defer taken.Close()
+
+	if _, _, err := listen(strconv.Itoa(port), 0); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("want the port in use without retries, got %v", err)
+	}
+
+	ln, bound, err := listen(strconv.Itoa(port), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if bound != strconv.Itoa(port+1) {
+		t.Errorf("bound %s, want %d", bound, port+1)
+	}
+
+	ephemeral, bound, err := listen("0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ephemeral.Close()
+	if bound == "0" || bound != strconv.Itoa(ephemeral.Addr().(*net.TCPAddr).Port) {
+		t.Errorf("-port 0 reported %s", bound)
+	}
+}
+
+// scriptedListener hands out the conns and errors of its script in order,
+// then fails for good
+type scriptedListener struct {
+	mu sync.Mutex
+	script []any
+	calls []time.Time
+}
+
+func (ln *scriptedListener) Accept() (net.Conn, error) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	ln.calls = append(ln.calls, time.Now())
+	if len(ln.script) == 0 {
+		return nil, net.ErrClosed
+	}
+	step := ln.script[0]
+	ln.script = ln.script[1:]
+	if err, ok := step.(error); ok {
+		return nil, err
+	}
+	return step.(net.Conn), nil
+}
+
+func (ln *scriptedListener) Close() error {
+	return nil
+}
+
+func (ln *scriptedListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6969}
+}
+
+func TestAcceptBacksOffAndRecovers(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	ln := &scriptedListener{script: []any{
+		emfile, emfile, emfile, emfile,
+		testutil.NewFakeConn("10.0.0.1:1001"),
+		emfile,
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages := make(chan Message, 1)
+	var connected atomic.Int32
+	log := captureLog(t)
+
+	err := accept(ctx, testConfig(), &CatalogFile{}, ln, &connected, messages)
+
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("want the listener's error to end the loop, got %v", err)
+	}
+	if msg := <-messages; msg.Type != ClientConnected {
+		t.Errorf("the connection between the errors wasn't accepted: %+v", msg)
+	}
+	if len(ln.calls) != 7 {
+		t.Fatalf("Accept was called %d times", len(ln.calls))
+	}
+	// Doubling from minAcceptBackoff after every error in a row
+	for i, want := range []time.Duration{5, 10, 20, 40} {
+		if waited := ln.calls[i+1].Sub(ln.calls[i]); waited < want*time.Millisecond {
+			t.Errorf("waited %s after error %d, want %dms", waited, i+1, want)
+		}
+	}
+	// And back to it after the accept went through
+	if waited := ln.calls[6].Sub(ln.calls[5]); waited < minAcceptBackoff || waited >= 40*time.Millisecond {
+		t.Errorf("waited %s after a successful accept, want the backoff to start over", waited)
+	}
+	// All of it within a second, so the errors were logged once
+	if logged := log.withEvent(t, "accept"); len(logged) != 1 {
+		t.Errorf("logged %d accept errors", len(logged))
+	}
+}
+
+// nilAddrConn is a conn whose peer address is a nil *net.TCPAddr, like a
+// closed or fake one may have
+type nilAddrConn struct {
+	net.Conn
+}
+
+func (nilAddrConn) RemoteAddr() net.Addr {
+	return (*net.TCPAddr)(nil)
+}
+
+func TestClientAddressOfANilTCPAddr(t *testing.T) {
+	conn := nilAddrConn{}
+	if ip, key := clientIP(conn), clientKey(conn); ip != "<nil>" || key != "<nil>" {
+		t.Errorf("got the IP %q and the key %q", ip, key)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"log/slog"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"sync/atomic"
+	"time"
+)
+
+// Published at /debug/vars, see -debugaddr. server() updates them as it
+// goes, so they are read without asking it, unlike /debug/stats.
+var (
+	// The clients server() has set up, see countClient
+	connectedClients = expvar.NewInt("connectedClients")
+	totalMessages = expvar.NewInt("totalMessages")
+	totalBans = expvar.NewInt("totalBans")
+	totalStrikes = expvar.NewInt("totalStrikes")
+	totalPanics = expvar.NewInt("totalPanics")
+	// Reads that ran into their deadline without the client disconnecting
+	readTimeouts = expvar.NewInt("readTimeouts")
+	serverVersion = expvar.NewString("version")
+	serverStartTime = expvar.NewString("startTime")
+	// May differ from -port, see -port-retry
+	listenPort = expvar.NewString("port")
+	// The most connectedClients since the start
+	peakClients atomic.Int64
+)
+
+func init() {
+	expvar.Publish("peakClients", expvar.Func(func() any {
+		return peakClients.Load()
+	}))
+}
+
+// countClient keeps connectedClients and peakClients in step with
+// Server.clients. Only server() calls it, so the peak needs no
+// compare-and-swap.
+func countClient(delta int64) {
+	connectedClients.Add(delta)
+	if n := connectedClients.Value(); n > peakClients.Load() {
+		peakClients.Store(n)
+	}
+}
+
+// How long /debug/stats waits for a busy server()
+const statsTimeout = 5*time.Second
+
+// serveDebug serves expvar at /debug/vars and pprof at /debug/pprof/. Both
+// register themselves on the default mux when imported. /debug/stats asks
+// server() for the current state.
+func serveDebug(ctx context.Context, addr string, messages chan Message) error {
+	serverVersion.Set(versionString())
+	serverStartTime.Set(time.Now().Format(time.RFC3339))
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	http.HandleFunc("/debug/stats", func(w http.ResponseWriter, r *http.Request) {
+		queryCtx, cancel := context.WithTimeout(r.Context(), statsTimeout)
+		defer cancel()
+		snapshot, err := queryStats(queryCtx, messages)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshot)
+	})
+	srv := &http.Server{}
+	context.AfterFunc(ctx, func() {
+		srv.Close()
+	})
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error("Debug server failed", "addr", addr, "err", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCountersFollowTheServer(t *testing.T) {
+	cfg := testConfig()
+	cfg.StrikeLimit = 1
+	ts := startServer(t, cfg, nil)
+	// Other tests count too, only the changes are ours
+	clients, messages, bans, strikes := connectedClients.Value(), totalMessages.Value(), totalBans.Value(), totalStrikes.Value()
+
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+	mallory := ts.connect("10.0.0.9:1009")
+	if connectedClients.Value()-clients != 3 || peakClients.Load() < clients+3 {
+		t.Errorf("connected %d, peak %d after 3 connects", connectedClients.Value()-clients, peakClients.Load())
+	}
+	alice.Play(ScriptStep{After: time.Second, Line: "hello"})
+	// Too fast, a rate limit strike
+	alice.Send("hello again")
+	bob.WaitFor("hello")
+	// A content strike and the ban
+	mallory.Play(ScriptStep{After: time.Second, Line: garbage})
+	alice.WaitFor("10.0.0.9 left " + defaultRoom)
+	bob.Close()
+	alice.WaitFor("10.0.0.2 left " + defaultRoom)
+
+	snapshot := ts.sync()
+	if got := connectedClients.Value() - clients; got != int64(snapshot.Clients) || got != 1 {
+		t.Errorf("connected %d, server() has %d clients", got, snapshot.Clients)
+	}
+	if got := totalMessages.Value() - messages; got != int64(ts.s.stats.Relayed) || got != 1 {
+		t.Errorf("counted %d messages, server() relayed %d", got, ts.s.stats.Relayed)
+	}
+	if got := totalStrikes.Value() - strikes; got != int64(ts.s.stats.Strikes) || got != 2 {
+		t.Errorf("counted %d strikes, server() %d", got, ts.s.stats.Strikes)
+	}
+	if got := totalBans.Value() - bans; got != int64(ts.s.stats.Bans) || got != 1 {
+		t.Errorf("counted %d bans, server() %d", got, ts.s.stats.Bans)
+	}
+}
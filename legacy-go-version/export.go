@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tsoding/4at/transcript"
+)
+
+// export writes the messages of the last window to a new transcript file
+// in ExportDir. The slice is taken here in the server goroutine, the file
+// is written by a worker which reports back with an ExportFinished
+// message. Only one export runs at a time, so two of them never end up
+// in one file.
+func (s *Server) export(author *Client, window time.Duration, now time.Time) {
+	if s.exporting {
+		s.tell(author, "export_busy", CatalogData{})
+		return
+	}
+	s.exporting = true
+	since := now.Add(-window)
+	var entries []transcript.Entry
+	if s.historyDB == nil {
+		for _, entry := range s.history.Slice() {
+			if !entry.Time.Before(since) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	db := s.historyDB
+	path := filepath.Join(s.cfg.ExportDir, "4at-export-"+now.Format("20060102-150405.000")+".jsonl")
+	id := author.ID
+	ctx, messages := s.ctx, s.messages
+	author.log.Info("Client started an export", "event", "export", "client", s.cfg.sensitive(clientKey(author.Conn)), "window", window.String(), "path", path)
+	go func() {
+		var err error
+		if db != nil {
+			entries, err = db.Since(since)
+		}
+		if err == nil {
+			err = writeExport(path, entries)
+		}
+		text := s.say("exported", CatalogData{Count: len(entries), Text: path}) + "\n"
+		if err != nil {
+			text = s.say("export_failed", CatalogData{Text: err.Error()}) + "\n"
+		}
+		select {
+		case messages <- Message{
+			Type: ExportFinished,
+			ConnID: id,
+			Text: text,
+		}:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+func writeExport(path string, entries []transcript.Entry) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	w, err := transcript.Open(path, time.Second)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := w.Write(entry); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
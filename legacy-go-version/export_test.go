@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tsoding/4at/transcript"
+)
+
+// exported reads the transcript the export of the client was written to
+func exported(t *testing.T, c *ScriptedClient) []string {
+	t.Helper()
+	c.WaitFor("Exported ")
+	var path string
+	for _, line := range c.Received() {
+		if _, after, ok := strings.Cut(line, " messages to "); ok {
+			path = after
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var texts []string
+	r := transcript.NewReader(file)
+	for {
+		entry, err := r.Next()
+		if err == io.EOF {
+			return texts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		texts = append(texts, strings.TrimSuffix(entry.Text, "\n"))
+	}
+}
+
+func TestExportCoversTheWindow(t *testing.T) {
+	cfg := adminConfig(t)
+	cfg.ExportDir = t.TempDir()
+	ts := startServer(t, cfg, nil)
+	admin := ts.connect("10.0.0.1:1001")
+	admin.Auth()
+	alice := ts.connect("10.0.0.2:1002")
+
+	alice.Play(
+		ScriptStep{After: time.Second, Line: "too old"},
+		ScriptStep{After: 2*time.Hour, Line: "just in"},
+		ScriptStep{After: 59*time.Minute, Line: "latest"},
+	)
+	// "just in" is exactly an hour old
+	ts.clock.Advance(time.Minute)
+	admin.Play(ScriptStep{After: 0, Line: ":export 1h"})
+
+	got := exported(t, admin)
+	if strings.Join(got, "|") != "just in|latest" || !admin.Got("Exported 2 messages") {
+		t.Errorf("exported %q, told %q", got, admin.Received())
+	}
+}
+
+func TestOverlappingExportsAreRejected(t *testing.T) {
+	cfg := adminConfig(t)
+	cfg.ExportDir = t.TempDir()
+	ts := startServer(t, cfg, nil)
+	alice := ts.connect("10.0.0.1:1001")
+	alice.Auth()
+	bob := ts.connect("10.0.0.2:1002")
+	bob.Auth()
+	alice.Play(ScriptStep{After: time.Second, Line: "hello"})
+
+	// Both in the same round, the worker can't be done in between
+	ts.clock.Advance(time.Second)
+	resume := ts.pause()
+	alice.Queue(":export 1h")
+	bob.Queue(":export 1h")
+	resume()
+	ts.sync()
+
+	if !bob.Got("Another export is running") {
+		t.Errorf("the second export wasn't rejected, got %q", bob.Received())
+	}
+	if got := exported(t, alice); len(got) != 1 {
+		t.Errorf("exported %q", got)
+	}
+
+	// And once it's done the next one may go
+	bob.Forget()
+	bob.Play(ScriptStep{After: time.Second, Line: ":export 1h"})
+	exported(t, bob)
+}
@@ -0,0 +1,93 @@
+package main
+
+// How many messages server() takes in from the channel before it runs the
+// next round anyway, so a steady stream of arrivals can't put the rounds off
+// forever
+const fairIntake = 256
+
+// FairQueue holds the messages of the clients while server() is busy
+// broadcasting. Every sender has a queue of its own and the messages are
+// handed out in rounds, a few per sender, so during a broadcast storm a
+// handful of noisy clients don't take all the broadcasts from the quiet
+// ones. Owned by server() like the rest of Server.
+type FairQueue struct {
+	senders map[ConnID]*fairSender
+	// The senders in the order they get their turn
+	order []ConnID
+	// Messages waiting in all the queues
+	len int
+}
+
+type fairSender struct {
+	queue []Message
+	// Since the queue was last empty, to tell the sender only once
+	dropped int
+}
+
+func NewFairQueue() *FairQueue {
+	return &FairQueue{
+		senders: map[ConnID]*fairSender{},
+	}
+}
+
+func (q *FairQueue) Len() int {
+	return q.len
+}
+
+// Push queues the message behind the others of its sender. A full queue
+// drops the message, the result is how many were dropped since the queue
+// was last empty, 0 when the message was queued.
+func (q *FairQueue) Push(msg Message, limit int) int {
+	sender := q.senders[msg.ConnID]
+	if sender == nil {
+		sender = &fairSender{}
+		q.senders[msg.ConnID] = sender
+		q.order = append(q.order, msg.ConnID)
+	}
+	if len(sender.queue) >= limit {
+		sender.dropped += 1
+		return sender.dropped
+	}
+	sender.queue = append(sender.queue, msg)
+	q.len += 1
+	return 0
+}
+
+// Take takes all the messages of one sender out of the queue, in the
+// order they arrived in
+func (q *FairQueue) Take(id ConnID) []Message {
+	sender := q.senders[id]
+	if sender == nil {
+		return nil
+	}
+	delete(q.senders, id)
+	for i, other := range q.order {
+		if other == id {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+	q.len -= len(sender.queue)
+	return sender.queue
+}
+
+// Round takes up to share messages from every sender, in the order they
+// arrived in. The senders left with nothing are forgotten.
+func (q *FairQueue) Round(share int) []Message {
+	round := []Message{}
+	order := q.order[:0]
+	for _, id := range q.order {
+		sender := q.senders[id]
+		n := min(share, len(sender.queue))
+		round = append(round, sender.queue[:n]...)
+		sender.queue = sender.queue[n:]
+		q.len -= n
+		if len(sender.queue) == 0 {
+			delete(q.senders, id)
+		} else {
+			order = append(order, id)
+		}
+	}
+	q.order = order
+	return round
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFairQueueRoundsTakeTurns(t *testing.T) {
+	q := NewFairQueue()
+	// One noisy sender with a full queue, two quiet ones with a message
+	// each, arriving after the noisy ones
+	for i := 0; i < 8; i++ {
+		q.Push(Message{ConnID: 1, Text: fmt.Sprintf("noisy %d", i)}, 8)
+	}
+	q.Push(Message{ConnID: 2, Text: "quiet 2"}, 8)
+	q.Push(Message{ConnID: 3, Text: "quiet 3"}, 8)
+
+	var got []string
+	for _, msg := range q.Round(1) {
+		got = append(got, msg.Text)
+	}
+	want := []string{"noisy 0", "quiet 2", "quiet 3"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("first round is %q, want %q", got, want)
+	}
+	if q.Len() != 7 {
+		t.Errorf("%d messages left, want 7", q.Len())
+	}
+	if dropped := q.Push(Message{ConnID: 1}, 7); dropped != 1 {
+		t.Errorf("a push over the limit dropped %d messages, want 1", dropped)
+	}
+}
+
+func TestFairQueueTake(t *testing.T) {
+	q := NewFairQueue()
+	q.Push(Message{ConnID: 1, Text: "a"}, 8)
+	q.Push(Message{ConnID: 2, Text: "b"}, 8)
+	q.Push(Message{ConnID: 1, Text: "c"}, 8)
+
+	taken := q.Take(1)
+	if len(taken) != 2 || taken[0].Text != "a" || taken[1].Text != "c" {
+		t.Errorf("took %v, want a and c", taken)
+	}
+	if q.Len() != 1 {
+		t.Errorf("%d messages left, want 1", q.Len())
+	}
+	if round := q.Round(8); len(round) != 1 || round[0].Text != "b" {
+		t.Errorf("the round after Take is %v, want b", round)
+	}
+	if taken := q.Take(1); taken != nil {
+		t.Errorf("took %v from a sender with nothing queued", taken)
+	}
+}
+
+func TestSkewedSendersShareTheBroadcasts(t *testing.T) {
+	cfg := testConfig()
+	cfg.MessageRate = 0
+	ts := startServer(t, cfg, nil)
+	noisy := ts.connect("10.0.0.1:1001")
+	quiet := ts.connect("10.0.0.2:1002")
+	listener := ts.connect("10.0.0.3:1003")
+
+	resume := ts.pause()
+	noisy.Queue("noisy 0", "noisy 1", "noisy 2", "noisy 3")
+	quiet.Queue("quiet 0")
+	resume()
+	snapshot := ts.sync()
+
+	var got []string
+	for _, line := range listener.Received() {
+		if strings.HasPrefix(line, "noisy") || strings.HasPrefix(line, "quiet") {
+			got = append(got, line)
+		}
+	}
+	want := []string{"noisy 0", "quiet 0", "noisy 1", "noisy 2", "noisy 3"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("the listener got %q, want %q", got, want)
+	}
+	if snapshot.Stats.Relayed != 5 {
+		t.Errorf("relayed %d messages, want 5", snapshot.Stats.Relayed)
+	}
+}
+
+func TestLastWordsBeforeDisconnect(t *testing.T) {
+	// FairShare is on by default, the message waits for its round
+	ts := startServer(t, testConfig(), nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+
+	ts.clock.Advance(time.Second)
+	resume := ts.pause()
+	alice.Queue("last words")
+	alice.QueueClose()
+	resume()
+	ts.sync()
+
+	if !bob.Got("last words") {
+		t.Errorf("the message sent right before disconnecting was lost, got %q", bob.Received())
+	}
+}
+
+// BenchmarkFairQueueSkewed runs a round per op with 20 noisy senders
+// keeping their queues full and a quiet one sending a message
+func BenchmarkFairQueueSkewed(b *testing.B) {
+	q := NewFairQueue()
+	for i := 0; i < b.N; i++ {
+		for id := ConnID(0); id < 20; id++ {
+			q.Push(Message{ConnID: id}, 8)
+			q.Push(Message{ConnID: id}, 8)
+		}
+		q.Push(Message{ConnID: ConnID(20 + i%5)}, 8)
+		q.Round(1)
+	}
+}
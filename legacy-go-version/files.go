@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Files holds everything the server reads from disk. It is loaded at
+// startup and reloaded on SIGHUP while server() keeps reading from it, so
+// each piece of data is guarded by its own lock.
+type Files struct {
+	Motd MotdFile
+	Wordlist WordlistFile
+	RegexFilter RegexFilterFile
+	Catalog CatalogFile
+	Bans BanListFile
+}
+
+type MotdFile struct {
+	mu sync.RWMutex
+	text string
+}
+
+func (motd *MotdFile) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	motd.mu.Lock()
+	defer motd.mu.Unlock()
+	motd.text = string(data)
+	return nil
+}
+
+func (motd *MotdFile) Text() string {
+	motd.mu.RLock()
+	defer motd.mu.RUnlock()
+	return motd.text
+}
+
+// WordlistFile is the list of phrases the clients may not use
+type WordlistFile struct {
+	mu sync.RWMutex
+	words []string
+}
+
+func (wordlist *WordlistFile) Load(path string) error {
+	words, err := loadWordlist(path)
+	if err != nil {
+		return err
+	}
+	wordlist.mu.Lock()
+	defer wordlist.mu.Unlock()
+	wordlist.words = words
+	return nil
+}
+
+// Match returns the first blocked phrase the text contains, ignoring case
+func (wordlist *WordlistFile) Match(text string) (string, bool) {
+	wordlist.mu.RLock()
+	defer wordlist.mu.RUnlock()
+	text = strings.ToLower(text)
+	for _, word := range wordlist.words {
+		if strings.Contains(text, word) {
+			return word, true
+		}
+	}
+	return "", false
+}
+
+// loadWordlist reads one phrase per line, skipping the blank lines and the
+// # comments. The phrases are trimmed, lowercased and deduplicated.
+func loadWordlist(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var words []string
+	seen := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		word := strings.ToLower(strings.TrimSpace(line))
+		if word == "" || seen[word] {
+			continue
+		}
+		seen[word] = true
+		words = append(words, word)
+	}
+	return words, nil
+}
+
+// RegexFilterFile is the list of regular expressions the messages may not
+// match, one per line
+type RegexFilterFile struct {
+	mu sync.RWMutex
+	// In the order of the file, a line broken by an edit keeps the pattern
+	// it replaced, see Load
+	patterns []*regexp.Regexp
+	errors []string
+}
+
+// Load compiles the patterns of the file. A line that doesn't compile
+// keeps the previous pattern at its place in the file: the one following
+// the last line the edit left alone, if the edit took it away.
+func (filter *RegexFilterFile) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+	lines := strings.Split(string(data), "\n")
+	present := map[string]bool{}
+	for _, line := range lines {
+		present[strings.TrimSpace(line)] = true
+	}
+	var patterns []*regexp.Regexp
+	var errors []string
+	// The index of the previous pattern the last unchanged line has
+	anchor := -1
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		re, err := regexp.Compile(line)
+		if err == nil {
+			patterns = append(patterns, re)
+			for j := anchor + 1; j < len(filter.patterns); j++ {
+				if filter.patterns[j].String() == line {
+					anchor = j
+					break
+				}
+			}
+			continue
+		}
+		errors = append(errors, fmt.Sprintf("%s:%d: %s", path, i+1, err))
+		if next := anchor + 1; next < len(filter.patterns) && !present[filter.patterns[next].String()] {
+			old := filter.patterns[next]
+			slog.Warn("Invalid pattern, keeping the previous one", "event", "regex_filter", "path", path, "line", i+1, "pattern", line, "previous", old.String(), "err", err)
+			patterns = append(patterns, old)
+			anchor = next
+		} else {
+			slog.Error("Invalid pattern", "event", "regex_filter", "path", path, "line", i+1, "pattern", line, "err", err)
+		}
+	}
+	filter.patterns = patterns
+	filter.errors = errors
+	return nil
+}
+
+// Match returns the first pattern the text matches
+func (filter *RegexFilterFile) Match(text string) (string, bool) {
+	filter.mu.RLock()
+	defer filter.mu.RUnlock()
+	for _, re := range filter.patterns {
+		if re.MatchString(text) {
+			return re.String(), true
+		}
+	}
+	return "", false
+}
+
+// RegexCompileErrors are the lines that didn't compile on the last load
+func (filter *RegexFilterFile) RegexCompileErrors() []string {
+	filter.mu.RLock()
+	defer filter.mu.RUnlock()
+	return filter.errors
+}
+
+// BanListFile is the ban list of -banfile as last read from disk. The
+// bans themselves belong to server(), Take hands them over.
+type BanListFile struct {
+	mu sync.Mutex
+	bans map[string]time.Time
+}
+
+func (list *BanListFile) Load(path string) error {
+	bans, err := loadBans(path)
+	if err != nil {
+		return err
+	}
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	list.bans = bans
+	return nil
+}
+
+// Take returns the bans loaded since the last Take, nil if none were
+func (list *BanListFile) Take() map[string]time.Time {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	bans := list.bans
+	list.bans = nil
+	return bans
+}
+
+type reloadable struct {
+	name string
+	path string
+	load func(path string) error
+	// A broken optional file is reported but doesn't stop the server from
+	// starting, it goes on with the previous data, or none
+	optional bool
+}
+
+func (files *Files) reloadables(cfg Config) []reloadable {
+	return []reloadable{
+		{name: "MOTD", path: cfg.MotdPath, load: files.Motd.Load},
+		{name: "wordlist", path: cfg.WordlistPath, load: files.Wordlist.Load, optional: true},
+		{name: "regex filter", path: cfg.RegexFilterPath, load: files.RegexFilter.Load, optional: true},
+		{name: "messages", path: cfg.MessagesPath, load: files.Catalog.Load, optional: true},
+		{name: "ban list", path: cfg.BanFile, load: files.Bans.Load},
+	}
+}
+
+// Load reads every configured file independently, so a broken file does
+// not prevent the rest from being (re)loaded. On failure the previously
+// loaded data stays in place.
+func (files *Files) Load(cfg Config) (loaded []string, errs []error) {
+	for _, file := range files.reloadables(cfg) {
+		if file.path == "" {
+			continue
+		}
+		if err := file.load(file.path); err != nil {
+			if file.optional {
+				slog.Error("Could not load a file, keeping the previous one", "event", "reload", "file", file.name, "path", file.path, "err", err)
+				continue
+			}
+			errs = append(errs, fmt.Errorf("could not load %s from %s: %w", file.name, file.path, err))
+			continue
+		}
+		loaded = append(loaded, file.name)
+	}
+	return loaded, errs
+}
+
+// Reloader re-reads the configuration and the files it points to, then
+// hands the new configuration over to server(). Both SIGHUP and the
+// :reload command end up here.
+type Reloader struct {
+	// The flags are bound to the fields of this Config, so nothing but the
+	// Reloader may touch it once it runs
+	bound *Config
+	flags *flag.FlagSet
+	configPath string
+	last Config
+	files *Files
+	messages chan Message
+	requests chan string
+}
+
+// Request asks for a reload on behalf of actor without blocking. Requests
+// arriving while one is already pending are merged into it.
+func (r *Reloader) Request(actor string) {
+	select {
+	case r.requests <- actor:
+	default:
+	}
+}
+
+func (r *Reloader) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		actor := "signal/SIGHUP"
+		select {
+		case <-hup:
+		case actor = <-r.requests:
+		case <-ctx.Done():
+			return
+		}
+		r.reload(ctx, actor)
+	}
+}
+
+func (r *Reloader) reload(ctx context.Context, actor string) {
+	cfg := r.last
+	if err := Configure(r.bound, r.flags, r.configPath); err != nil {
+		slog.Error("Could not reload the configuration, keeping the old one", "event", "reload", "err", err)
+	} else if err := r.bound.Validate(); err != nil {
+		slog.Error("Invalid configuration on reload, keeping the old one", "event", "reload", "err", err)
+	} else if err := hashPasswords(r.bound); err != nil {
+		slog.Error("Invalid configuration on reload, keeping the old one", "event", "reload", "err", err)
+	} else {
+		cfg = *r.bound
+	}
+	r.last = cfg
+
+	loaded, errs := r.files.Load(cfg)
+	for _, err := range errs {
+		slog.Error("Could not reload a file", "event", "reload", "err", err)
+	}
+	slog.Info("Reloaded files", "event", "reload", "files", strings.Join(loaded, ","), "errors", len(errs))
+
+	select {
+	case r.messages <- Message{
+		Type: ConfigReloaded,
+		Config: &cfg,
+		Bans: r.files.Bans.Take(),
+		Actor: actor,
+	}:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// reloadFiles loads the files again and hands the configuration over to
+// server() like the Reloader does
+func reloadFiles(ts *testServer, files *Files, cfg Config) {
+	ts.t.Helper()
+	if _, errs := files.Load(cfg); len(errs) > 0 {
+		ts.t.Fatal(errs)
+	}
+	ts.messages <- Message{Type: ConfigReloaded, Config: &cfg, Bans: files.Bans.Take(), Actor: "test"}
+	ts.sync()
+}
+
+func TestLoadWordlist(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"comments only", "# the blocked phrases\n\n   # indented too\n", nil},
+		{"trailing whitespace", "spam  \n\teggs and ham \t\r\n", []string{"spam", "eggs and ham"}},
+		{"duplicates", "spam\nSpam\nspam # again\n  spam\neggs\n", []string{"spam", "eggs"}},
+		{"comment after a phrase", "spam # no spam please\n", []string{"spam"}},
+	} {
+		words, err := loadWordlist(writeFile(t, "wordlist.txt", tc.text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(words, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, words, tc.want)
+		}
+	}
+}
+
+func TestWordlistKeepsThePreviousOnError(t *testing.T) {
+	path := writeFile(t, "wordlist.txt", "spam\n")
+	var wordlist WordlistFile
+	if err := wordlist.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(path)
+	if err := wordlist.Load(path); err == nil {
+		t.Fatalf("a missing file loaded")
+	}
+	if word, blocked := wordlist.Match("SPAM for everybody"); !blocked || word != "spam" {
+		t.Errorf("the previous wordlist is gone")
+	}
+}
+
+func TestReloadedBanListReplacesTheBans(t *testing.T) {
+	cfg := testConfig()
+	cfg.BanFile = writeFile(t, "bans.json", `{"10.0.0.9": "2024-01-14T11:59:00Z"}`)
+	files := &Files{}
+	ts := startServer(t, cfg, files)
+	alice := ts.connect("10.0.0.1:1001")
+
+	reloadFiles(ts, files, cfg)
+	if mallory := ts.connect("10.0.0.9:1009"); !mallory.Got("You are banned MF") {
+		t.Errorf("a ban added to the file isn't enforced, got %q", mallory.Received())
+	}
+
+	if err := os.WriteFile(cfg.BanFile, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloadFiles(ts, files, cfg)
+	if mallory := ts.connect("10.0.0.9:1010"); mallory.Got("You are banned MF") {
+		t.Errorf("a ban lifted in the file is still enforced")
+	}
+	if files.Bans.Take() != nil {
+		t.Errorf("the same bans were handed over twice")
+	}
+	if alice.Conn.IsClosed() {
+		t.Errorf("a reload hung up on a client")
+	}
+}
+
+func TestReloadAppliesTheNewMessageRate(t *testing.T) {
+	path := writeFile(t, "4at.json", `{"MessageRate": "1s"}`)
+	cfg, fs, err := parseFlags(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Configure(cfg, fs, path); err != nil {
+		t.Fatal(err)
+	}
+	files := &Files{}
+	ts := startServer(t, *cfg, files)
+	reloader := &Reloader{
+		bound: cfg,
+		flags: fs,
+		configPath: path,
+		last: *cfg,
+		files: files,
+		messages: ts.messages,
+	}
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+
+	alice.Play(ScriptStep{After: 2*time.Second, Line: "before"})
+	if err := os.WriteFile(path, []byte(`{"MessageRate": "5s"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloader.reload(ts.ctx, "test")
+	ts.sync()
+	alice.Play(
+		ScriptStep{After: 2*time.Second, Line: "too soon"},
+		ScriptStep{After: 5*time.Second, Line: "after"},
+	)
+
+	if !bob.Got("before") || bob.Got("too soon") || !bob.Got("after") {
+		t.Errorf("the reloaded rate isn't applied, got %q", bob.Received())
+	}
+}
+
+func TestMotdReload(t *testing.T) {
+	cfg := testConfig()
+	cfg.MotdPath = writeFile(t, "motd.txt", "Welcome to the first version\n")
+	files := &Files{}
+	if _, errs := files.Load(cfg); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	ts := startServer(t, cfg, files)
+
+	alice := ts.connect("10.0.0.1:1001")
+	if !alice.Got("Welcome to the first version") {
+		t.Errorf("the MOTD isn't sent on connect, got %q", alice.Received())
+	}
+
+	if err := os.WriteFile(cfg.MotdPath, []byte("Welcome to the second version\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloadFiles(ts, files, cfg)
+	if !alice.Got("MOTD updated. Use :motd to view it.") || alice.Got("Welcome to the second version") {
+		t.Errorf("a connected client isn't told about the new MOTD, got %q", alice.Received())
+	}
+	if bob := ts.connect("10.0.0.2:1002"); !bob.Got("Welcome to the second version") {
+		t.Errorf("a new client doesn't get the new MOTD, got %q", bob.Received())
+	}
+	alice.Play(ScriptStep{After: time.Second, Line: ":motd"})
+	if !alice.Got("Welcome to the second version") {
+		t.Errorf(":motd doesn't show the new MOTD, got %q", alice.Received())
+	}
+
+	// Unchanged, nobody is told again
+	alice.Forget()
+	reloadFiles(ts, files, cfg)
+	if alice.Got("MOTD updated") {
+		t.Errorf("a reload that didn't change the MOTD announced it")
+	}
+}
+
+func TestSighupReloadsTheFiles(t *testing.T) {
+	motd := writeFile(t, "motd.txt", "Welcome to the first version\n")
+	cfg, fs, err := parseFlags(t, "-motd", motd, "-safe-mode", "off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := &Files{}
+	if _, errs := files.Load(*cfg); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	ts := startServer(t, *cfg, files)
+	reloader := &Reloader{
+		bound: cfg,
+		flags: fs,
+		last: *cfg,
+		files: files,
+		messages: ts.messages,
+		requests: make(chan string, 1),
+	}
+	// Until Run listens, a SIGHUP would kill the test instead
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go reloader.Run(ts.ctx)
+	alice := ts.connect("10.0.0.1:1001")
+
+	if err := os.WriteFile(motd, []byte("Welcome to the second version\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Again until Run got one
+	deadline := time.Now().Add(5*time.Second)
+	for !alice.Got("MOTD updated") {
+		if time.Now().After(deadline) {
+			t.Fatalf("no reload on SIGHUP, got %q", alice.Received())
+		}
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20*time.Millisecond)
+		ts.sync()
+	}
+	if bob := ts.connect("10.0.0.2:1002"); !bob.Got("Welcome to the second version") {
+		t.Errorf("a new client doesn't get the new MOTD, got %q", bob.Received())
+	}
+}
+
+func TestRegexFilterKeepsTheEditedPatternInItsPlace(t *testing.T) {
+	filter := &RegexFilterFile{}
+	path := writeFile(t, "regex.txt", "")
+	load := func(text string) []string {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := filter.Load(path); err != nil {
+			t.Fatal(err)
+		}
+		var patterns []string
+		for _, re := range filter.patterns {
+			patterns = append(patterns, re.String())
+		}
+		return patterns
+	}
+	load("^spam$\n^buy .* now$\n")
+
+	// A line inserted above the one an edit broke
+	got := load("^sp.m\n^spam$\n^buy (.* now$\n")
+	if want := []string{"^sp.m", "^spam$", "^buy .* now$"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if errs := filter.RegexCompileErrors(); len(errs) != 1 || !strings.Contains(errs[0], path+":3:") {
+		t.Errorf("got the errors %q", errs)
+	}
+	// Broken again on the next reload, still kept
+	if got := load("^sp.m\n^spam$\n^buy (.* now$\n"); len(got) != 3 {
+		t.Errorf("got %q", got)
+	}
+
+	// A broken line that replaced nothing gets nothing
+	got = load("^sp.m\n(\n^spam$\n^buy .* now$\n")
+	if want := []string{"^sp.m", "^spam$", "^buy .* now$"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The first pattern of the file that matches, every time
+	for i := 0; i < 20; i++ {
+		if pattern, ok := filter.Match("spam"); !ok || pattern != "^sp.m" {
+			t.Fatalf("matched %q", pattern)
+		}
+	}
+}
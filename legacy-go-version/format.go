@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// OutputFormat is how a client wants its lines, picked with :format
+type OutputFormat string
+
+const (
+	// As close to the raw text as possible, the default
+	PlainOutput OutputFormat = "plain"
+	// Every line starts with a tag telling what it is
+	VerboseOutput OutputFormat = "verbose"
+)
+
+type LineKind int
+const (
+	// A message of a client, or of a client of a relayed server
+	ChatLine LineKind = iota + 1
+	// Joins, kicks, topics and the other notices of the server
+	SystemLine
+	AnnouncementLine
+)
+
+// Line is something happening that the clients are told about. Every
+// client gets it through render, in its own format.
+type Line struct {
+	Kind LineKind
+	// The room of a ChatLine
+	Room string
+	// Who sent a ChatLine, empty when unknown
+	Sender string
+	Text string
+	// Numbers the ChatLines in the order server() delivered them, which is
+	// the order every client gets them in. Shown by the verbose format, so
+	// the clients can tell.
+	Seq uint64
+}
+
+// render is the one place that turns a Line into what a client reads, so
+// the tags of the verbose format apply to every kind of line the same way
+func render(line Line, format OutputFormat) string {
+	var tag string
+	var text string
+	switch line.Kind {
+	case ChatLine:
+		text = splitMessage(line.Text, maxLineLength)
+		tag = "[msg " + line.Room + " " + strconv.FormatUint(line.Seq, 10) + "]"
+		if line.Sender != "" {
+			tag += " <" + line.Sender + ">"
+		}
+	case SystemLine:
+		text = noticePrefix + " " + line.Text + "\n"
+		tag = "[sys]"
+	case AnnouncementLine:
+		text = announcementPrefix + " " + line.Text + "\n"
+		tag = "[ann]"
+	}
+	if format != VerboseOutput {
+		return text
+	}
+	if line.Kind != ChatLine {
+		// The tag says the same as the prefix
+		text = line.Text + "\n"
+	}
+	lines := strings.SplitAfter(strings.TrimSuffix(text, "\n"), "\n")
+	for i := range lines {
+		lines[i] = tag + " " + lines[i]
+	}
+	return strings.Join(lines, "") + "\n"
+}
+
+// renderer renders the line once per format, for the broadcasts
+func renderer(line Line) func(format OutputFormat) string {
+	rendered := map[OutputFormat]string{}
+	return func(format OutputFormat) string {
+		if format != VerboseOutput {
+			format = PlainOutput
+		}
+		text, ok := rendered[format]
+		if !ok {
+			text = render(line, format)
+			rendered[format] = text
+		}
+		return text
+	}
+}
+
+// Send writes the line to the client in the format it picked
+func (client *Client) Send(line Line) {
+	client.Write(render(line, client.Format))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderEveryKindInEveryFormat(t *testing.T) {
+	long := strings.Repeat("x", maxLineLength+88)
+	first, second := "[1/2] "+long[:maxLineLength], "[2/2] "+long[maxLineLength:]
+	for _, test := range []struct {
+		line Line
+		plain string
+		verbose string
+	}{
+		{
+			Line{Kind: ChatLine, Room: "#general", Sender: "bob", Text: "hi\n", Seq: 7},
+			"hi\n",
+			"[msg #general 7] <bob> hi\n",
+		},
+		{
+			// Relayed from a server that didn't say who
+			Line{Kind: ChatLine, Room: "#general", Text: "hi\n", Seq: 8},
+			"hi\n",
+			"[msg #general 8] hi\n",
+		},
+		{
+			Line{Kind: ChatLine, Room: "#golang", Sender: "bob", Text: long + "\n", Seq: 9},
+			first + "\n" + second + "\n",
+			"[msg #golang 9] <bob> " + first + "\n[msg #golang 9] <bob> " + second + "\n",
+		},
+		{
+			Line{Kind: SystemLine, Text: "bob joined #general, 2 members now"},
+			"[Server] bob joined #general, 2 members now\n",
+			"[sys] bob joined #general, 2 members now\n",
+		},
+		{
+			Line{Kind: SystemLine, Text: "[message from alice] psst"},
+			"[Server] [message from alice] psst\n",
+			"[sys] [message from alice] psst\n",
+		},
+		{
+			Line{Kind: AnnouncementLine, Text: "restarting in 5 minutes"},
+			"[Announcement] restarting in 5 minutes\n",
+			"[ann] restarting in 5 minutes\n",
+		},
+	} {
+		for format, want := range map[OutputFormat]string{
+			PlainOutput: test.plain,
+			VerboseOutput: test.verbose,
+			// A client that never picked one
+			"": test.plain,
+		} {
+			if got := renderer(test.line)(format); got != want {
+				t.Errorf("%q in %q: got %q, want %q", test.line.Text, format, got, want)
+			}
+		}
+	}
+}
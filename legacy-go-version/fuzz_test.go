@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+// What the clients may throw at the parsers besides plain chat, seeding
+// both fuzz targets. Run them with e.g. go test -fuzz FuzzSanitizeMessage
+var fuzzSeeds = []string{
+	"",
+	"hello",
+	":nick bob",
+	"  :join   #room  ",
+	":topic some\ttopic\n",
+	":)",
+	":",
+	":kick bob being rude",
+	":ban 10.0.0.1",
+	// Telnet IAC WILL ECHO, IAC DO SUPPRESS-GO-AHEAD
+	"\xff\xfb\x01\xff\xfd\x03",
+	// A lone surrogate half, U+D800 in CESU-8
+	"\xed\xa0\x80",
+	// 4-byte runes
+	"🙂 𝄞 𐍈",
+	"\x1b[31mred\x1b[0m",
+	"\x00\x01\x02",
+	"a\u0085b c　d",
+	"[Server] You are banned MF",
+	"hi\r[Server] You are banned MF",
+	"\x1b[2K\r[Server] fake kick",
+	// C1 controls, CSI and NEL
+	"\u009b2K\u0085[Server] fake kick",
+	"  [announcement] fake\nBYE code=banned retry_after=600\n",
+	strings.Repeat("x ", 300),
+}
+
+func FuzzIsCommand(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, text string) {
+		name, args, ok := parseCommand(text)
+		if !ok {
+			return
+		}
+		_, isCmd := commands[name]
+		_, isAdminCmd := adminCommands[name]
+		if !isCmd && !isAdminCmd {
+			t.Fatalf("%q parsed as the unknown command %q", text, name)
+		}
+		for _, token := range append([]string{name}, args...) {
+			if token == "" || strings.IndexFunc(token, unicode.IsSpace) >= 0 {
+				t.Fatalf("%q parsed into the token %q", text, token)
+			}
+		}
+		again, againArgs, ok := parseCommand(name + " " + strings.Join(args, " "))
+		if !ok || again != name || strings.Join(againArgs, " ") != strings.Join(args, " ") {
+			t.Fatalf("%q parsed as %q %q, but that parses as %q %q", text, name, args, again, againArgs)
+		}
+	})
+}
+
+func FuzzSanitizeMessage(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, text string) {
+		message := sanitizeMessage(text)
+		if !utf8.ValidString(message) {
+			t.Fatalf("sanitizeMessage(%q) = %q, not valid UTF-8", text, message)
+		}
+		if i := strings.IndexFunc(message, func(r rune) bool {
+			return r != '\n' && r != '\t' && unicode.IsControl(r)
+		}); i >= 0 {
+			t.Fatalf("sanitizeMessage(%q) = %q, a control character at %d", text, message, i)
+		}
+		if again := sanitizeMessage(message); again != message {
+			t.Fatalf("sanitizeMessage(%q) = %q, but sanitizing that again gives %q", text, message, again)
+		}
+		for _, line := range strings.SplitAfter(message, "\n") {
+			if strings.HasPrefix(line, spoofMarker) {
+				continue
+			}
+			trimmed := strings.ToLower(strings.TrimLeft(line, " \t\v\f"))
+			for _, prefix := range reservedPrefixes {
+				if strings.HasPrefix(trimmed, strings.ToLower(prefix)) {
+					t.Fatalf("sanitizeMessage(%q) let through the line %q", text, line)
+				}
+			}
+		}
+		if strings.IndexByte(text, 0) >= 0 && !looksBinary(text) {
+			t.Fatalf("%q has a NUL but doesn't look binary", text)
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// Why a handler turned a message down, besides the violations of the
+// hooks. The client has been told already, server() only logs them.
+var (
+	errBanned = errors.New("client is banned")
+	errUnknownClient = errors.New("connection is gone")
+	errMuted = errors.New("client is muted in its room")
+	errSlowMode = errors.New("room is in slow mode")
+)
+
+
+// handleClientConnected sets up the client of a new connection, unless its
+// IP is banned
+func (s *Server) handleClientConnected(msg Message) error {
+	addr, ip := clientKey(msg.Conn), clientIP(msg.Conn)
+	bannedAt, banned := s.bannedMfs[ip]
+	now := s.now()
+	if banned && now.Sub(bannedAt) >= s.cfg.BanLimit {
+		s.unban(AutoStrikeLimit, ip, "ban expired", now)
+		banned = false
+	}
+	if banned {
+		slog.Info("Banned client tried to connect", "event", "banned_reconnect", "conn", msg.ConnID, "client", s.cfg.sensitive(addr))
+		securityEvent("banned_reconnect", "ban", s.cfg.sensitive(addr), "left", (s.cfg.BanLimit - now.Sub(bannedAt)).Round(time.Second).String())
+		writeWithTimeout(msg.Conn, []byte(s.say("ban_countdown", CatalogData{Duration: s.cfg.BanLimit - now.Sub(bannedAt)})+"\n"), writeTimeout)
+		hangUp(msg.Conn, ByeBanned, s.cfg.BanLimit - now.Sub(bannedAt))
+		return errBanned
+	}
+
+	id := newCorrelationID()
+	client := &Client{
+		Conn: msg.Conn,
+		ID: msg.ConnID,
+		CorrelationID: id,
+		log: slog.With("cid", id, "conn", msg.ConnID),
+		ConnectedAt: now,
+		LastMessage: now,
+		Format: PlainOutput,
+		budget: newBudget(s.cfg.Bandwidth),
+	}
+	client.log.Info("Client connected", "event", "connect", "client", s.cfg.sensitive(addr))
+	// The only CA the client certificates are verified against is the
+	// admin one, see -adminca
+	if tlsConn, ok := asTLS(msg.Conn); ok && len(tlsConn.ConnectionState().VerifiedChains) > 0 {
+		client.IsAdmin = true
+		client.log.Info("Client authenticated as admin with a certificate", "event", "auth", "client", s.cfg.sensitive(addr), "subject", tlsConn.ConnectionState().PeerCertificates[0].Subject.String())
+	}
+	s.clients[client.ID] = client
+	countClient(1)
+	s.hooksConnect(client)
+	s.joinRoom(client, defaultRoom)
+	client.Write(s.limits())
+	if motd := s.files.Motd.Text(); motd != "" {
+		client.Write(motd)
+	}
+	s.replayOnJoin(client)
+	msg.Conn.SetDeadline(time.Time{})
+	if s.cfg.ReadDeadline > 0 {
+		msg.Conn.SetReadDeadline(now.Add(s.cfg.ReadDeadline))
+	}
+	close(msg.Admitted)
+	return nil
+}
+
+// handleClientDisconnected forgets the client and gives its slot back
+func (s *Server) handleClientDisconnected(msg Message) {
+	addr := clientKey(msg.Conn)
+	if client := s.clients[msg.ConnID]; client != nil {
+		client.log.Info("Client disconnected", "event", "disconnect", "client", s.cfg.sensitive(addr), "name", clientDisplayName(client, s.cfg),
+			"duration", s.now().Sub(client.ConnectedAt).Round(time.Second).String(),
+			"bytes_read", client.BytesRead,
+			"bytes_written", client.BytesWritten,
+			"messages_sent", client.MessagesSent,
+			"messages_received", client.MessagesReceived)
+		if client.IsRelay {
+			client.log.Info("Relay disconnected", "event", "relay_disconnect", "client", s.cfg.sensitive(addr), "name", clientDisplayName(client, s.cfg))
+		}
+		s.hooksDisconnect(client)
+		s.leaveRoom(client)
+		s.forgetClient(client)
+		countClient(-1)
+	} else {
+		slog.Info("Client disconnected", "event", "disconnect", "conn", msg.ConnID, "client", s.cfg.sensitive(addr))
+	}
+	delete(s.clients, msg.ConnID)
+	s.connected.Add(-1)
+}
+
+// handleNewMessage runs a line of a client through the hooks, the limits
+// and filters included, then either runs the command or delivers the
+// message to the room
+func (s *Server) handleNewMessage(msg Message) error {
+	// nil when the connection is gone already, its own goroutine closed it
+	author := s.clients[msg.ConnID]
+	if author == nil {
+		return errUnknownClient
+	}
+	now := s.now()
+	if author.IsRelay {
+		s.relayInput(author, msg.Text, now)
+		return nil
+	}
+	author.BytesRead += len(msg.Text)
+	text, err := s.hooksMessage(author, msg.Text, now)
+	if err != nil {
+		s.reject(author, text, err, now)
+		return err
+	}
+
+	author.LastMessage = now
+	author.RateLimitStrikes = 0
+	if name, args, ok := parseCommand(text); ok {
+		s.command(author, name, args, now)
+		return nil
+	}
+	if muted := s.mutedFor(author, now); muted > 0 {
+		s.tell(author, "muted", CatalogData{Room: author.Room, Wait: muted})
+		return errMuted
+	}
+	if wait := s.slowedFor(author, now); wait > 0 {
+		// The room's own limit is no abuse of the server, it doesn't earn
+		// a strike
+		room := s.rooms[author.Room]
+		s.tell(author, "room_slow_mode", CatalogData{Room: room.Name, Duration: room.SlowMode, Wait: wait})
+		return errSlowMode
+	}
+
+	s.rooms[author.Room].LastMessage[author.ID] = now
+	author.log.Debug("Client sent a message", "event", "message", "client", s.cfg.sensitive(clientKey(author.Conn)), "bytes", len(text), "text", s.cfg.sensitiveContent(text))
+	author.MessagesSent += 1
+	escaped := sanitizeMessage(text)
+	render := renderer(Line{
+		Kind: ChatLine,
+		Room: author.Room,
+		Sender: clientDisplayName(author, s.cfg),
+		Text: escaped,
+		Seq: s.nextSeq(),
+	})
+	for _, client := range s.rooms[author.Room].Members {
+		if client != author && !client.Ignored[author.ID] {
+			s.deliver(client, render(client.Format))
+		}
+	}
+	s.stats.Relayed += 1
+	totalMessages.Add(1)
+	s.transcribe(author, escaped, now)
+	s.forward(author.Room, escaped)
+	if author.Echo {
+		author.Write(render(author.Format))
+	}
+	s.stats.Latency.Observe(time.Since(msg.ReceivedAt))
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pipeClient is the server side of a net.Pipe, with everything written to
+// it collected on the other side
+func pipeClient(t *testing.T) (net.Conn, *capturedLog) {
+	t.Helper()
+	conn, peer := net.Pipe()
+	received := &capturedLog{}
+	go io.Copy(received, peer)
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return conn, received
+}
+
+// waitForText polls, the copy from the pipe runs on a goroutine of its own
+func waitForText(t *testing.T, received *capturedLog, text string) {
+	t.Helper()
+	deadline := time.Now().Add(5*time.Second)
+	for !strings.Contains(received.String(), text) {
+		if time.Now().After(deadline) {
+			t.Fatalf("no %q, got %q", text, received.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// The handlers run without server(), called from the test goroutine
+func TestHandlersOnTheirOwn(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 14, 12, 0, 0, 0, time.UTC)}
+	s := NewServer(testConfig(), &Files{})
+	s.now = clock.Now
+	connect := func(id ConnID) (net.Conn, *capturedLog, error) {
+		conn, received := pipeClient(t)
+		s.connected.Add(1)
+		return conn, received, s.handleClientConnected(Message{Type: ClientConnected, Conn: conn, ConnID: id, Admitted: make(chan struct{})})
+	}
+	newMessage := func(id ConnID, text string) error {
+		return s.handleNewMessage(Message{Type: NewMessage, Text: text + "\n", ConnID: id, ReceivedAt: time.Now()})
+	}
+
+	aliceConn, _, err := connect(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobConn, bob, err := connect(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Second)
+	if err := newMessage(1, "hi"); err != nil {
+		t.Errorf("a fine message was turned down: %s", err)
+	}
+	waitForText(t, bob, "hi\n")
+	if err := newMessage(1, "again"); !errors.As(err, new(RateLimitViolation)) {
+		t.Errorf("got %v, want a RateLimitViolation", err)
+	}
+	clock.Advance(time.Minute)
+	if err := newMessage(1, garbage); !errors.As(err, new(BinaryViolation)) {
+		t.Errorf("got %v, want a BinaryViolation", err)
+	}
+
+	s.handleClientDisconnected(Message{Type: ClientDisconnected, Conn: bobConn, ConnID: 2})
+	if _, ok := s.clients[2]; ok {
+		t.Errorf("the client is still there after its disconnect")
+	}
+	if err := newMessage(2, "ghost"); !errors.Is(err, errUnknownClient) {
+		t.Errorf("got %v for a client that is gone", err)
+	}
+
+	s.ban(AutoStrikeLimit, "pipe", "test", clock.Now())
+	if _, _, err := connect(3); !errors.Is(err, errBanned) {
+		t.Errorf("got %v for a banned IP", err)
+	}
+	s.handleClientDisconnected(Message{Type: ClientDisconnected, Conn: aliceConn, ConnID: 1})
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tsoding/4at/transcript"
+)
+
+// RingBuffer keeps the last size broadcast messages of a room for the
+// history. It belongs to the server() goroutine. Since a delivered message
+// is at most maxMessageSize bytes, it never holds much more than
+// size*maxMessageSize bytes. The entries carry their timestamps for the
+// retention policies.
+type RingBuffer struct {
+	buf []transcript.Entry
+	size int
+	// Index of the oldest entry
+	head int
+	count int
+}
+
+func NewRingBuffer(size int) *RingBuffer {
+	return &RingBuffer{buf: make([]transcript.Entry, size), size: size}
+}
+
+// Push adds the entry in O(1), overwriting the oldest one when full
+func (r *RingBuffer) Push(entry transcript.Entry) {
+	if r.size == 0 {
+		return
+	}
+	r.buf[(r.head+r.count)%r.size] = entry
+	if r.count < r.size {
+		r.count += 1
+	} else {
+		r.head = (r.head + 1) % r.size
+	}
+}
+
+// Slice returns a copy of the entries oldest first
+func (r *RingBuffer) Slice() []transcript.Entry {
+	entries := make([]transcript.Entry, r.count)
+	for i := range entries {
+		entries[i] = r.buf[(r.head+i)%r.size]
+	}
+	return entries
+}
+
+func (r *RingBuffer) Len() int {
+	return r.count
+}
+
+// DropOldest forgets the oldest entry, if any
+func (r *RingBuffer) DropOldest() {
+	if r.count == 0 {
+		return
+	}
+	r.buf[r.head] = transcript.Entry{}
+	r.head = (r.head + 1) % r.size
+	r.count -= 1
+}
+
+// Resize changes the capacity to n, dropping the oldest entries that
+// don't fit anymore
+func (r *RingBuffer) Resize(n int) {
+	entries := r.Slice()
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	r.buf = make([]transcript.Entry, n)
+	copy(r.buf, entries)
+	r.size = n
+	r.head = 0
+	r.count = len(entries)
+}
+
+// Expire drops the entries older than before. The entries are pushed in
+// order, so those are always the oldest ones.
+func (r *RingBuffer) Expire(before time.Time) {
+	for r.count > 0 && r.buf[r.head].Time.Before(before) {
+		r.buf[r.head] = transcript.Entry{}
+		r.head = (r.head + 1) % r.size
+		r.count -= 1
+	}
+}
+
+// The room of the history entries meant for every room
+const allRooms = "*"
+
+// History is a RingBuffer of the last size messages of every room, so a
+// busy room doesn't push the history of a quiet one out. All the rooms
+// together hold at most limit entries, past that the rooms that were
+// active the longest ago lose their oldest entries first. That keeps the
+// memory under limit*maxMessageSize however many rooms come and go.
+type History struct {
+	rooms map[string]*roomRing
+	// Entries per room
+	size int
+	// Entries in all the rooms together, 0 for no limit
+	limit int
+	total int
+}
+
+type roomRing struct {
+	ring *RingBuffer
+	// When the last entry was pushed
+	active time.Time
+}
+
+func NewHistory(size int, limit int) *History {
+	return &History{
+		rooms: map[string]*roomRing{},
+		size: size,
+		limit: limit,
+	}
+}
+
+// Push adds the entry to the history of its room. Entries from before the
+// rooms belong to the default room, and the ones of allRooms show up in
+// every room.
+func (h *History) Push(entry transcript.Entry) {
+	if h.size == 0 {
+		return
+	}
+	name := entry.Room
+	if name == "" {
+		name = defaultRoom
+	}
+	room := h.rooms[name]
+	if room == nil {
+		room = &roomRing{ring: NewRingBuffer(h.size)}
+		h.rooms[name] = room
+	}
+	h.total -= room.ring.Len()
+	room.ring.Push(entry)
+	h.total += room.ring.Len()
+	room.active = entry.Time
+	h.evict()
+}
+
+// evict trims the least recently active rooms until the total fits
+func (h *History) evict() {
+	for h.limit > 0 && h.total > h.limit {
+		var oldest string
+		for name, room := range h.rooms {
+			if oldest == "" || room.active.Before(h.rooms[oldest].active) {
+				oldest = name
+			}
+		}
+		room := h.rooms[oldest]
+		room.ring.DropOldest()
+		h.total -= 1
+		if room.ring.Len() == 0 {
+			delete(h.rooms, oldest)
+		}
+	}
+}
+
+// Has tells whether the room has any history
+func (h *History) Has(name string) bool {
+	return h.rooms[name] != nil
+}
+
+// Room returns the entries of the room, allRooms ones included, oldest
+// first
+func (h *History) Room(name string) []transcript.Entry {
+	var entries []transcript.Entry
+	if room := h.rooms[name]; room != nil {
+		entries = room.ring.Slice()
+	}
+	if all := h.rooms[allRooms]; all != nil && name != allRooms {
+		entries = append(entries, all.ring.Slice()...)
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Time.Before(entries[j].Time)
+		})
+	}
+	return entries
+}
+
+// Slice returns the entries of all the rooms, oldest first
+func (h *History) Slice() []transcript.Entry {
+	var entries []transcript.Entry
+	for _, room := range h.rooms {
+		entries = append(entries, room.ring.Slice()...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	return entries
+}
+
+// Drop forgets the history of the room
+func (h *History) Drop(name string) {
+	if room := h.rooms[name]; room != nil {
+		h.total -= room.ring.Len()
+		delete(h.rooms, name)
+	}
+}
+
+// Resize changes the entries kept per room and in total, dropping the
+// oldest ones that don't fit anymore
+func (h *History) Resize(size int, limit int) {
+	h.size = size
+	h.limit = limit
+	h.total = 0
+	for name, room := range h.rooms {
+		if size == 0 {
+			delete(h.rooms, name)
+			continue
+		}
+		room.ring.Resize(size)
+		h.total += room.ring.Len()
+	}
+	h.evict()
+}
+
+// Expire drops the entries older than before from every room
+func (h *History) Expire(before time.Time) {
+	for name, room := range h.rooms {
+		h.total -= room.ring.Len()
+		room.ring.Expire(before)
+		h.total += room.ring.Len()
+		if room.ring.Len() == 0 {
+			delete(h.rooms, name)
+		}
+	}
+}
+
+// expireHistory drops the messages past RetentionDuration from the history
+func (s *Server) expireHistory(now time.Time) {
+	if s.cfg.RetentionDuration > 0 {
+		s.history.Expire(now.Add(-s.cfg.RetentionDuration))
+	}
+}
+
+// roomHistory returns the entries of the room from the history, oldest
+// first. The expired entries are left out even before expireHistory gets
+// to them.
+func (s *Server) roomHistory(room string) []transcript.Entry {
+	var entries []transcript.Entry
+	for _, entry := range s.history.Room(room) {
+		if s.cfg.RetentionDuration > 0 && s.now().Sub(entry.Time) > s.cfg.RetentionDuration {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// reseedHistory fills the history of a room that has none from the
+// database, so a room that went away with its last member gets its
+// history back when it comes again
+func (s *Server) reseedHistory(room string) {
+	if s.historyDB == nil || s.history.Has(room) {
+		return
+	}
+	entries, err := s.historyDB.RecentIn(room, s.cfg.HistorySize)
+	if err != nil {
+		slog.Error("Could not read the history database", "event", "history", "room", room, "err", err)
+		return
+	}
+	for _, entry := range entries {
+		s.history.Push(entry)
+	}
+}
+
+// replayOnJoin replays the history of the room the client just joined,
+// unless it asked not to with :nohistory
+func (s *Server) replayOnJoin(client *Client) {
+	ip := clientIP(client.Conn)
+	if entries := s.roomHistory(client.Room); len(entries) > 0 && !s.noHistory[ip] {
+		s.replay(client, entries)
+	}
+}
+
+// replay sends the entries to the client alone, bracketed so they can't be
+// mistaken for live traffic
+func (s *Server) replay(client *Client, entries []transcript.Entry) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s last %d messages %s\n", historyMarker, len(entries), historyMarker)
+	for _, entry := range entries {
+		fmt.Fprintf(&sb, "[%s] %s", entry.Time.Format("15:04:05"), entry.Text)
+		if !strings.HasSuffix(entry.Text, "\n") {
+			sb.WriteString("\n")
+		}
+	}
+	fmt.Fprintf(&sb, "%s end of history %s\n", historyMarker, historyMarker)
+	client.Write(sb.String())
+}
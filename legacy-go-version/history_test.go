@@ -0,0 +1,293 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tsoding/4at/transcript"
+)
+
+// entries makes the entries "0", "1"... a second apart
+func entries(n int) []transcript.Entry {
+	start := time.Date(2024, 1, 14, 12, 0, 0, 0, time.UTC)
+	var list []transcript.Entry
+	for i := 0; i < n; i++ {
+		list = append(list, transcript.Entry{Time: start.Add(time.Duration(i)*time.Second), Text: strconv.Itoa(i)})
+	}
+	return list
+}
+
+func texts(list []transcript.Entry) []string {
+	result := []string{}
+	for _, entry := range list {
+		result = append(result, entry.Text)
+	}
+	return result
+}
+
+func TestRingBufferEmpty(t *testing.T) {
+	for _, size := range []int{0, 3} {
+		r := NewRingBuffer(size)
+		if got := r.Slice(); len(got) != 0 || r.Len() != 0 {
+			t.Errorf("an empty buffer of %d has %q", size, texts(got))
+		}
+		r.DropOldest()
+		r.Expire(time.Now())
+		if r.Len() != 0 {
+			t.Errorf("an empty buffer of %d grew to %d", size, r.Len())
+		}
+	}
+	r := NewRingBuffer(0)
+	r.Push(entries(1)[0])
+	if r.Len() != 0 {
+		t.Errorf("a buffer of 0 kept an entry")
+	}
+}
+
+func TestRingBufferSliceOrder(t *testing.T) {
+	r := NewRingBuffer(5)
+	for _, entry := range entries(3) {
+		r.Push(entry)
+	}
+	if got, want := texts(r.Slice()), []string{"0", "1", "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRingBufferWraparound(t *testing.T) {
+	r := NewRingBuffer(3)
+	for i, entry := range entries(8) {
+		r.Push(entry)
+		want := texts(entries(i + 1))
+		if len(want) > 3 {
+			want = want[len(want)-3:]
+		}
+		if got := texts(r.Slice()); !reflect.DeepEqual(got, want) {
+			t.Fatalf("after pushing %d entries got %q, want %q", i+1, got, want)
+		}
+	}
+}
+
+func TestRingBufferSliceIsACopy(t *testing.T) {
+	r := NewRingBuffer(2)
+	r.Push(entries(1)[0])
+	r.Slice()[0].Text = "changed"
+	if r.Slice()[0].Text != "0" {
+		t.Errorf("changing the slice changed the buffer")
+	}
+}
+
+func TestRingBufferResize(t *testing.T) {
+	r := NewRingBuffer(4)
+	// Wrapped around, so the oldest entry isn't at the start of buf
+	for _, entry := range entries(6) {
+		r.Push(entry)
+	}
+	r.Resize(2)
+	if got, want := texts(r.Slice()), []string{"4", "5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("shrunk to %q, want %q", got, want)
+	}
+	r.Resize(3)
+	r.Push(entries(7)[6])
+	if got, want := texts(r.Slice()), []string{"4", "5", "6"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("grown to %q, want %q", got, want)
+	}
+}
+
+func TestRingBufferExpire(t *testing.T) {
+	r := NewRingBuffer(3)
+	list := entries(5)
+	for _, entry := range list {
+		r.Push(entry)
+	}
+	r.Expire(list[3].Time)
+	if got, want := texts(r.Slice()), []string{"3", "4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// linesAfter are the lines of the client from the one containing the
+// marker on
+func linesAfter(c *ScriptedClient, marker string) []string {
+	lines := c.Received()
+	for i, line := range lines {
+		if strings.Contains(line, marker) {
+			return lines[i:]
+		}
+	}
+	return nil
+}
+
+func TestReplayOnJoin(t *testing.T) {
+	cfg := testConfig()
+	cfg.HistorySize = 3
+	files := &Files{}
+	if err := files.Wordlist.Load(writeFile(t, "wordlist.txt", "spam\n")); err != nil {
+		t.Fatal(err)
+	}
+	ts := startServer(t, cfg, files)
+	alice := ts.connect("10.0.0.1:1001")
+	for _, text := range []string{"zero", "one", "two", "buy spam", "three"} {
+		alice.Play(ScriptStep{After: time.Second, Line: text})
+	}
+
+	bob := ts.connect("10.0.0.2:1002")
+	replay := linesAfter(bob, "--- last 3 messages ---")
+	if len(replay) != 5 || !strings.HasSuffix(replay[1], "one") || !strings.HasSuffix(replay[2], "two") || !strings.HasSuffix(replay[3], "three") || replay[4] != "--- end of history ---" {
+		t.Errorf("want the last 3 messages in order, without the blocked one, got %q", bob.Received())
+	}
+	if !strings.HasPrefix(replay[1], "[12:00:02]") {
+		t.Errorf("the replay has no timestamps: %q", replay)
+	}
+
+	carol := ts.connect("10.0.0.3:1003")
+	carol.Play(ScriptStep{After: time.Second, Line: ":nohistory"})
+	carol.Close()
+	if again := ts.connect("10.0.0.3:1004"); again.Got("--- last") {
+		t.Errorf("replayed after :nohistory, got %q", again.Received())
+	}
+}
+
+func TestHistoryCommandDoesNotDisturbTheOthers(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+	carol := ts.connect("10.0.0.3:1003")
+
+	alice.Play(
+		ScriptStep{After: time.Second, Line: "first"},
+		ScriptStep{After: time.Second, Line: "second"},
+	)
+	bob.Forget()
+	bob.Play(ScriptStep{After: time.Second, Line: ":history 5"})
+	alice.Play(ScriptStep{After: time.Second, Line: "third"})
+
+	// Bob gets the history, bracketed, then the live traffic
+	lines := bob.Received()
+	want := []string{"Only 2 messages in the history", "--- last 2 messages ---", "first", "second", "--- end of history ---", "third"}
+	if len(lines) != len(want) {
+		t.Fatalf("got %q", lines)
+	}
+	for i := range want {
+		if !strings.HasSuffix(lines[i], want[i]) {
+			t.Errorf("line %d is %q, want %q", i, lines[i], want[i])
+		}
+	}
+
+	// Nobody else sees it
+	var live []string
+	for _, line := range carol.Received() {
+		if strings.Contains(line, "--- ") {
+			t.Errorf("carol got the history of bob: %q", line)
+		}
+		for _, text := range []string{"first", "second", "third"} {
+			if strings.HasSuffix(line, text) {
+				live = append(live, text)
+			}
+		}
+	}
+	if strings.Join(live, " ") != "first second third" {
+		t.Errorf("carol got %q", live)
+	}
+
+	bob.Forget()
+	bob.Play(ScriptStep{After: time.Second, Line: ":history"})
+	if !bob.Got("You can ask for the history again in") || bob.Got("--- last") {
+		t.Errorf(":history isn't rate limited, got %q", bob.Received())
+	}
+}
+
+func TestRetentionLeavesOldMessagesOutOfTheReplay(t *testing.T) {
+	cfg := testConfig()
+	cfg.RetentionDuration = time.Second
+	ts := startServer(t, cfg, nil)
+	alice := ts.connect("10.0.0.1:1001")
+	alice.Play(
+		ScriptStep{After: time.Second, Line: "stale"},
+		ScriptStep{After: 2*time.Second, Line: "fresh"},
+	)
+
+	bob := ts.connect("10.0.0.2:1002")
+	if !bob.Got("fresh") || bob.Got("stale") {
+		t.Errorf("want only the message of the last second, got %q", bob.Received())
+	}
+
+	ts.clock.Advance(2*time.Second)
+	if carol := ts.connect("10.0.0.3:1003"); carol.Got("fresh") {
+		t.Errorf("replayed an expired message, got %q", carol.Received())
+	}
+}
+
+func TestReplayIsRoomScoped(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+	// Someone stays in each room so it isn't garbage collected
+	ts.connect("10.0.0.3:1003").Play(ScriptStep{After: time.Second, Line: ":join #golang"})
+	ts.connect("10.0.0.4:1004").Play(ScriptStep{After: time.Second, Line: ":join #rust"})
+	alice.Play(
+		ScriptStep{After: time.Second, Line: ":join #golang"},
+		ScriptStep{After: time.Second, Line: "gophers"},
+	)
+	bob.Play(
+		ScriptStep{After: time.Second, Line: ":join #rust"},
+		ScriptStep{After: time.Second, Line: "crabs"},
+	)
+
+	carol := ts.connect("10.0.0.5:1005")
+	carol.Play(ScriptStep{After: time.Second, Line: ":join #golang"})
+	if !carol.Got("gophers") || carol.Got("crabs") {
+		t.Errorf("the replay of #golang isn't its own, got %q", carol.Received())
+	}
+	carol.Forget()
+	carol.Play(ScriptStep{After: time.Second, Line: ":join #rust"})
+	if !carol.Got("crabs") || carol.Got("gophers") {
+		t.Errorf("the replay of #rust isn't its own, got %q", carol.Received())
+	}
+	carol.Forget()
+	carol.Play(ScriptStep{After: time.Minute, Line: ":history"})
+	if !carol.Got("crabs") || carol.Got("gophers") {
+		t.Errorf(":history isn't room scoped, got %q", carol.Received())
+	}
+
+	// A room that went away takes its history along without the database
+	dave := ts.connect("10.0.0.6:1006")
+	dave.Play(
+		ScriptStep{After: time.Second, Line: ":join #zig"},
+		ScriptStep{After: time.Second, Line: "ziguanas"},
+		ScriptStep{After: time.Second, Line: ":part #zig"},
+	)
+	erin := ts.connect("10.0.0.7:1007")
+	erin.Play(ScriptStep{After: time.Second, Line: ":join #zig"})
+	if erin.Got("ziguanas") {
+		t.Errorf("the history outlived its room, got %q", erin.Received())
+	}
+}
+
+func TestHistoryLimitEvictsTheQuietRoomsFirst(t *testing.T) {
+	h := NewHistory(3, 4)
+	list := entries(6)
+	for i, room := range []string{"#a", "#a", "#b", "#b", "#c"} {
+		list[i].Room = room
+		h.Push(list[i])
+	}
+	// #a was active the longest ago
+	if got := texts(h.Room("#a")); !reflect.DeepEqual(got, []string{"1"}) {
+		t.Errorf("#a kept %q", got)
+	}
+
+	list[5].Room = "#c"
+	h.Push(list[5])
+	if h.Has("#a") {
+		t.Errorf("#a still has a history: %q", texts(h.Room("#a")))
+	}
+	if got := texts(h.Room("#b")); !reflect.DeepEqual(got, []string{"2", "3"}) {
+		t.Errorf("a more active room lost entries, #b kept %q", got)
+	}
+	if got := texts(h.Slice()); len(got) != 4 {
+		t.Errorf("the history holds %q, more than the limit", got)
+	}
+}
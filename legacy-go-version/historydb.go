@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsoding/4at/transcript"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// Inserts are batched into one transaction per this many messages...
+	historyDBBatch = 100
+	// ...or per this much time, whatever comes first
+	historyDBFlushEvery = time.Second
+	// How many messages may wait for the writer before new ones are dropped
+	historyDBQueue = 1024
+)
+
+// HistoryDB persists the broadcast messages to SQLite. The inserts are
+// queued for a writer goroutine so the server loop never waits on the disk.
+type HistoryDB struct {
+	path string
+	db *sql.DB
+	queue chan transcript.Entry
+	done sync.WaitGroup
+}
+
+func OpenHistoryDB(path string) (*HistoryDB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite has one writer anyway, a single connection keeps the searches
+	// from failing with SQLITE_BUSY while a batch is being inserted
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS messages (
+		rowid INTEGER PRIMARY KEY,
+		ts INTEGER NOT NULL,
+		id TEXT NOT NULL,
+		sender TEXT NOT NULL,
+		text TEXT NOT NULL,
+		room TEXT NOT NULL DEFAULT '#general'
+	)`)
+	if err == nil {
+		err = migrateHistoryDB(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	h := &HistoryDB{
+		path: path,
+		db: db,
+		queue: make(chan transcript.Entry, historyDBQueue),
+	}
+	h.done.Add(1)
+	go h.write()
+	return h, nil
+}
+
+// migrateHistoryDB brings a database from an older version up to date.
+// The messages from before the rooms all went to the default room.
+func migrateHistoryDB(db *sql.DB) error {
+	if _, err := db.Exec("SELECT room FROM messages LIMIT 0"); err == nil {
+		return nil
+	}
+	_, err := db.Exec("ALTER TABLE messages ADD COLUMN room TEXT NOT NULL DEFAULT '#general'")
+	return err
+}
+
+// Insert queues the entry without blocking. When the writer can't keep up
+// the entry is dropped rather than stalling the chat.
+func (h *HistoryDB) Insert(entry transcript.Entry) {
+	select {
+	case h.queue <- entry:
+	default:
+		slog.Warn("History database is behind, dropping a message", "event", "history_db", "path", h.path)
+	}
+}
+
+func (h *HistoryDB) write() {
+	defer h.done.Done()
+	ticker := time.NewTicker(historyDBFlushEvery)
+	defer ticker.Stop()
+	var batch []transcript.Entry
+	for {
+		select {
+		case entry, ok := <-h.queue:
+			if !ok {
+				h.flush(batch)
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) < historyDBBatch {
+				continue
+			}
+		case <-ticker.C:
+		}
+		h.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+func (h *HistoryDB) flush(batch []transcript.Entry) {
+	if len(batch) == 0 {
+		return
+	}
+	err := h.insert(batch)
+	if err != nil {
+		slog.Error("Could not write to the history database", "event", "history_db", "path", h.path, "messages", len(batch), "err", err)
+	}
+}
+
+func (h *HistoryDB) insert(batch []transcript.Entry) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("INSERT INTO messages (ts, id, sender, text, room) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, entry := range batch {
+		if _, err := stmt.Exec(entry.Time.UnixNano(), entry.ID, entry.Sender, entry.Text, entry.Room); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Search returns the last limit messages of the room containing all of the
+// terms, oldest first
+func (h *HistoryDB) Search(room string, terms []string, limit int) ([]transcript.Entry, error) {
+	where := []string{"room = ?"}
+	args := []any{room}
+	for _, term := range terms {
+		where = append(where, `text LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(term)+"%")
+	}
+	query := "SELECT ts, id, sender, text, room FROM messages WHERE " + strings.Join(where, " AND ")
+	return h.query(query+" ORDER BY rowid DESC LIMIT ?", append(args, limit)...)
+}
+
+// Since returns the messages sent at or after t, oldest first
+func (h *HistoryDB) Since(t time.Time) ([]transcript.Entry, error) {
+	return h.query("SELECT ts, id, sender, text, room FROM messages WHERE ts >= ? ORDER BY rowid DESC", t.UnixNano())
+}
+
+// RecentIn returns the last n messages of the room, oldest first. The
+// messages from before the rooms belong to the default room.
+func (h *HistoryDB) RecentIn(room string, n int) ([]transcript.Entry, error) {
+	if room == defaultRoom {
+		return h.query("SELECT ts, id, sender, text, room FROM messages WHERE room = ? OR room = '' ORDER BY rowid DESC LIMIT ?", room, n)
+	}
+	return h.query("SELECT ts, id, sender, text, room FROM messages WHERE room = ? ORDER BY rowid DESC LIMIT ?", room, n)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (h *HistoryDB) query(query string, args ...any) ([]transcript.Entry, error) {
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []transcript.Entry
+	for rows.Next() {
+		var entry transcript.Entry
+		var ts int64
+		if err := rows.Scan(&ts, &entry.ID, &entry.Sender, &entry.Text, &entry.Room); err != nil {
+			return nil, err
+		}
+		entry.Time = time.Unix(0, ts)
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// The queries go newest first to make LIMIT keep the latest ones
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// Close writes out the queued messages and closes the database
+func (h *HistoryDB) Close() error {
+	close(h.queue)
+	h.done.Wait()
+	return h.db.Close()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tsoding/4at/transcript"
+)
+
+func TestHistoryDBBatchesEveryMessage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	h, err := OpenHistoryDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two full batches and a partial one that only Close writes out
+	n := 2*historyDBBatch + 5
+	start := time.Date(2024, 1, 14, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		h.Insert(transcript.Entry{Time: start.Add(time.Duration(i)*time.Second), ID: fmt.Sprint(i), Sender: "alice", Room: defaultRoom, Text: fmt.Sprintf("message %d", i)})
+	}
+
+	// The full batches go without waiting for the flush interval
+	deadline := time.Now().Add(historyDBFlushEvery / 2)
+	var count int
+	for time.Now().Before(deadline) {
+		if err := h.db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count >= 2*historyDBBatch {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if count < 2*historyDBBatch {
+		t.Errorf("%d messages written before the flush interval, want the full batches", count)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = OpenHistoryDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	got, err := h.RecentIn(defaultRoom, n+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != n || got[0].Text != "message 0" || got[n-1].Text != fmt.Sprintf("message %d", n-1) || !got[1].Time.Equal(start.Add(time.Second)) {
+		t.Errorf("got %d messages back, from %+v to %+v", len(got), got[0], got[len(got)-1])
+	}
+}
+
+func TestHistoryDBSearch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	h, err := OpenHistoryDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, entry := range []transcript.Entry{
+		{Room: defaultRoom, Text: "the build is green"},
+		{Room: defaultRoom, Text: "the build is red"},
+		{Room: "#rust", Text: "the build is green in rust"},
+		{Room: defaultRoom, Text: "100% green"},
+		{Room: defaultRoom, Text: "snake_case and the build is green again"},
+	} {
+		entry.ID = fmt.Sprint(i)
+		h.Insert(entry)
+	}
+	// Written out for sure
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h, err = OpenHistoryDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for _, tc := range []struct {
+		terms []string
+		limit int
+		want []string
+	}{
+		{[]string{"build", "green"}, 10, []string{"the build is green", "snake_case and the build is green again"}},
+		{[]string{"build", "green"}, 1, []string{"snake_case and the build is green again"}},
+		{[]string{"%"}, 10, []string{"100% green"}},
+		{[]string{"e_c"}, 10, []string{"snake_case and the build is green again"}},
+		{[]string{"blue"}, 10, nil},
+	} {
+		entries, err := h.Search(defaultRoom, tc.terms, tc.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, entry := range entries {
+			got = append(got, entry.Text)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%q: got %q, want %q", tc.terms, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+)
+
+// Hook looks at what the clients do from inside server(), so it must not
+// block. The hooks run in the order they were added, the built-in rules of
+// the server first, see builtinHooks. Embed BaseHook to only implement
+// what's needed.
+type Hook interface {
+	// For the log
+	Name() string
+	// Once the client is set up, before it gets anything
+	OnConnect(client *Client)
+	// For every line of a client but the relays, commands included,
+	// before it goes anywhere
+	OnMessage(ctx *MsgCtx) Verdict
+	// Before the client is forgotten
+	OnDisconnect(client *Client)
+}
+
+// MsgCtx is the message a Hook is asked about
+type MsgCtx struct {
+	Server *Server
+	Author *Client
+	// As rewritten by the hooks before
+	Text string
+	Now time.Time
+}
+
+// Verdict is what a Hook decides about a message. The zero Verdict lets it
+// through as it is.
+type Verdict struct {
+	// Replaces the text for the following hooks and the rest of the
+	// server, when not empty. It isn't checked by the hooks before.
+	Rewrite string
+	// Stops the message, the following hooks don't see it. reject decides
+	// what the author is told and whether it's a strike, NoticeViolation
+	// and StrikeViolation are for the hooks with rules of their own.
+	Reject error
+}
+
+// BaseHook does nothing, for embedding in a Hook
+type BaseHook struct{}
+
+func (BaseHook) OnConnect(client *Client) {}
+
+func (BaseHook) OnMessage(ctx *MsgCtx) Verdict {
+	return Verdict{}
+}
+
+func (BaseHook) OnDisconnect(client *Client) {}
+
+// More panics than this within panicWindow get a hook disabled
+const maxHookPanics = 3
+
+type registeredHook struct {
+	hook Hook
+	panics PanicCounter
+	disabled bool
+}
+
+// AddHook puts the hook behind the ones already there. Like the rest of
+// Server, only before server() runs or from inside it.
+func (s *Server) AddHook(hook Hook) {
+	s.hooks = append(s.hooks, &registeredHook{hook: hook})
+}
+
+// callHook runs one hook, a panic in it is logged and taken for a Verdict
+// letting the message through. A hook that keeps panicking is disabled for
+// the rest of the run.
+func (s *Server) callHook(h *registeredHook, client *Client, call func() Verdict) (verdict Verdict) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Hook panic", "event", "hook_panic", "hook", h.hook.Name(), "client", client.CorrelationID, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			s.stats.Panics += 1
+			totalPanics.Add(1)
+			h.panics.Add(time.Now())
+			if h.panics.Exceeded(maxHookPanics) {
+				slog.Error("Hook keeps panicking, disabling it", "event", "hook_disabled", "hook", h.hook.Name())
+				h.disabled = true
+			}
+			verdict = Verdict{}
+		}
+	}()
+	return call()
+}
+
+func (s *Server) hooksConnect(client *Client) {
+	for _, h := range s.hooks {
+		if !h.disabled {
+			s.callHook(h, client, func() Verdict {
+				h.hook.OnConnect(client)
+				return Verdict{}
+			})
+		}
+	}
+}
+
+func (s *Server) hooksDisconnect(client *Client) {
+	for _, h := range s.hooks {
+		if !h.disabled {
+			s.callHook(h, client, func() Verdict {
+				h.hook.OnDisconnect(client)
+				return Verdict{}
+			})
+		}
+	}
+}
+
+// hooksMessage runs the message through the hooks, returning its text as
+// rewritten by them or why the first one to reject it did
+func (s *Server) hooksMessage(author *Client, text string, now time.Time) (string, error) {
+	ctx := &MsgCtx{Server: s, Author: author, Text: text, Now: now}
+	for _, h := range s.hooks {
+		if h.disabled {
+			continue
+		}
+		verdict := s.callHook(h, author, func() Verdict {
+			return h.hook.OnMessage(ctx)
+		})
+		if verdict.Reject != nil {
+			return ctx.Text, verdict.Reject
+		}
+		if verdict.Rewrite != "" {
+			ctx.Text = verdict.Rewrite
+		}
+	}
+	return ctx.Text, nil
+}
+
+// messageHook is a Hook of a single OnMessage function
+type messageHook struct {
+	BaseHook
+	name string
+	check func(ctx *MsgCtx) Verdict
+}
+
+func (h messageHook) Name() string {
+	return h.name
+}
+
+func (h messageHook) OnMessage(ctx *MsgCtx) Verdict {
+	return h.check(ctx)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingHook notes the texts it's asked about in the shared calls
+type recordingHook struct {
+	BaseHook
+	name string
+	calls *[]string
+	verdict func(ctx *MsgCtx) Verdict
+}
+
+func (h recordingHook) Name() string {
+	return h.name
+}
+
+func (h recordingHook) OnMessage(ctx *MsgCtx) Verdict {
+	*h.calls = append(*h.calls, h.name+": "+ctx.Text)
+	return h.verdict(ctx)
+}
+
+// threeHooks are an upper-caser, a rule against "stop" and a hook that
+// only watches, in that order
+func threeHooks(s *Server) *[]string {
+	calls := &[]string{}
+	s.AddHook(recordingHook{name: "upper", calls: calls, verdict: func(ctx *MsgCtx) Verdict {
+		return Verdict{Rewrite: strings.ToUpper(ctx.Text)}
+	}})
+	s.AddHook(recordingHook{name: "stop", calls: calls, verdict: func(ctx *MsgCtx) Verdict {
+		if strings.Contains(ctx.Text, "STOP") {
+			return Verdict{Reject: NoticeViolation{Notice: "No stopping here"}}
+		}
+		return Verdict{}
+	}})
+	s.AddHook(recordingHook{name: "watch", calls: calls, verdict: func(ctx *MsgCtx) Verdict {
+		return Verdict{}
+	}})
+	return calls
+}
+
+func TestHooksRunInOrderWithTheRewrites(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	calls := threeHooks(ts.s)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+
+	alice.Play(ScriptStep{After: time.Second, Line: "hello"})
+
+	want := []string{"upper: hello\n", "stop: HELLO\n", "watch: HELLO\n"}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("got the calls %q, want %q", *calls, want)
+	}
+	if !bob.Got("HELLO") {
+		t.Errorf("the rewritten message wasn't broadcast, got %q", bob.Received())
+	}
+}
+
+func TestHookRejectionShortCircuits(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	calls := threeHooks(ts.s)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+
+	alice.Play(ScriptStep{After: time.Second, Line: "please stop"})
+
+	want := []string{"upper: please stop\n", "stop: PLEASE STOP\n"}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("got the calls %q, want %q", *calls, want)
+	}
+	if !alice.Got("No stopping here") {
+		t.Errorf("the author wasn't told, got %q", alice.Received())
+	}
+	if bob.Got("STOP") {
+		t.Errorf("the rejected message was broadcast")
+	}
+}
+
+func TestPanickingHookGetsDisabled(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	calls := &[]string{}
+	ts.s.AddHook(recordingHook{name: "broken", calls: calls, verdict: func(ctx *MsgCtx) Verdict {
+		panic("broken hook")
+	}})
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+
+	for i := 0; i < maxHookPanics+2; i++ {
+		alice.Play(ScriptStep{After: time.Second, Line: "hello"})
+	}
+
+	if len(*calls) != maxHookPanics+1 {
+		t.Errorf("the hook was called %d times, want %d", len(*calls), maxHookPanics+1)
+	}
+	if got := strings.Count(bob.Conn.Written(), "hello"); got != maxHookPanics+2 {
+		t.Errorf("%d messages got through the panicking hook, want %d", got, maxHookPanics+2)
+	}
+}
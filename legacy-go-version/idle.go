@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// idleCheckInterval is how often server() looks for idle clients, a tenth
+// of the timeout but not more often than once a minute
+func idleCheckInterval(timeout time.Duration) time.Duration {
+	return max(time.Minute, timeout/10)
+}
+
+// disconnectIdle drops the clients which haven't sent anything for longer
+// than IdleTimeout. It reads the timeout on every call, so a reloaded one
+// applies to the existing connections as well.
+func (s *Server) disconnectIdle(now time.Time) {
+	if s.cfg.IdleTimeout <= 0 {
+		return
+	}
+	for _, client := range s.clients {
+		// A relay is quiet while the clients of its server are
+		if client.IsRelay {
+			continue
+		}
+		if now.Sub(client.LastMessage) > s.cfg.IdleTimeout {
+			client.log.Info("Client is idle for too long", "event", "idle", "client", s.cfg.sensitive(clientKey(client.Conn)), "idle", now.Sub(client.LastMessage).Round(time.Second).String())
+			client.Send(s.notice("idle_disconnect", CatalogData{Duration: s.cfg.IdleTimeout}))
+			hangUp(client.Conn, ByeIdle, 0)
+		}
+	}
+}
+
+// humanDuration spells whole minutes out, "30 minutes" reads better than
+// "30m0s"
+func humanDuration(d time.Duration) string {
+	if d >= time.Minute && d%time.Minute == 0 {
+		return fmt.Sprintf("%d minutes", d/time.Minute)
+	}
+	return d.String()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tsoding/4at/testutil"
+)
+
+// The idle check runs on a ticker of at least a minute, so these drive
+// server()'s handlers from the test goroutine instead, on a fake clock
+func connectIdleTest(t *testing.T, s *Server, addr string, id ConnID) *testutil.FakeConn {
+	t.Helper()
+	conn := testutil.NewFakeConn(addr)
+	s.connected.Add(1)
+	s.processMessage(context.Background(), Message{Type: ClientConnected, Conn: conn, ConnID: id, Admitted: make(chan struct{})})
+	return conn
+}
+
+func TestIdleClientsAreDisconnected(t *testing.T) {
+	cfg := testConfig()
+	cfg.IdleTimeout = time.Second
+	clock := &fakeClock{now: time.Date(2024, 1, 14, 12, 0, 0, 0, time.UTC)}
+	s := NewServer(cfg, &Files{})
+	s.now = clock.Now
+	idle := connectIdleTest(t, s, "10.0.0.1:1001", 1)
+	active := connectIdleTest(t, s, "10.0.0.2:1002", 2)
+
+	clock.Advance(1500*time.Millisecond)
+	s.processMessage(context.Background(), Message{Type: NewMessage, Text: "still here\n", Conn: active, ConnID: 2, ReceivedAt: clock.Now()})
+	clock.Advance(time.Second / 2)
+	s.disconnectIdle(clock.Now())
+
+	if !idle.IsClosed() || !strings.Contains(idle.Written(), "Disconnecting due to inactivity for more than 1s") {
+		t.Errorf("the idle client is still connected, got %q", idle.Written())
+	}
+	if active.IsClosed() {
+		t.Errorf("the active client was disconnected, got %q", active.Written())
+	}
+
+	// A reloaded timeout applies to the connections already there
+	next := cfg
+	next.IdleTimeout = time.Minute
+	s.processMessage(context.Background(), Message{Type: ConfigReloaded, Config: &next, Actor: "test"})
+	clock.Advance(2*time.Second)
+	s.disconnectIdle(clock.Now())
+	if active.IsClosed() {
+		t.Errorf("the old timeout still applies")
+	}
+	clock.Advance(time.Minute)
+	s.disconnectIdle(clock.Now())
+	if !active.IsClosed() {
+		t.Errorf("the new timeout doesn't apply")
+	}
+}
+
+func TestIdleCheckInterval(t *testing.T) {
+	for timeout, want := range map[time.Duration]time.Duration{
+		time.Second: time.Minute,
+		30*time.Minute: 3*time.Minute,
+		0: time.Minute,
+	} {
+		if got := idleCheckInterval(timeout); got != want {
+			t.Errorf("%s: got %s, want %s", timeout, got, want)
+		}
+	}
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tsoding/4at/bot"
+	// Not to clash with the client() of the server
+	chatclient "github.com/tsoding/4at/client"
+)
+
+// The integration tests go through real sockets, the accept loop and the
+// client goroutines included, on the real clock. Every wait is bounded by
+// this, generous so a loaded CI machine doesn't fail them.
+const integrationTimeout = 5*time.Second
+
+// integrationConfig lets the tests send as fast as they like, the rate
+// limit is covered by the tests on a fake clock
+func integrationConfig() Config {
+	cfg := testConfig()
+	cfg.MessageRate = 0
+	cfg.ConnRate = 1000
+	cfg.ConnBurst = 100
+	cfg.FairQueue = 1000
+	return cfg
+}
+
+// startTCPServer runs the whole server on an ephemeral port of localhost
+// for the length of the test and returns its address
+func startTCPServer(t *testing.T, cfg Config) string {
+	t.Helper()
+	return startServerOn(t, cfg, listenLocal(t))
+}
+
+func listenLocal(t *testing.T) net.Listener {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("integration test")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
+
+// startServerOn is startTCPServer on a listener of the test's own, like a
+// TLS one
+func startServerOn(t *testing.T, cfg Config, ln net.Listener) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewServer(cfg, &Files{})
+	messages := make(chan Message)
+	served := make(chan struct{})
+	accepted := make(chan struct{})
+	go func() {
+		server(ctx, s, messages)
+		close(served)
+	}()
+	go func() {
+		accept(ctx, cfg, &s.files.Catalog, ln, s.connected, messages)
+		close(accepted)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-accepted
+		<-served
+	})
+	return ln.Addr().String()
+}
+
+// tcpClient is the peer side of a real connection
+type tcpClient struct {
+	t *testing.T
+	conn net.Conn
+	reader *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *tcpClient {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, integrationTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return &tcpClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// dialJoined dials and waits for the greeting, so the client is sure to
+// be in the room
+func dialJoined(t *testing.T, addr string) *tcpClient {
+	t.Helper()
+	c := dial(t, addr)
+	c.waitFor(limitsPrefix)
+	return c
+}
+
+func (c *tcpClient) send(line string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// readLine fails the test unless a line comes within integrationTimeout,
+// io.EOF and the other errors of the connection are returned
+func (c *tcpClient) readLine() (string, error) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(integrationTimeout))
+	line, err := c.reader.ReadString('\n')
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.t.Fatalf("nothing came within %s", integrationTimeout)
+	}
+	return strings.TrimSuffix(line, "\n"), err
+}
+
+// waitFor reads until a line containing the text and returns the lines
+// before it
+func (c *tcpClient) waitFor(text string) []string {
+	c.t.Helper()
+	var before []string
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			c.t.Fatalf("connection ended waiting for %q after %q: %s", text, before, err)
+		}
+		if strings.Contains(line, text) {
+			return before
+		}
+		before = append(before, line)
+	}
+}
+
+// readAll reads until the server hangs up
+func (c *tcpClient) readAll() []string {
+	c.t.Helper()
+	var lines []string
+	for {
+		line, err := c.readLine()
+		if line != "" {
+			lines = append(lines, line)
+		}
+		if err != nil {
+			return lines
+		}
+	}
+}
+
+func TestIntegrationFanOut(t *testing.T) {
+	addr := startTCPServer(t, integrationConfig())
+	var listeners []*tcpClient
+	for i := 0; i < 10; i++ {
+		listeners = append(listeners, dialJoined(t, addr))
+	}
+
+	// Right after dialing, the ClientConnected has to win over the first
+	// NewMessage
+	sender := dial(t, addr)
+	sender.send("hello everybody")
+
+	for i, listener := range listeners {
+		before := listener.waitFor("hello everybody")
+		for _, line := range before {
+			if strings.Contains(line, "hello everybody") {
+				t.Errorf("listener %d got the message twice", i)
+			}
+		}
+	}
+}
+
+func TestIntegrationDisconnectMidBroadcast(t *testing.T) {
+	addr := startTCPServer(t, integrationConfig())
+	sender := dialJoined(t, addr)
+	leaver := dialJoined(t, addr)
+	stayer := dialJoined(t, addr)
+
+	for i := 0; i < 50; i++ {
+		sender.send(fmt.Sprintf("message %d", i))
+		if i == 10 {
+			leaver.conn.Close()
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		stayer.waitFor(fmt.Sprintf("message %d", i))
+	}
+	// The server is still up for the newcomers
+	dialJoined(t, addr)
+}
+
+func TestIntegrationBanArrivesBeforeTheHangup(t *testing.T) {
+	cfg := integrationConfig()
+	cfg.StrikeLimit = 3
+	addr := startTCPServer(t, cfg)
+	flooder := dialJoined(t, addr)
+
+	for i := 0; i < cfg.StrikeLimit; i++ {
+		flooder.send(garbage)
+	}
+
+	lines := flooder.readAll()
+	ban, bye := -1, -1
+	for i, line := range lines {
+		if strings.Contains(line, "You are banned MF") {
+			ban = i
+		}
+		if strings.HasPrefix(line, byePrefix+string(ByeBanned)) {
+			bye = i
+		}
+	}
+	if ban < 0 || bye < 0 || ban > bye || bye != len(lines)-1 {
+		t.Errorf("want the ban notice, then the BYE as the last line, got %q", lines)
+	}
+
+	// All the test clients share 127.0.0.1
+	again := dial(t, addr)
+	lines = again.readAll()
+	if len(lines) != 2 || !strings.Contains(lines[0], "You are banned MF:") || !strings.HasPrefix(lines[1], byePrefix+string(ByeBanned)) {
+		t.Errorf("want the ban countdown and the BYE for the banned IP, got %q", lines)
+	}
+}
+
+// verboseSeq parses the sequence number and the text out of a message in
+// the verbose format, "[msg #general 42] <sender> text"
+func verboseSeq(line string) (uint64, string, bool) {
+	rest, ok := strings.CutPrefix(line, "[msg ")
+	if !ok {
+		return 0, "", false
+	}
+	tag, text, ok := strings.Cut(rest, "] ")
+	if !ok {
+		return 0, "", false
+	}
+	_, number, _ := strings.Cut(tag, " ")
+	seq, err := strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	// Without the sender
+	if _, after, ok := strings.Cut(text, "> "); ok {
+		text = after
+	}
+	return seq, text, true
+}
+
+func TestIntegrationConcurrentSendersSeeOneOrder(t *testing.T) {
+	const senders = 4
+	const listeners = 3
+	const perSender = 50
+	addr := startTCPServer(t, integrationConfig())
+	var clients []*tcpClient
+	for i := 0; i < senders+listeners; i++ {
+		c := dialJoined(t, addr)
+		c.send(":format verbose")
+		c.waitFor("Format is verbose now")
+		clients = append(clients, c)
+	}
+
+	// Every client reads on its own while the senders send, all that is
+	// expected of it is every message but its own
+	type received struct {
+		seqs []uint64
+		texts map[uint64]string
+		err error
+	}
+	transcripts := make([]chan received, len(clients))
+	for i, c := range clients {
+		expected := senders*perSender
+		if i < senders {
+			expected -= perSender
+		}
+		transcripts[i] = make(chan received, 1)
+		go func(c *tcpClient, done chan received) {
+			got := received{texts: map[uint64]string{}}
+			c.conn.SetReadDeadline(time.Now().Add(integrationTimeout))
+			for len(got.seqs) < expected {
+				line, err := c.reader.ReadString('\n')
+				if err != nil {
+					got.err = err
+					break
+				}
+				if seq, text, ok := verboseSeq(strings.TrimSuffix(line, "\n")); ok {
+					got.seqs = append(got.seqs, seq)
+					got.texts[seq] = text
+				}
+			}
+			done <- got
+		}(c, transcripts[i])
+	}
+	for i := 0; i < senders; i++ {
+		go func(i int) {
+			for j := 0; j < perSender; j++ {
+				fmt.Fprintf(clients[i].conn, "sender %d message %d\n", i, j)
+			}
+		}(i)
+	}
+
+	// The canonical order is the one of the sequence numbers, each one
+	// naming the same message for everybody
+	canonical := map[uint64]string{}
+	for i := range clients {
+		got := <-transcripts[i]
+		if got.err != nil {
+			t.Fatalf("client %d: %s after %d messages", i, got.err, len(got.seqs))
+		}
+		for k, seq := range got.seqs {
+			if k > 0 && seq <= got.seqs[k-1] {
+				t.Fatalf("client %d got %d after %d", i, seq, got.seqs[k-1])
+			}
+			if text, ok := canonical[seq]; ok && text != got.texts[seq] {
+				t.Fatalf("message %d is %q for client %d but %q for another", seq, got.texts[seq], i, text)
+			}
+			canonical[seq] = got.texts[seq]
+		}
+	}
+	if len(canonical) != senders*perSender {
+		t.Errorf("%d messages numbered, want %d", len(canonical), senders*perSender)
+	}
+	// And every sender's own messages stay in the order it sent them
+	last := map[int]int{}
+	for seq := uint64(1); seq <= uint64(len(canonical)); seq++ {
+		var sender, j int
+		if _, err := fmt.Sscanf(canonical[seq], "sender %d message %d", &sender, &j); err != nil {
+			t.Fatalf("message %d is %q", seq, canonical[seq])
+		}
+		if previous, ok := last[sender]; ok && j != previous+1 {
+			t.Errorf("sender %d: message %d came after %d", sender, j, previous)
+		}
+		last[sender] = j
+	}
+}
+
+func TestIntegrationServerFull(t *testing.T) {
+	cfg := integrationConfig()
+	cfg.MaxClients = 3
+	addr := startTCPServer(t, cfg)
+	var clients []*tcpClient
+	for i := 0; i < cfg.MaxClients; i++ {
+		clients = append(clients, dialJoined(t, addr))
+	}
+
+	lines := dial(t, addr).readAll()
+	if len(lines) == 0 || lines[0] != "Server full, try again later" || !strings.HasPrefix(lines[len(lines)-1], byePrefix+string(ByeFull)) {
+		t.Errorf("want the server full notice and the BYE, got %q", lines)
+	}
+
+	// The ones already in go on as if nothing happened
+	clients[0].send("still here")
+	for _, c := range clients[1:] {
+		c.waitFor("still here")
+	}
+}
+
+func TestIntegrationBotAnswersWithinTheRate(t *testing.T) {
+	security := captureSecurityLog(t)
+	cfg := integrationConfig()
+	cfg.MessageRate = 200*time.Millisecond
+	addr := startTCPServer(t, cfg)
+	var humans []*tcpClient
+	for i := 0; i < 3; i++ {
+		humans = append(humans, dialJoined(t, addr))
+	}
+
+	b := bot.New()
+	b.Command("ping", func(cmd bot.Command) *bot.Reply {
+		return &bot.Reply{Text: "pong " + strings.Join(cmd.Args, " ")}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		b.Run(ctx, addr)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+	humans[0].waitFor("joined " + defaultRoom + ", 4 members now")
+
+	// Three triggers at once, from clients of their own so none of them is
+	// held to the rate, once the rate allows their first message
+	time.Sleep(cfg.MessageRate)
+	for i, human := range humans {
+		human.send(fmt.Sprintf("!ping %d", i))
+	}
+	start := time.Now()
+	// In the order the triggers got to the server, whichever that is
+	pongs := 0
+	for pongs < len(humans) {
+		line, err := humans[0].readLine()
+		if err != nil {
+			t.Fatalf("got %d replies: %s", pongs, err)
+		}
+		if strings.HasPrefix(line, "pong ") {
+			pongs += 1
+		}
+	}
+	// The first reply goes right away, the other two wait for the rate
+	if elapsed := time.Since(start); elapsed < 2*cfg.MessageRate {
+		t.Errorf("the bot answered 3 times in %s, faster than the rate of %s", elapsed, cfg.MessageRate)
+	}
+	if strikes := security.withEvent(t, "strike"); len(strikes) > 0 {
+		t.Errorf("the bot got strikes: %v", strikes)
+	}
+}
+
+func TestIntegrationBotSeesWhoJoins(t *testing.T) {
+	addr := startTCPServer(t, integrationConfig())
+	alice := dialJoined(t, addr)
+
+	joins := make(chan bot.Join, 1)
+	b := bot.New()
+	b.OnJoin(func(join bot.Join) *bot.Reply {
+		joins <- join
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		b.Run(ctx, addr)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+	alice.waitFor("joined " + defaultRoom + ", 2 members now")
+
+	dialJoined(t, addr)
+	select {
+	case join := <-joins:
+		if join.Nick != "127.0.0.1" || join.Room != defaultRoom || join.Members != 3 {
+			t.Errorf("got %+v", join)
+		}
+	case <-time.After(5*time.Second):
+		t.Fatal("the bot didn't see the join")
+	}
+}
+
+func TestIntegrationNothingLeaksAfterCancel(t *testing.T) {
+	ln := listenLocal(t)
+	before := runtime.NumGoroutine()
+	cfg := integrationConfig()
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewServer(cfg, &Files{})
+	messages := make(chan Message)
+	go server(ctx, s, messages)
+	go accept(ctx, cfg, &s.files.Catalog, ln, s.connected, messages)
+	addr := ln.Addr().String()
+	var clients []*tcpClient
+	for i := 0; i < 3; i++ {
+		clients = append(clients, dialJoined(t, addr))
+	}
+	clients[0].send("hello")
+	clients[1].waitFor("hello")
+
+	cancel()
+	// The server hangs up on every client, then the clients are gone too
+	for _, c := range clients {
+		c.readAll()
+		c.conn.Close()
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines left over, %d before:\n%s", runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+}
+
+// waitForIncoming reads the messages of the session until one contains
+// the text
+func waitForIncoming(t *testing.T, session *chatclient.Session, text string) chatclient.Incoming {
+	t.Helper()
+	timeout := time.After(integrationTimeout)
+	for {
+		select {
+		case incoming, ok := <-session.Messages():
+			if !ok {
+				t.Fatalf("the session ended waiting for %q", text)
+			}
+			if strings.Contains(incoming.Text, text) {
+				return incoming
+			}
+		case <-timeout:
+			t.Fatalf("%q didn't come within %s", text, integrationTimeout)
+		}
+	}
+}
+
+func dialSession(t *testing.T, addr string, opts ...chatclient.Option) *chatclient.Session {
+	t.Helper()
+	session, err := chatclient.Dial(addr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		session.Close()
+	})
+	return session
+}
+
+func TestIntegrationClientLibraryRoundTrip(t *testing.T) {
+	addr := startTCPServer(t, integrationConfig())
+	alice := dialSession(t, addr, chatclient.WithNick("alice"))
+	bob := dialSession(t, addr, chatclient.WithNick("bob"))
+	waitForIncoming(t, alice, "You are known as alice")
+	waitForIncoming(t, bob, "You are known as bob")
+
+	if err := alice.Send("hello bob"); err != nil {
+		t.Fatal(err)
+	}
+	if incoming := waitForIncoming(t, bob, "hello bob"); incoming.Notice {
+		t.Errorf("a chat line came as a notice: %q", incoming.Text)
+	}
+	// The LIMITS line isn't delivered, it's parsed
+	if limits := alice.Limits(); limits.MaxLen != maxMessageSize || limits.Strikes != integrationConfig().StrikeLimit {
+		t.Errorf("got the limits %+v", limits)
+	}
+	if err := alice.Send(strings.Repeat("x", maxMessageSize)); err == nil {
+		t.Errorf("sent a message over the limit")
+	}
+}
+
+func TestIntegrationClientReconnectsAfterABye(t *testing.T) {
+	cfg := integrationConfig()
+	cfg.AdminPassword = adminConfig(t).AdminPassword
+	addr := startTCPServer(t, cfg)
+	admin := dialSession(t, addr)
+	victim := dialSession(t, addr, chatclient.WithNick("victim"), chatclient.WithReconnect(10*time.Millisecond, 100*time.Millisecond))
+	if err := admin.Send(":auth " + testPassword); err != nil {
+		t.Fatal(err)
+	}
+	waitForIncoming(t, admin, "You are an admin now")
+	waitForIncoming(t, victim, "You are known as victim")
+	if _, ok := victim.Bye(); ok {
+		t.Errorf("a BYE before any")
+	}
+
+	if err := admin.Send(":kick victim flooding"); err != nil {
+		t.Fatal(err)
+	}
+	if incoming := waitForIncoming(t, victim, "BYE code=kicked"); !incoming.Notice {
+		t.Errorf("the BYE isn't a notice")
+	}
+	if bye, ok := victim.Bye(); !ok || bye != (chatclient.Bye{Code: "kicked"}) {
+		t.Errorf("got the bye %+v, %t", bye, ok)
+	}
+
+	// Back with its nick on a new connection
+	waitForIncoming(t, victim, "You are known as victim")
+	if err := victim.Send("I'm back"); err != nil {
+		t.Fatal(err)
+	}
+	waitForIncoming(t, admin, "I'm back")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// The upper bounds of the buckets of LatencyHistogram, anything slower goes
+// to one more bucket past the last
+var latencyBuckets = [...]time.Duration{
+	100*time.Microsecond,
+	250*time.Microsecond,
+	500*time.Microsecond,
+	time.Millisecond,
+	2500*time.Microsecond,
+	5*time.Millisecond,
+	10*time.Millisecond,
+	25*time.Millisecond,
+	50*time.Millisecond,
+	100*time.Millisecond,
+	250*time.Millisecond,
+	500*time.Millisecond,
+	time.Second,
+	2500*time.Millisecond,
+	5*time.Second,
+}
+
+// LatencyHistogram counts how long the messages took from being read to
+// being written to their last recipient. It's an array, so copying Stats
+// copies it.
+type LatencyHistogram struct {
+	counts [len(latencyBuckets)+1]int
+	count int
+	max time.Duration
+}
+
+func (h *LatencyHistogram) Observe(latency time.Duration) {
+	bucket := len(latencyBuckets)
+	for i, bound := range latencyBuckets {
+		if latency <= bound {
+			bucket = i
+			break
+		}
+	}
+	h.counts[bucket] += 1
+	h.count += 1
+	h.max = max(h.max, latency)
+}
+
+// Percentile is the upper bound of the bucket holding the p-th latency, or
+// the slowest one seen when that's past the last bucket
+func (h *LatencyHistogram) Percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int(p*float64(h.count-1)) + 1
+	seen := 0
+	for i, count := range h.counts {
+		seen += count
+		if seen >= rank {
+			if i < len(latencyBuckets) {
+				return min(latencyBuckets[i], h.max)
+			}
+			break
+		}
+	}
+	return h.max
+}
+
+func (h LatencyHistogram) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"count": h.count,
+		"p50": h.Percentile(0.50).String(),
+		"p95": h.Percentile(0.95).String(),
+		"p99": h.Percentile(0.99).String(),
+		"max": h.max.String(),
+	})
+}
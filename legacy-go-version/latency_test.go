@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tsoding/4at/testutil"
+)
+
+func TestLatencyPercentiles(t *testing.T) {
+	var h LatencyHistogram
+	for i := 0; i < 98; i++ {
+		h.Observe(200*time.Microsecond)
+	}
+	h.Observe(40*time.Millisecond)
+	h.Observe(7*time.Second)
+
+	for p, want := range map[float64]time.Duration{
+		0.50: 250*time.Microsecond,
+		0.99: 50*time.Millisecond,
+		1: 7*time.Second,
+	} {
+		if got := h.Percentile(p); got != want {
+			t.Errorf("p%v is %s, want %s", p*100, got, want)
+		}
+	}
+}
+
+// slowConn takes its time with every write, like a client on a bad network
+type slowConn struct {
+	*testutil.FakeConn
+	delay time.Duration
+}
+
+func (c slowConn) Write(b []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.FakeConn.Write(b)
+}
+
+func TestLatencyCountsTheSlowestRecipient(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	alice := ts.connect("10.0.0.1:1001")
+	ts.connect("10.0.0.2:1002")
+	send := func(text string) {
+		ts.clock.Advance(time.Minute)
+		// The latency is measured on the real clock
+		ts.messages <- Message{Type: NewMessage, Text: text + "\n", Conn: alice.Conn, ConnID: alice.ID, ReceivedAt: time.Now()}
+		ts.sync()
+	}
+
+	send("fast")
+	if latency := ts.sync().Stats.Latency; latency.count != 1 || latency.max >= 25*time.Millisecond {
+		t.Errorf("a room of fast clients took %s", latency.max)
+	}
+
+	const delay = 30*time.Millisecond
+	slow := slowConn{testutil.NewFakeConn("10.0.0.3:1003"), delay}
+	ts.s.connected.Add(1)
+	ts.messages <- Message{Type: ClientConnected, Conn: slow, ConnID: nextConnID(), Admitted: make(chan struct{})}
+	ts.sync()
+	send("slow")
+	latency := ts.sync().Stats.Latency
+	if latency.count != 2 || latency.max < delay || latency.Percentile(1) < delay {
+		t.Errorf("the write delay of %s didn't show: max %s, p100 %s", delay, latency.max, latency.Percentile(1))
+	}
+}
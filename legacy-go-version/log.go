@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// logLevel is shared by the handlers so the level can be changed on reload
+// without rebuilding the logger
+var logLevel = &slog.LevelVar{}
+
+func setLogLevel(cfg Config) {
+	var level slog.Level
+	// Validate has already made sure the level parses
+	level.UnmarshalText([]byte(cfg.LogLevel))
+	logLevel.Set(level)
+}
+
+// toggleDebugOnSignal switches between the debug and info levels on every
+// SIGUSR1, for a quick look at what a running server is doing
+func toggleDebugOnSignal(ctx context.Context) {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	defer signal.Stop(usr1)
+	for {
+		select {
+		case <-usr1:
+		case <-ctx.Done():
+			return
+		}
+		level := slog.LevelDebug
+		if logLevel.Level() == slog.LevelDebug {
+			level = slog.LevelInfo
+		}
+		logLevel.Set(level)
+		slog.Warn("Changed the log level", "event", "loglevel", "level", level.String(), "actor", "signal/SIGUSR1")
+	}
+}
+
+// securityLog gets one line per security event, see -security-log. It
+// discards them unless configured since the ordinary log has them anyway.
+var securityLog = slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+func setupSecurityLog(cfg Config) error {
+	if cfg.SecurityLog == "" {
+		return nil
+	}
+	f, err := os.OpenFile(cfg.SecurityLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	securityLog = slog.New(slog.NewJSONHandler(f, nil))
+	return nil
+}
+
+// securityEvent logs that the rule fired against the client, the client
+// being already passed through Config.sensitive
+func securityEvent(event string, rule string, client string, args ...any) {
+	securityLog.Warn("Security event", append([]any{"event", event, "rule", rule, "client", client}, args...)...)
+}
+
+func setupLogging(cfg Config) error {
+	setLogLevel(cfg)
+	var out io.Writer = os.Stderr
+	if cfg.LogFile != "" && cfg.LogRotate == "daily" {
+		w, err := openDailyRotatingWriter(cfg.LogFile, cfg.LogKeep)
+		if err != nil {
+			return err
+		}
+		out = w
+	} else if cfg.LogFile != "" {
+		w, err := openRotatingWriter(cfg.LogFile, int64(cfg.LogMaxSize)*1024*1024, cfg.LogMaxFiles)
+		if err != nil {
+			return err
+		}
+		out = w
+	}
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	if cfg.LogFormat == "json" {
+		handler = slog.NewJSONHandler(out, opts)
+	} else {
+		handler = slog.NewTextHandler(out, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// rotatingWriter appends to the file at path and rotates it once it would
+// grow past maxSize: path becomes path.1, path.1 becomes path.2 and so on,
+// keeping at most maxFiles old files. The lock makes the rotation atomic
+// for the concurrent writers, none of them ever sees a half rotated file.
+type rotatingWriter struct {
+	mu sync.Mutex
+	path string
+	maxSize int64
+	maxFiles int
+	file *os.File
+	size int64
+}
+
+func openRotatingWriter(path string, maxSize int64, maxFiles int) (*rotatingWriter, error) {
+	w := &rotatingWriter{
+		path: path,
+		maxSize: maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	for i := w.maxFiles - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	var err error
+	if w.maxFiles > 0 {
+		err = os.Rename(w.path, w.path+".1")
+	} else {
+		err = os.Remove(w.path)
+	}
+	if err != nil {
+		return err
+	}
+	return w.open()
+}
+
+const logDateLayout = "2006-01-02"
+
+// dailyRotatingWriter appends to the file at path, say 4at.log, and moves
+// it to 4at.2024-01-14.log on the first write of a new day. Rotated files
+// older than keepDays are deleted, 0 keeps them all.
+type dailyRotatingWriter struct {
+	*os.File
+	mu sync.Mutex
+	path string
+	keepDays int
+	lastDate string
+}
+
+func openDailyRotatingWriter(path string, keepDays int) (*dailyRotatingWriter, error) {
+	w := &dailyRotatingWriter{
+		path: path,
+		keepDays: keepDays,
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// A file left over from an earlier day gets rotated on the first write
+	w.File = file
+	w.lastDate = info.ModTime().Format(logDateLayout)
+	return w, nil
+}
+
+// rotatedLogPath inserts the date before the extension of path
+func rotatedLogPath(path string, date string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + date + ext
+}
+
+func (w *dailyRotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if today := time.Now().Format(logDateLayout); today != w.lastDate {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+		w.lastDate = today
+	}
+	return w.File.Write(p)
+}
+
+func (w *dailyRotatingWriter) rotate() error {
+	if err := w.File.Sync(); err != nil {
+		return err
+	}
+	if err := w.File.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.path, rotatedLogPath(w.path, w.lastDate)); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	w.File = file
+	if w.keepDays > 0 {
+		ext := filepath.Ext(w.path)
+		cleanOldLogs(filepath.Dir(w.path), strings.TrimSuffix(filepath.Base(w.path), ext), ext, w.keepDays)
+	}
+	return nil
+}
+
+// cleanOldLogs deletes the files rotated by dailyRotatingWriter that are
+// more than keepDays days old
+func cleanOldLogs(dir string, basename string, ext string, keepDays int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -keepDays)
+	for _, entry := range entries {
+		date, ok := strings.CutPrefix(entry.Name(), basename+".")
+		if !ok {
+			continue
+		}
+		date, ok = strings.CutSuffix(date, ext)
+		if !ok {
+			continue
+		}
+		day, err := time.Parse(logDateLayout, date)
+		if err != nil {
+			continue
+		}
+		if day.Before(cutoff) {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
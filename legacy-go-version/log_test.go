@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// capturedLog collects the JSON lines of a logger the server and its
+// goroutines write to at once
+type capturedLog struct {
+	mu sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *capturedLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *capturedLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+// entries are the records logged so far, in order
+func (l *capturedLog) entries(t *testing.T) []map[string]any {
+	t.Helper()
+	var entries []map[string]any
+	for _, line := range bytes.Split(bytes.TrimSpace([]byte(l.String())), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var entry map[string]any
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("not a JSON log line: %s", line)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// withEvent are the entries of the event
+func (l *capturedLog) withEvent(t *testing.T, event string) []map[string]any {
+	t.Helper()
+	var entries []map[string]any
+	for _, entry := range l.entries(t) {
+		if entry["event"] == event {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func newCapturedLogger() (*capturedLog, *slog.Logger) {
+	captured := &capturedLog{}
+	return captured, slog.New(slog.NewJSONHandler(captured, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+// captureLog makes the default logger log everything as JSON for the
+// length of the test. The clients take their loggers from it on connect,
+// so it has to come before them.
+func captureLog(t *testing.T) *capturedLog {
+	captured, logger := newCapturedLogger()
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+	})
+	return captured
+}
+
+// captureSecurityLog does the same for the -security-log
+func captureSecurityLog(t *testing.T) *capturedLog {
+	captured, logger := newCapturedLogger()
+	previous := securityLog
+	securityLog = logger
+	t.Cleanup(func() {
+		securityLog = previous
+	})
+	return captured
+}
+
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestDailyRotatingWriterRotatesOnANewDay(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "4at.log")
+	// Long gone, and recent enough to stay
+	old := filepath.Join(dir, "4at.2000-01-01.log")
+	recent := filepath.Join(dir, "4at."+time.Now().AddDate(0, 0, -2).Format(logDateLayout)+".log")
+	for _, name := range []string{old, recent} {
+		if err := os.WriteFile(name, []byte("before\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := openDailyRotatingWriter(path, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.Write([]byte("yesterday\n"))
+	// The date changes under the writer
+	yesterday := time.Now().AddDate(0, 0, -1).Format(logDateLayout)
+	w.lastDate = yesterday
+	w.Write([]byte("today\n"))
+
+	if got := readLog(t, filepath.Join(dir, "4at."+yesterday+".log")); got != "yesterday\n" {
+		t.Errorf("the rotated file has %q", got)
+	}
+	if got := readLog(t, path); got != "today\n" {
+		t.Errorf("the fresh file has %q", got)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("a file older than -logkeep days is still there")
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Errorf("a file within -logkeep days is gone: %s", err)
+	}
+
+	// Same day, no rotation
+	w.Write([]byte("again\n"))
+	if got := readLog(t, path); got != "today\nagain\n" {
+		t.Errorf("the file has %q", got)
+	}
+}
+
+func TestLogEventsAtTheirLevels(t *testing.T) {
+	captured := captureLog(t)
+	cfg := testConfig()
+	cfg.SafeMode = "redact"
+	cfg.StrikeLimit = 1
+	ts := startServer(t, cfg, nil)
+	alice := ts.connect("10.0.0.1:1001")
+	ts.connect("10.0.0.2:1002").Close()
+
+	alice.Play(
+		ScriptStep{After: time.Second, Line: "hello"},
+		ScriptStep{After: time.Second, Line: garbage},
+	)
+
+	for _, tc := range []struct {
+		event string
+		level string
+		attr string
+		value any
+	}{
+		{"connect", "INFO", "client", "[REDACTED]"},
+		{"message", "DEBUG", "bytes", float64(len("hello\n"))},
+		{"strike", "INFO", "rule", "binary"},
+		{"ban", "INFO", "client", "[REDACTED]"},
+		{"disconnect", "INFO", "client", "[REDACTED]"},
+	} {
+		entries := captured.withEvent(t, tc.event)
+		if len(entries) == 0 {
+			t.Errorf("no %s logged", tc.event)
+			continue
+		}
+		if entry := entries[0]; entry["level"] != tc.level || entry[tc.attr] != tc.value {
+			t.Errorf("%s: got %v, want level %s and %s=%v", tc.event, entry, tc.level, tc.attr, tc.value)
+		}
+	}
+}
+
+func TestRotatingWriterKeepsMaxFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "4at.log")
+	w, err := openRotatingWriter(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.file.Close()
+
+	for name, want := range map[string]string{
+		path: "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		if got := readLog(t, name); got != want {
+			t.Errorf("%s has %q, want %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than -log-max-files old files are kept")
+	}
+}
+
+func TestRotatingWriterConcurrentWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "4at.log")
+	w, err := openRotatingWriter(path, 100, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const writers = 8
+	const lines = 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				w.Write([]byte("0123456789\n"))
+			}
+		}()
+	}
+	wg.Wait()
+	w.file.Close()
+
+	// Every line made it whole into one of the files
+	matches, err := filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, name := range matches {
+		text := readLog(t, name)
+		if len(text) > 100 {
+			t.Errorf("%s grew to %d bytes", name, len(text))
+		}
+		for _, line := range strings.SplitAfter(text, "\n") {
+			if line == "" {
+				continue
+			}
+			if line != "0123456789\n" {
+				t.Fatalf("%s has a torn line %q", name, line)
+			}
+			total += 1
+		}
+	}
+	if total != writers*lines {
+		t.Errorf("%d lines written, want %d", total, writers*lines)
+	}
+}
+
+func TestCorrelationIDFollowsTheConnection(t *testing.T) {
+	captured := captureLog(t)
+	cfg := testConfig()
+	cfg.StrikeLimit = 2
+	ts := startServer(t, cfg, nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+
+	alice.Play(
+		ScriptStep{After: time.Second, Line: "hello"},
+		ScriptStep{After: time.Second, Line: garbage},
+	)
+	bob.Play(ScriptStep{After: time.Second, Line: "hi"})
+	alice.Close()
+	bob.Close()
+
+	cids := map[float64]map[any]bool{}
+	for _, entry := range captured.entries(t) {
+		conn, ok := entry["conn"].(float64)
+		if !ok {
+			continue
+		}
+		if cids[conn] == nil {
+			cids[conn] = map[any]bool{}
+		}
+		cids[conn][entry["cid"]] = true
+	}
+	for _, c := range []*ScriptedClient{alice, bob} {
+		if got := cids[float64(c.ID)]; len(got) != 1 || got[nil] {
+			t.Errorf("connection %d was logged with the cids %v, want exactly one", c.ID, got)
+		}
+	}
+	if events := len(captured.withEvent(t, "strike")); events != 1 {
+		t.Errorf("%d strikes logged, want the one of alice", events)
+	}
+	for cid := range cids[float64(alice.ID)] {
+		if cids[float64(bob.ID)][cid] {
+			t.Errorf("two connections share the cid %v", cid)
+		}
+	}
+}
+
+func TestSecurityLogFollowsAClientToItsBan(t *testing.T) {
+	security := captureSecurityLog(t)
+	cfg := testConfig()
+	cfg.StrikeLimit = 3
+	cfg.SafeMode = "redact"
+	ts := startServer(t, cfg, nil)
+	mallory := ts.connect("10.0.0.1:1001")
+	for i := 0; i < cfg.StrikeLimit; i++ {
+		mallory.Play(ScriptStep{After: time.Second, Line: garbage})
+	}
+	ts.connect("10.0.0.1:1002")
+
+	var got []string
+	for _, entry := range security.entries(t) {
+		if entry["client"] == "10.0.0.1:1001" || entry["client"] == "10.0.0.1" {
+			t.Errorf("the address is in the security log with the safe mode on: %v", entry)
+		}
+		got = append(got, fmt.Sprintf("%v %v %v", entry["event"], entry["rule"], entry["strikes"]))
+	}
+	want := []string{
+		"strike binary 1",
+		"strike binary 2",
+		"strike binary 3",
+		"ban too many content strikes, the last for binary <nil>",
+		"banned_reconnect ban <nil>",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got the security events\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestSafeModeKeepsTheMessagesOutOfTheLog(t *testing.T) {
+	for _, mode := range []string{"redact", "hash", "off"} {
+		log := captureLog(t)
+		cfg := testConfig()
+		cfg.SafeMode = mode
+		ts := startServer(t, cfg, nil)
+		alice := ts.connect("10.0.0.1:1001")
+		ts.connect("10.0.0.2:1002")
+		alice.Play(ScriptStep{After: time.Second, Line: "meet me at the old mill"})
+		// Too fast, turned down
+		alice.Send("bring the password")
+
+		logged := strings.Contains(log.String(), "old mill")
+		if mode == "off" && !logged {
+			t.Errorf("the message isn't logged with the safe mode off")
+		}
+		if mode != "off" && (logged || strings.Contains(log.String(), "password")) {
+			t.Errorf("%s: the message is in the log:\n%s", mode, log)
+		}
+	}
+}
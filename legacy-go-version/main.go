@@ -1,27 +1,35 @@
 package main
 
 import (
-	"log"
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log/slog"
 	"net"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"fmt"
-	"unicode/utf8"
-)
 
-const (
-	Port = "6969"
-	SafeMode = true
-	MessageRate = 1.0
-	BanLimit = 10*60.0
-	StrikeLimit = 10
+	"github.com/tsoding/4at/transcript"
+	"golang.org/x/time/rate"
 )
 
-func sensitive(message string) string {
-	if SafeMode {
-		return "[REDACTED]"
-	} else {
-		return message
-	}
+// Set at build time, see the Makefile
+var buildVersion = "dev"
+var buildCommit = "unknown"
+
+func versionString() string {
+	return fmt.Sprintf("4at v%s (%s)", buildVersion, buildCommit)
 }
 
 type MessageType int
@@ -29,130 +37,1219 @@ const (
 	ClientConnected MessageType = iota + 1
 	ClientDisconnected
 	NewMessage
+	ConfigReloaded
+	StatusReport
+	ExportFinished
+	AuthChecked
+	AccountChecked
+	// A frame from one of the relays dialed by the server
+	RelayReceived
+	// Asks for a StatsSnapshot on Reply, see queryStats
+	QueryStats
 )
 
+var messageTypeNames = map[MessageType]string{
+	ClientConnected: "ClientConnected",
+	ClientDisconnected: "ClientDisconnected",
+	NewMessage: "NewMessage",
+	ConfigReloaded: "ConfigReloaded",
+	StatusReport: "StatusReport",
+	ExportFinished: "ExportFinished",
+	AuthChecked: "AuthChecked",
+	AccountChecked: "AccountChecked",
+	RelayReceived: "RelayReceived",
+	QueryStats: "QueryStats",
+}
+
+func (t MessageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("MessageType(%d)", int(t))
+}
+
+// ConnID tells the connections apart for the whole run of the server. The
+// addresses don't: a NAT may hand the same one to the next connection.
+type ConnID uint64
+
+// The last ConnID given out, see nextConnID
+var lastConnID atomic.Uint64
+
+func nextConnID() ConnID {
+	return ConnID(lastConnID.Add(1))
+}
+
 type Message struct {
 	Type MessageType
 	Conn net.Conn
+	// The connection the message is about, set for every message that has
+	// a Conn and for the workers answering a client
+	ConnID ConnID
 	Text string
+	Config *Config
+	// The ban list of a ConfigReloaded as read from -banfile, nil to keep
+	// the current one
+	Bans map[string]time.Time
+	// Who triggered a ConfigReloaded
+	Actor string
+	// Whether the password of an AuthChecked was right
+	Granted bool
+	Account *AccountReply
+	// Where a QueryStats wants its answer
+	Reply chan StatsSnapshot
+	// When client() read the line of a NewMessage
+	ReceivedAt time.Time
+	// Closed by server() once it has set up the client of a
+	// ClientConnected, see HandshakeDeadline
+	Admitted chan struct{}
 }
 
 type Client struct {
 	Conn net.Conn
+	// The key of the client in Server.clients and in the rooms
+	ID ConnID
+	// Stays the same for the whole session, unlike the port, so grepping
+	// the log for it finds everything that happened to the client
+	CorrelationID string
+	log *slog.Logger
+	// The room the messages of the client go to
+	Room string
+	// Set with :nick, empty until then
+	Username string
+	// The registered nick the client logged in as, empty until then
+	Account string
+	ConnectedAt time.Time
 	LastMessage time.Time
-	StrikeCount int
+	LastHistory time.Time
+	// Sending too fast, see slowDown. They never get the client banned.
+	RateLimitStrikes int
+	// Until then every message is too fast, the longer the more rate
+	// limit strikes in a row
+	CooldownUntil time.Time
+	// Breaking the content rules or failing to authenticate, see strike
+	ContentStrikes int
+	// The last content strike, they decay from there
+	LastStrike time.Time
+	IsAdmin bool
+	// Set with :echo, the client gets its own messages back once accepted,
+	// and a notice for every message that isn't
+	Echo bool
+	// Set with :format, see render
+	Format OutputFormat
+	// Set once another server authenticated with :relay, see relay.go
+	IsRelay bool
+	// The start of a relay frame still waiting for its newline
+	relayBuf string
+	// nil without a -bandwidth, see deliver
+	budget *rate.Limiter
+	// Chat lines skipped since the last one delivered
+	skipped int
+	// Set by :nick, see nickWait
+	LastNickChange time.Time
+	// :nick turned down since the last change, see setNick
+	nickRefused int
+	// Set with :ignore. By connection, not by nick, so renaming doesn't
+	// shake an ignore off.
+	Ignored map[ConnID]bool
+	BytesRead int
+	BytesWritten int
+	MessagesSent int
+	MessagesReceived int
+}
+
+// Write sends the text to the client, dropping the client when it doesn't
+// keep up. The ClientDisconnected of the closed connection cleans up.
+//
+// Every write happens right away on the server() goroutine, which is what
+// makes all the clients see the messages in one order, the order server()
+// processed them in, the order of their sequence numbers. Writing
+// from another goroutine, or queueing per client, has to keep that: one
+// FIFO queue per client, filled by server() only.
+func (client *Client) Write(text string) {
+	if err := writeWithTimeout(client.Conn, []byte(text), writeTimeout); err != nil {
+		client.log.Debug("Could not write to the client, disconnecting it", "event", "write_failed", "err", err)
+		hangUp(client.Conn, ByeSlowConsumer, 0)
+		return
+	}
+	client.BytesWritten += len(text)
+}
+
+// Server is the state owned by the server() goroutine. Nothing else is
+// supposed to touch it, everything goes through the messages channel. The
+// goroutines that want to read it, like the debug endpoints, send a
+// QueryStats and get a copy back, so the maps need no locks.
+type Server struct {
+	cfg Config
+	files *Files
+	reload func(actor string)
+	// Stops the whole server, server() keeps running until its context is
+	// done
+	shutdown func()
+	// The MOTD clients have last been told about
+	motd string
+	// The server wide slow mode, as configured or as set by :slowmode
+	slowMode time.Duration
+	// Shared with the accept loop which admits the clients
+	connected *atomic.Int32
+	// nil when transcripting is disabled
+	transcript *transcript.Writer
+	msgIDs MsgIDGenerator
+	// Of the last chat line, see Line.Seq
+	seq uint64
+	audit *AuditLog
+	stats Stats
+	history *History
+	// nil when the history isn't persisted
+	historyDB *HistoryDB
+	// nil without -accounts-db
+	accounts *AccountDB
+	// By IP, for the lockout of the account commands
+	logins map[string]*loginAttempts
+	// Set while an export worker is writing a file
+	exporting bool
+	// For the workers which report back to server()
+	messages chan Message
+	// Of server(), the workers give up reporting back once it's done
+	ctx context.Context
+	// Addresses which asked not to get the history replayed on join
+	noHistory map[string]bool
+	// By connection, the IPs are only for the bans
+	clients map[ConnID]*Client
+	// An empty room is deleted
+	rooms map[string]*Room
+	bannedMfs map[string]time.Time
+	// Tags the messages sent to the relays, so they are recognized when
+	// they come back
+	id string
+	// By address, see syncRelays
+	relays map[string]*Relay
+	// nil unless WebhookURL is set
+	webhook *Webhook
+	// The limits the clients have last been told about
+	lastLimits string
+	panics PanicCounter
+	// The NewMessages waiting for their round, see FairQueue
+	pending *FairQueue
+	// See AddHook
+	hooks []*registeredHook
+	// time.Now, a fake clock in the tests
+	now func() time.Time
+}
+
+func NewServer(cfg Config, files *Files) *Server {
+	s := &Server{
+		cfg: cfg,
+		files: files,
+		reload: func(string) {},
+		shutdown: func() {},
+		audit: &AuditLog{max: cfg.AuditSize},
+		history: NewHistory(cfg.HistorySize, cfg.HistoryLimit),
+		noHistory: map[string]bool{},
+		logins: map[string]*loginAttempts{},
+		motd: files.Motd.Text(),
+		slowMode: cfg.SlowMode,
+		connected: &atomic.Int32{},
+		clients: map[ConnID]*Client{},
+		rooms: map[string]*Room{},
+		bannedMfs: map[string]time.Time{},
+		id: newCorrelationID(),
+		relays: map[string]*Relay{},
+		msgIDs: newMsgIDGenerator(cfg.MsgIDType),
+		pending: NewFairQueue(),
+		now: time.Now,
+	}
+	for _, hook := range builtinHooks() {
+		s.AddHook(hook)
+	}
+	return s
 }
 
-func server(messages chan Message) {
-	clients := map[string]*Client{}
-	bannedMfs := map[string]time.Time{}
+func server(ctx context.Context, s *Server, messages chan Message) {
+	s.messages = messages
+	s.ctx = ctx
+	s.lastLimits = s.limits()
+	s.syncRelays(ctx)
+	s.syncWebhook(ctx)
+	idle := time.NewTicker(idleCheckInterval(s.cfg.IdleTimeout))
+	defer idle.Stop()
+	banCleanup := time.NewTicker(banCleanupInterval(s.cfg.BanLimit))
+	defer banCleanup.Stop()
+	// How many messages were taken in since the last round
+	intake := 0
 	for {
-		msg := <- messages
-		switch msg.Type {
-		case ClientConnected:
-			addr := msg.Conn.RemoteAddr().(*net.TCPAddr)
-			bannedAt, banned := bannedMfs[addr.IP.String()]
-			now := time.Now()
-			if banned {
-				if now.Sub(bannedAt).Seconds() >= BanLimit {
-					delete(bannedMfs, addr.IP.String())
-					banned = false
+		var msg Message
+		// With messages waiting for their round only the ones that already
+		// arrived are taken in, then the next round goes
+		if s.pending.Len() > 0 {
+			if intake < fairIntake {
+				select {
+				case msg = <- messages:
+					intake += 1
+				case <-ctx.Done():
+					s.close()
+					return
+				default:
 				}
 			}
-
-			if !banned {
-				log.Printf("Client %s connected", sensitive(addr.String()));
-				clients[msg.Conn.RemoteAddr().String()] = &Client{
-					Conn: msg.Conn,
-					LastMessage: time.Now(),
+			if msg.Type == 0 {
+				intake = 0
+				// A reload may have set FairShare to 0 with messages
+				// still waiting
+				for _, queued := range s.pending.Round(max(s.cfg.FairShare, 1)) {
+					s.dispatch(ctx, queued, idle, banCleanup)
 				}
-			} else {
-				msg.Conn.Write([]byte(fmt.Sprintf("You are banned MF: %f secs left\n", BanLimit - now.Sub(bannedAt).Seconds())))
-				msg.Conn.Close()
-			}
-		case ClientDisconnected:
-			addr := msg.Conn.RemoteAddr().(*net.TCPAddr)
-			log.Printf("Client %s disconnected", sensitive(addr.String()));
-			delete(clients, addr.String())
-		case NewMessage:
-			authorAddr := msg.Conn.RemoteAddr().(*net.TCPAddr)
-			author := clients[authorAddr.String()]
-			now := time.Now()
-			if author != nil {
-				if now.Sub(author.LastMessage).Seconds() >= MessageRate {
-					if utf8.ValidString(msg.Text) {
-						author.LastMessage = now
-						author.StrikeCount = 0
-						log.Printf("Client %s sent message %s", sensitive(authorAddr.String()), msg.Text);
-						for _, client := range clients {
-							if client.Conn.RemoteAddr().String() != authorAddr.String() {
-								client.Conn.Write([]byte(msg.Text))
-							}
-						}
-					} else {
-						author.StrikeCount += 1
-						if author.StrikeCount >= StrikeLimit {
-							bannedMfs[authorAddr.IP.String()] = now
-							author.Conn.Write([]byte("You are banned MF\n"))
-							author.Conn.Close()
-						}
-					}
-				} else {
-					author.StrikeCount += 1
-					if author.StrikeCount >= StrikeLimit {
-						bannedMfs[authorAddr.IP.String()] = now
-						author.Conn.Write([]byte("You are banned MF\n"))
-						author.Conn.Close()
-					}
-				}
-			} else {
-				msg.Conn.Close()
+				continue
 			}
+		} else {
+			select {
+			case msg = <- messages:
+			case now := <-idle.C:
+				s.disconnectIdle(now)
+				s.expireHistory(now)
+				continue
+			case now := <-banCleanup.C:
+				s.expireBans(now)
+				s.forgetLogins(now)
+				continue
+			case <-ctx.Done():
+				s.close()
+				return
+			}
+		}
+		// Counting the message just received as well
+		if depth := len(messages) + 1 + s.pending.Len(); depth > s.stats.PeakDepth {
+			s.stats.PeakDepth = depth
+		}
+		if msg.Type == NewMessage && s.cfg.FairShare > 0 {
+			if dropped := s.pending.Push(msg, s.cfg.FairQueue); dropped > 0 {
+				s.drop(msg, dropped)
+			}
+			continue
+		}
+		// The last words of a client come before its ClientDisconnected
+		// in the channel, they'd be lost waiting for their round once the
+		// client is gone
+		if msg.Type == ClientDisconnected {
+			for _, queued := range s.pending.Take(msg.ConnID) {
+				s.dispatch(ctx, queued, idle, banCleanup)
+			}
+		}
+		s.dispatch(ctx, msg, idle, banCleanup)
+	}
+}
+
+// dispatch processes the message and keeps server() running after it
+func (s *Server) dispatch(ctx context.Context, msg Message, idle, banCleanup *time.Ticker) {
+	if s.processMessage(ctx, msg) && s.panics.Exceeded(s.cfg.MaxPanics) {
+		slog.Error("The server keeps panicking, shutting down", "event", "panic", "max_panics", s.cfg.MaxPanics)
+		s.shutdown()
+	}
+	if msg.Type == ConfigReloaded {
+		idle.Reset(idleCheckInterval(s.cfg.IdleTimeout))
+		banCleanup.Reset(banCleanupInterval(s.cfg.BanLimit))
+	}
+}
+
+// drop tells the sender its message didn't fit in its FairQueue, once for
+// all the ones dropped in a row
+func (s *Server) drop(msg Message, dropped int) {
+	s.stats.Dropped += 1
+	client := s.clients[msg.ConnID]
+	if client == nil || dropped > 1 {
+		return
+	}
+	client.log.Info("Client sends faster than the server broadcasts, dropping its messages", "event", "fair_drop", "queue", s.cfg.FairQueue)
+	client.Send(s.notice("busy_dropped", CatalogData{Count: dropped}))
+}
+
+// close lets go of the clients and the files when server() stops
+func (s *Server) close() {
+	// The client goroutines leave the connections of the clients set up
+	// to server(), to be hung up on here. All at once, so the dead peers
+	// wait for byeTimeout together.
+	var wg sync.WaitGroup
+	for _, client := range s.clients {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			hangUp(conn, ByeShutdown, shutdownRetryAfter)
+		}(client.Conn)
+	}
+	wg.Wait()
+	if s.transcript != nil {
+		s.transcript.Close()
+	}
+	if s.accounts != nil {
+		s.accounts.Close()
+	}
+	if s.historyDB != nil {
+		s.historyDB.Close()
+	}
+	if s.audit.file != nil {
+		s.audit.file.Close()
+	}
+}
+
+// processMessage handles one message for server(). A panic in there is
+// logged and doesn't take the server down, true tells it happened.
+func (s *Server) processMessage(ctx context.Context, msg Message) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Server panic", "event", "panic", "type", msg.Type.String(), "client", s.messageClient(msg), "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			s.panics.Add(s.now())
+			s.stats.Panics += 1
+			totalPanics.Add(1)
+			panicked = true
+		}
+	}()
+	var err error
+	switch msg.Type {
+	case ClientConnected:
+		err = s.handleClientConnected(msg)
+	case ClientDisconnected:
+		s.handleClientDisconnected(msg)
+	case NewMessage:
+		err = s.handleNewMessage(msg)
+	case ConfigReloaded:
+		s.applyConfig(*msg.Config, msg.Bans)
+		s.syncRelays(ctx)
+		s.syncWebhook(ctx)
+		s.audit.Record(AuditEntry{
+			Time: s.now(),
+			Actor: msg.Actor,
+			Action: "reload",
+		})
+	case StatusReport:
+		s.report()
+	case QueryStats:
+		// Buffered by queryStats, a caller that gave up doesn't block us
+		msg.Reply <- s.snapshot()
+	case RelayReceived:
+		s.receiveRelayed(msg.Text, s.now())
+	case AuthChecked:
+		if client := s.clients[msg.ConnID]; client != nil {
+			s.authChecked(client, msg.Granted, s.now())
+		}
+	case AccountChecked:
+		if client := s.clients[msg.ConnID]; client != nil {
+			s.accountChecked(client, *msg.Account, s.now())
+		}
+	case ExportFinished:
+		s.exporting = false
+		if client := s.clients[msg.ConnID]; client != nil {
+			client.Write(msg.Text)
+		}
+	}
+	if err != nil {
+		logger := slog.Default().With("conn", msg.ConnID)
+		if client := s.clients[msg.ConnID]; client != nil {
+			logger = client.log
+		}
+		logger.Debug("Message turned down", "event", "rejected", "type", msg.Type.String(), "err", err)
+	}
+	return false
+}
+
+// messageClient identifies the client a message is about for the log, by
+// its correlation ID when it's known. It must not panic itself, whatever
+// the message.
+func (s *Server) messageClient(msg Message) string {
+	if client := s.clients[msg.ConnID]; client != nil {
+		return client.CorrelationID
+	}
+	if msg.Conn == nil {
+		return ""
+	}
+	return s.cfg.sensitive(clientKey(msg.Conn))
+}
+
+// newCorrelationID returns a random version 4 UUID
+func newCorrelationID() string {
+	var id [16]byte
+	// crypto/rand never fails on the supported platforms
+	rand.Read(id[:])
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+// One content strike is forgiven for every this long the client goes
+// without a new one, whatever it sends in the meantime
+const contentStrikeDecay = 10*time.Minute
+
+// strike counts a violation of the rule against the client and bans it
+// once it has too many. Only for what looks like abuse, sending too fast
+// is slowDown.
+func (s *Server) strike(author *Client, rule string, now time.Time) {
+	if forgiven := int(now.Sub(author.LastStrike) / contentStrikeDecay); forgiven > 0 {
+		author.ContentStrikes = max(author.ContentStrikes-forgiven, 0)
+	}
+	author.LastStrike = now
+	author.ContentStrikes += 1
+	s.stats.Strikes += 1
+	totalStrikes.Add(1)
+	author.log.Info("Client got a strike", "event", "strike", "client", s.cfg.sensitive(clientKey(author.Conn)), "strikes", author.ContentStrikes, "rule", rule)
+	securityEvent("strike", rule, s.cfg.sensitive(clientKey(author.Conn)), "cid", author.CorrelationID, "strikes", author.ContentStrikes, "limit", s.cfg.StrikeLimit)
+	if author.ContentStrikes >= s.cfg.StrikeLimit {
+		s.ban(AutoStrikeLimit, clientIP(author.Conn), "too many content strikes, the last for "+rule, now)
+	}
+}
+
+// Doubling from the message rate, a cooldown gets too long to matter well
+// before the shift overflows
+const maxCooldownShift = 20
+
+// slowDown counts a message sent too fast against the client. It doesn't
+// lead to a ban, every strike in a row puts the client on a cooldown twice
+// as long as the previous one instead, from the message rate up to the ban
+// duration.
+func (s *Server) slowDown(author *Client, rate time.Duration, now time.Time) {
+	author.RateLimitStrikes += 1
+	s.stats.Strikes += 1
+	totalStrikes.Add(1)
+	cooldown := min(rate<<min(author.RateLimitStrikes-1, maxCooldownShift), s.cfg.BanLimit)
+	author.CooldownUntil = now.Add(cooldown)
+	author.log.Info("Client got a rate limit strike", "event", "strike", "client", s.cfg.sensitive(clientKey(author.Conn)), "strikes", author.RateLimitStrikes, "rule", "rate_limit", "cooldown", cooldown.String())
+	securityEvent("strike", "rate_limit", s.cfg.sensitive(clientKey(author.Conn)), "cid", author.CorrelationID, "strikes", author.RateLimitStrikes, "cooldown", cooldown.String())
+}
+
+// ban is the only way to ban an IP, so every ban ends up in the audit log
+// no matter whether the server or an admin issued it
+func (s *Server) ban(actor string, ip string, reason string, now time.Time) {
+	s.bannedMfs[ip] = now
+	securityEvent("ban", reason, s.cfg.sensitive(ip), "actor", actor, "duration", s.cfg.BanLimit.String())
+	s.stats.Bans += 1
+	totalBans.Add(1)
+	s.saveBans()
+	s.audit.Record(AuditEntry{
+		Time: now,
+		Actor: actor,
+		Action: "ban",
+		Target: s.cfg.sensitive(ip),
+		Duration: s.cfg.BanLimit,
+		Reason: reason,
+	})
+	for _, client := range s.clients {
+		if clientIP(client.Conn) == ip {
+			client.log.Info("Client got banned", "event", "ban", "client", s.cfg.sensitive(clientKey(client.Conn)), "duration", s.cfg.BanLimit.String())
+			s.tell(client, "banned", CatalogData{Text: reason})
+			hangUp(client.Conn, ByeBanned, s.cfg.BanLimit)
 		}
 	}
 }
 
-func client(conn net.Conn, messages chan Message) {
-	buffer := make([]byte, 64)
+func (s *Server) unban(actor string, ip string, reason string, now time.Time) {
+	delete(s.bannedMfs, ip)
+	s.saveBans()
+	s.audit.Record(AuditEntry{
+		Time: now,
+		Actor: actor,
+		Action: "unban",
+		Target: s.cfg.sensitive(ip),
+		Reason: reason,
+	})
+}
+
+func (s *Server) saveBans() {
+	if s.cfg.BanFile == "" {
+		return
+	}
+	if err := saveBans(s.cfg.BanFile, s.bannedMfs); err != nil {
+		slog.Error("Could not save the ban list", "path", s.cfg.BanFile, "err", err)
+	}
+}
+
+func (s *Server) applyConfig(cfg Config, bans map[string]time.Time) {
+	next, restart := s.cfg.reloaded(cfg)
+	for _, field := range restart {
+		slog.Warn("Changing the setting requires restart, keeping the old value", "event", "reload", "setting", field)
+	}
+	// Leave a level set with :loglevel or SIGUSR1 alone unless the
+	// configuration actually asks for a different one
+	if next.LogLevel != s.cfg.LogLevel {
+		setLogLevel(next)
+	}
+	// Same for a :slowmode
+	if next.SlowMode != s.cfg.SlowMode {
+		s.slowMode = next.SlowMode
+	}
+	if next.HistorySize != s.cfg.HistorySize || next.HistoryLimit != s.cfg.HistoryLimit {
+		s.history.Resize(next.HistorySize, next.HistoryLimit)
+	}
+	if next.Bandwidth != s.cfg.Bandwidth {
+		for _, client := range s.clients {
+			client.budget = newBudget(next.Bandwidth)
+		}
+	}
+	// The file is the truth, an edit may have lifted bans as well as added
+	// some
+	if bans != nil {
+		s.bannedMfs = bans
+		slog.Info("Reloaded the ban list", "event", "reload", "bans", len(bans))
+	}
+	s.cfg = next
+	slog.Info("Applied the reloaded configuration", "event", "reload")
+	s.announceLimits()
+
+	if motd := s.files.Motd.Text(); motd != s.motd {
+		s.motd = motd
+		s.broadcast(s.notice("motd_updated", CatalogData{}))
+	}
+}
+
+func (s *Server) transcribe(author *Client, text string, now time.Time) {
+	s.record(s.cfg.sensitive(clientKey(author.Conn)), author.Room, text, now)
+}
+
+// record puts a message into the history and the transcript
+func (s *Server) record(sender string, room string, text string, now time.Time) {
+	entry := transcript.Entry{
+		Time: now,
+		ID: s.msgIDs.Next(),
+		Sender: sender,
+		Room: room,
+		Text: text,
+	}
+	s.history.Push(entry)
+	if s.historyDB != nil {
+		s.historyDB.Insert(entry)
+	}
+	if s.webhook != nil {
+		s.webhook.Send(entry)
+	}
+	if s.transcript == nil {
+		return
+	}
+	if err := s.transcript.Write(entry); err != nil {
+		slog.Error("COULD NOT WRITE THE TRANSCRIPT, TRANSCRIPTING IS DISABLED", "event", "transcript", "path", s.cfg.TranscriptPath, "err", err)
+		s.transcript.Close()
+		s.transcript = nil
+	}
+}
+
+// nextSeq numbers a chat line about to be delivered, see Line.Seq
+func (s *Server) nextSeq() uint64 {
+	s.seq += 1
+	return s.seq
+}
+
+// broadcast sends the line to every client, see Client.Write for the order
+// they get it in
+func (s *Server) broadcast(line Line) {
+	render := renderer(line)
+	for _, client := range s.clients {
+		text := render(client.Format)
+		client.Write(text)
+		s.stats.BytesBroadcast += len(text)
+	}
+}
+
+func client(ctx context.Context, cfg Config, catalog *CatalogFile, conn net.Conn, id ConnID, messages chan Message, admitted chan struct{}) {
+	// An expired deadline wakes up the blocked Read on shutdown. Only the
+	// read one, server() still has a BYE to write.
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+	// Without its ClientDisconnected the client would stay in server() as
+	// a ghost nobody can reach or clean up
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Client goroutine panic", "event", "panic", "conn", id, "client", cfg.sensitive(clientKey(conn)), "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			totalPanics.Add(1)
+			hangUp(conn, ByeServerError, 0)
+			select {
+			case messages <- Message{
+				Type: ClientDisconnected,
+				Conn: conn,
+				ConnID: id,
+			}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	// A message is a line. TCP may cut one line into several reads, or put
+	// several lines into one, so nothing goes to server() before its
+	// newline.
+	reader := bufio.NewReaderSize(conn, cfg.ReadBufSize)
+	// A TLS client dialed the plaintext port by mistake. It would never
+	// send a line, better tell it right away.
+	if _, isTLS := asTLS(conn); !isTLS && looksLikeTLS(reader) {
+		slog.Info("Client started a TLS handshake on the plaintext port", "event", "tls_on_plaintext", "conn", id, "client", cfg.sensitive(clientKey(conn)))
+		writeWithTimeout(conn, []byte(render(catalog.Notice("tls_on_plaintext", CatalogData{}), PlainOutput)), writeTimeout)
+		hangUp(conn, ByeProtocol, 0)
+		select {
+		case messages <- Message{
+			Type: ClientDisconnected,
+			Conn: conn,
+			ConnID: id,
+		}:
+		case <-ctx.Done():
+		}
+		return
+	}
+	var line []byte
 	for {
-		n, err := conn.Read(buffer)
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		// Whatever arrives proves the connection alive, so the deadline
+		// starts over. Until server() sets the client up the handshake
+		// deadline applies instead.
+		if len(chunk) > 0 && cfg.ReadDeadline > 0 {
+			select {
+			case <-admitted:
+				conn.SetReadDeadline(time.Now().Add(cfg.ReadDeadline))
+			default:
+			}
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			if len(line) > maxClientLine {
+				slog.Warn("Client sent a line that is too long, disconnecting it", "event", "line_overflow", "conn", id, "client", cfg.sensitive(clientKey(conn)), "bytes", len(line))
+				hangUp(conn, ByeLineTooLong, 0)
+				select {
+				case messages <- Message{
+					Type: ClientDisconnected,
+					Conn: conn,
+					ConnID: id,
+				}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			continue
+		}
 		if err != nil {
-			conn.Close();
-			messages <- Message{
+			// server() is shutting down and hangs up on the clients it set
+			// up, the others are this goroutine's to close
+			if ctx.Err() != nil {
+				select {
+				case <-admitted:
+				default:
+					hangUp(conn, ByeShutdown, shutdownRetryAfter)
+				}
+				return
+			}
+			// A read deadline running out only means the client had
+			// nothing to say, the idle timeout of server() decides when
+			// that is too long. A connection that silently went away is
+			// caught by the TCP keepalive instead, whose ETIMEDOUT says
+			// Timeout() too, hence no net.Error check here.
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				select {
+				case <-admitted:
+					readTimeouts.Add(1)
+					if cfg.ReadDeadline > 0 {
+						conn.SetReadDeadline(time.Now().Add(cfg.ReadDeadline))
+					} else {
+						conn.SetReadDeadline(time.Time{})
+					}
+					continue
+				default:
+					// Not the client's fault as far as we know, so no
+					// strike, but it doesn't get to hold a slot either
+					slog.Info("Client did not finish the handshake in time", "event", "handshake", "conn", id, "client", cfg.sensitive(clientKey(conn)), "deadline", cfg.HandshakeDeadline.String())
+					hangUp(conn, ByeHandshake, 0)
+				}
+			}
+			// Otherwise the peer hung up or broke the connection, nobody
+			// is there to say goodbye to
+			conn.Close()
+			select {
+			case messages <- Message{
 				Type: ClientDisconnected,
 				Conn: conn,
+				ConnID: id,
+			}:
+			case <-ctx.Done():
 			}
 			return
 		}
-		text := string(buffer[0:n])
-		messages <- Message{
+		text := string(line)
+		line = line[:0]
+		select {
+		case messages <- Message{
 			Type: NewMessage,
 			Text: text,
 			Conn: conn,
+			ConnID: id,
+			ReceivedAt: time.Now(),
+		}:
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func main() {
-	ln, err := net.Listen("tcp", ":"+Port)
-	if err != nil {
-		log.Fatalf("Could not listen to epic port %s: %s\n", Port, sensitive(err.Error()))
+// admit takes a client slot unless the server is full. Compare-and-swap
+// keeps concurrent accepts from overshooting the limit.
+func admit(connected *atomic.Int32, max int) bool {
+	for {
+		n := connected.Load()
+		if max > 0 && int(n) >= max {
+			return false
+		}
+		if connected.CompareAndSwap(n, n+1) {
+			return true
+		}
 	}
-	log.Printf("Listening to TCP connections on port %s ...\n", Port);
+}
 
-	messages := make(chan Message)
-	go server(messages)
+// Between the TCP keepalive probes of the client connections. Linux gives
+// up after 9 unanswered ones, about two and a half minutes.
+const keepAlivePeriod = 15*time.Second
+
+// How long accept waits after a failed Accept, doubled on every failure in
+// a row
+const (
+	minAcceptBackoff = 5*time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// temporaryAcceptError tells the Accept errors that go away on their own,
+// like running out of file descriptors, from a broken listener
+func temporaryAcceptError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED, syscall.ECONNRESET} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var temporary interface{ Temporary() bool }
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout() || errors.As(err, &temporary) && temporary.Temporary()
+}
+
+// accept runs until ctx is done or the listener breaks, the error of the
+// listener is returned in the latter case
+func accept(ctx context.Context, cfg Config, catalog *CatalogFile, ln net.Listener, connected *atomic.Int32, messages chan Message) error {
+	stop := context.AfterFunc(ctx, func() {
+		ln.Close()
+	})
+	defer stop()
 
+	limiter := rate.NewLimiter(rate.Limit(cfg.ConnRate), cfg.ConnBurst)
+	var backoff time.Duration
+	// The same error logged thousands of times a second helps nobody
+	var lastLogged time.Time
+	suppressed := 0
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("Could not accept a connection: %s\n", sensitive(err.Error()))
+			if ctx.Err() != nil {
+				return nil
+			}
+			if !temporaryAcceptError(err) {
+				return err
+			}
+			backoff = min(max(2*backoff, minAcceptBackoff), maxAcceptBackoff)
+			if time.Since(lastLogged) >= time.Second {
+				slog.Error("Could not accept a connection, backing off", "event", "accept", "err", cfg.sensitive(err.Error()), "backoff", backoff.String(), "suppressed", suppressed)
+				lastLogged = time.Now()
+				suppressed = 0
+			} else {
+				suppressed += 1
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil
+			}
 			continue
 		}
-		messages <- Message{
-			Type: ClientConnected,
-			Conn: conn,
+		backoff = 0
+		// Everything past here, server() included, sees the safeConn
+		conn = &safeConn{Conn: conn}
+		// Dropping right away instead of waiting keeps a connection flood
+		// from piling up ClientConnected events in front of server()
+		if !limiter.Allow() {
+			securityEvent("rejected", "connrate", cfg.sensitive(clientKey(conn)))
+			var retryAfter time.Duration
+			if cfg.ConnRate > 0 {
+				retryAfter = time.Duration(float64(time.Second)/cfg.ConnRate)
+			}
+			hangUp(conn, ByeConnRate, retryAfter)
+			continue
 		}
-		go client(conn, messages)
+		// Every admitted connection is released by its ClientDisconnected
+		if !admit(connected, cfg.MaxClients) {
+			securityEvent("rejected", "maxclients", cfg.sensitive(clientKey(conn)))
+			writeWithTimeout(conn, []byte(catalog.Render("server_full", CatalogData{})+"\n"), byeTimeout)
+			hangUp(conn, ByeFull, fullRetryAfter)
+			continue
+		}
+		// A client can't hold its slot by handshaking slowly, server()
+		// lifts the deadline once the client is set up
+		if cfg.HandshakeDeadline > 0 {
+			conn.SetDeadline(time.Now().Add(cfg.HandshakeDeadline))
+		}
+		id := nextConnID()
+		if tlsConn, ok := asTLS(conn); ok {
+			// Handshaking before ClientConnected lets server() see the client
+			// certificate, and doing it here keeps a slow handshake from
+			// holding up either the accept loop or server()
+			go func() {
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					slog.Debug("TLS handshake failed", "event", "handshake", "client", cfg.sensitive(clientKey(conn)), "err", cfg.sensitive(err.Error()))
+					release(conn, connected, ByeProtocol)
+					return
+				}
+				if admitted, ok := connect(ctx, conn, id, connected, messages); ok {
+					client(ctx, cfg, catalog, conn, id, messages, admitted)
+				}
+			}()
+			continue
+		}
+		admitted, ok := connect(ctx, conn, id, connected, messages)
+		if !ok {
+			return nil
+		}
+		go client(ctx, cfg, catalog, conn, id, messages, admitted)
+	}
+}
+
+// connect introduces an admitted connection to server(), or releases it
+// and returns false when the server is shutting down. The channel is
+// closed once server() has set the client up.
+func connect(ctx context.Context, conn net.Conn, id ConnID, connected *atomic.Int32, messages chan Message) (chan struct{}, bool) {
+	admitted := make(chan struct{})
+	select {
+	case messages <- Message{
+		Type: ClientConnected,
+		Conn: conn,
+		ConnID: id,
+		Admitted: admitted,
+	}:
+		return admitted, true
+	case <-ctx.Done():
+		release(conn, connected, ByeShutdown)
+		return nil, false
+	}
+}
+
+// release gives back the slot of an admitted connection that never made it
+// to server() and hangs up on it with the code
+func release(conn net.Conn, connected *atomic.Int32, code ByeCode) {
+	connected.Add(-1)
+	retryAfter := time.Duration(0)
+	if code == ByeShutdown {
+		retryAfter = shutdownRetryAfter
+	}
+	hangUp(conn, code, retryAfter)
+}
+
+// listenError tells apart the reasons for not being able to bind a port
+// that need different fixes from the operator
+func listenError(port string, err error) string {
+	var addrErr *net.AddrError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		return fmt.Sprintf("port %s is already in use", port)
+	case errors.Is(err, syscall.EACCES):
+		return fmt.Sprintf("permission denied, ports below 1024 usually require root: %s", err)
+	case errors.As(err, &addrErr), errors.As(err, &dnsErr):
+		return fmt.Sprintf("invalid port %q", port)
+	}
+	return err.Error()
+}
+
+// listen binds the port, or when it's taken one of the next retries ports.
+// Port 0 picks an ephemeral one. The port actually bound is returned.
+func listen(port string, retries int) (net.Listener, string, error) {
+	first, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, "", err
+	}
+	// The keepalive is what notices a client whose network went away
+	// without a word, the read fails then and the client is disconnected
+	lc := net.ListenConfig{KeepAlive: keepAlivePeriod}
+	for i := 0; ; i++ {
+		try := strconv.Itoa(first + i)
+		ln, err := lc.Listen(context.Background(), "tcp", ":"+try)
+		if err == nil {
+			return ln, strconv.Itoa(ln.Addr().(*net.TCPAddr).Port), nil
+		}
+		if first == 0 || i >= retries || !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, "", err
+		}
+		slog.Warn("Port is already in use, trying the next one", "port", try)
+	}
+}
+
+func checkPort(port string) int {
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Port %s is not available: %s\n", port, listenError(port, err))
+		return 1
+	}
+	ln.Close()
+	fmt.Printf("Port %s is available\n", port)
+	return 0
+}
+
+// dryrun goes through the same checks the real startup does but reports
+// every failure instead of stopping at the first one
+func dryrun(cfg Config) int {
+	errs := runChecks(startupChecks(cfg), func(startupCheck, error) {})
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		fmt.Println(string(data))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// configFlags binds the flags of the settings to the fields of cfg, with
+// their current values as the defaults
+func configFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.Port, "port", cfg.Port, "Port to listen to")
+	fs.IntVar(&cfg.PortRetry, "port-retry", cfg.PortRetry, "Number of the following ports to try when the port is taken, see the log for the one bound. -port 0 picks any free port.")
+	fs.StringVar(&cfg.SafeMode, "safe-mode", cfg.SafeMode, "How client addresses and errors are logged: off, redact, or hash to log a short HMAC that stays the same for the same client")
+	fs.StringVar(&cfg.SafeModeKey, "safe-mode-key", cfg.SafeModeKey, "Key for the hash safe mode, a random one is generated on every start when empty")
+	fs.DurationVar(&cfg.MessageRate, "message-rate", cfg.MessageRate, "Minimal interval between two messages of a client")
+	fs.DurationVar(&cfg.SlowMode, "slowmode", cfg.SlowMode, "Server wide slow mode, raises the minimal interval between messages of every client to this, 0 disables it")
+	fs.DurationVar(&cfg.BanLimit, "ban-limit", cfg.BanLimit, "How long a banned client stays banned")
+	fs.IntVar(&cfg.StrikeLimit, "strike-limit", cfg.StrikeLimit, "Number of strikes before a client gets banned")
+	fs.IntVar(&cfg.MaxClients, "maxclients", cfg.MaxClients, "Maximum number of connected clients, 0 means unlimited")
+	fs.Var((*stringList)(&cfg.RelayAddrs), "relay", "Comma separated addresses of the servers to relay the messages to and from")
+	fs.Var((*stringList)(&cfg.TrustedProxies), "trusted-proxies", "Comma separated CIDRs of the reverse proxies whose X-Forwarded-For or Forwarded headers name the client")
+	fs.StringVar(&cfg.RelayAuthToken, "relaytoken", cfg.RelayAuthToken, "Token the relays authenticate with, the same on every server. Empty refuses the relays dialing in.")
+	fs.IntVar(&cfg.MaxPanics, "maxpanics", cfg.MaxPanics, "Shut down once the server panicked this many times within a minute, 0 never gives up")
+	fs.StringVar(&cfg.MsgIDType, "msgid", cfg.MsgIDType, "How the messages are numbered in the transcript and the history: sequence, or uuid to make the IDs unpredictable")
+	fs.StringVar(&cfg.WebhookURL, "webhook", cfg.WebhookURL, "URL to post every message to as JSON")
+	fs.StringVar(&cfg.WebhookSecret, "webhooksecret", cfg.WebhookSecret, "Sign the webhook posts with HMAC-SHA256 in the X-Signature header")
+	fs.Var((*headerMap)(&cfg.WebhookHeaders), "webhookheader", "Header to send with the webhook posts, \"Name: value\", may be repeated")
+	fs.IntVar(&cfg.MaxRoomSize, "maxroomsize", cfg.MaxRoomSize, "Maximum number of members in a room, 0 means unlimited")
+	fs.IntVar(&cfg.MaxRooms, "maxrooms", cfg.MaxRooms, "Maximum number of rooms, 0 means unlimited. Admins may create more, up to 1000.")
+	fs.IntVar(&cfg.ReadBufSize, "readbufsize", cfg.ReadBufSize, "Size of the per-client read buffer in bytes")
+	fs.IntVar(&cfg.FairShare, "fairshare", cfg.FairShare, "Messages of every client broadcast per round when the server falls behind, 0 broadcasts them in the order they arrive in")
+	fs.IntVar(&cfg.Bandwidth, "bandwidth", cfg.Bandwidth, "Bytes per second of messages of the other clients each client gets at most, the ones over it are skipped and summed up, 0 means unlimited")
+	fs.IntVar(&cfg.FairQueue, "fairqueue", cfg.FairQueue, "Messages of a client waiting for their round before the following ones are dropped")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Minimal level of the logged events: debug, info, warn or error")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Format of the log: text or json")
+	fs.StringVar(&cfg.LogFile, "log-file", cfg.LogFile, "Write the log to this file instead of stderr")
+	fs.IntVar(&cfg.LogMaxSize, "log-max-size", cfg.LogMaxSize, "Size in megabytes after which the log file is rotated, 0 disables the rotation")
+	fs.IntVar(&cfg.LogMaxFiles, "log-max-files", cfg.LogMaxFiles, "Number of rotated log files to keep")
+	fs.StringVar(&cfg.LogRotate, "log-rotate", cfg.LogRotate, "How the log file is rotated: size, or daily to start a new file every day")
+	fs.StringVar(&cfg.SecurityLog, "security-log", cfg.SecurityLog, "Also log the strikes, bans, failed authentications and rejected connections to this file as JSON lines")
+	fs.IntVar(&cfg.LogKeep, "logkeep", cfg.LogKeep, "Days to keep the daily rotated log files, 0 keeps them all")
+	fs.StringVar(&cfg.BanFile, "banfile", cfg.BanFile, "Persist the bans to this JSON file so they survive restarts")
+	fs.StringVar(&cfg.LetsEncrypt, "letsencrypt", cfg.LetsEncrypt, "Comma separated domains to serve TLS for with certificates from Let's Encrypt")
+	fs.StringVar(&cfg.LetsEncryptEmail, "letsencryptemail", cfg.LetsEncryptEmail, "Contact email for the Let's Encrypt account")
+	fs.StringVar(&cfg.CertCacheDir, "certcachedir", cfg.CertCacheDir, "Directory to keep the Let's Encrypt account and certificates in")
+	fs.StringVar(&cfg.AdminCA, "adminca", cfg.AdminCA, "PEM file with the CA whose client certificates make the TLS clients admins without :auth")
+	fs.StringVar(&cfg.DebugAddr, "debugaddr", cfg.DebugAddr, "Serve expvar at /debug/vars and pprof at /debug/pprof/ on this address, e.g. localhost:8080")
+	fs.StringVar(&cfg.ExportDir, "exportdir", cfg.ExportDir, "Directory the :export command writes to")
+	fs.StringVar(&cfg.HistoryDB, "history-db", cfg.HistoryDB, "Keep every message in this SQLite database, searchable with :search")
+	fs.StringVar(&cfg.AccountsDB, "accounts-db", cfg.AccountsDB, "Keep the accounts of :register in this SQLite database, accounts are disabled when empty")
+	fs.BoolVar(&cfg.TopicAdminOnly, "topic-admin-only", cfg.TopicAdminOnly, "Allow only the admins to set the room topics, not the room creators")
+	fs.BoolVar(&cfg.SearchAdminOnly, "search-admin-only", cfg.SearchAdminOnly, "Allow only the admins to use :search")
+	fs.DurationVar(&cfg.RetentionDuration, "retention", cfg.RetentionDuration, "Stop replaying the messages from the history after this long, 0 keeps them as long as they fit")
+	fs.IntVar(&cfg.HistorySize, "historysize", cfg.HistorySize, "Number of recent messages of a room replayed to the clients that join it, 0 disables the history")
+	fs.IntVar(&cfg.HistoryLimit, "historylimit", cfg.HistoryLimit, "Number of messages kept in the history of all the rooms together, the least recently active rooms lose theirs first, 0 means unlimited")
+	fs.DurationVar(&cfg.IdleTimeout, "idletimeout", cfg.IdleTimeout, "Disconnect the clients which haven't sent anything for this long, 0 disables it")
+	fs.DurationVar(&cfg.NickInterval, "nickinterval", cfg.NickInterval, "Least time between two nick changes of a client, its first nick is free, 0 disables the limit")
+	fs.DurationVar(&cfg.ReadDeadline, "readdeadline", cfg.ReadDeadline, "Wake up the goroutine of a client that sent nothing for this long to check on its connection, 0 disables it")
+	fs.DurationVar(&cfg.HandshakeDeadline, "handshakedeadline", cfg.HandshakeDeadline, "Disconnect the connections which aren't set up this long after being accepted, TLS handshake included, 0 disables it")
+	fs.DurationVar(&cfg.StatusInterval, "status-interval", cfg.StatusInterval, "How often to log a status line with the server counters, 0 disables it")
+	fs.StringVar(&cfg.AuditFile, "auditfile", cfg.AuditFile, "Append every moderation action to this file as a JSON line")
+	fs.IntVar(&cfg.AuditSize, "auditsize", cfg.AuditSize, "Number of moderation actions kept in memory for the :audit command")
+	fs.StringVar(&cfg.TranscriptPath, "transcript", cfg.TranscriptPath, "Append every broadcast message to this file as a JSON line, see cmd/transcript-dump")
+	fs.StringVar(&cfg.WordlistPath, "wordlist", cfg.WordlistPath, "File with the phrases the clients may not use, one per line, # starts a comment")
+	fs.StringVar(&cfg.RegexFilterPath, "regexfilter", cfg.RegexFilterPath, "File with the regular expressions the messages may not match, one per line")
+	fs.StringVar(&cfg.MessagesPath, "messages", cfg.MessagesPath, "JSON file overriding the messages the server sends to the clients, by key")
+	fs.StringVar(&cfg.MotdPath, "motd", cfg.MotdPath, "File with the message of the day sent to every connected client")
+	fs.StringVar(&cfg.AdminPassword, "adminpassword", cfg.AdminPassword, "Password for the :auth command, preferably a bcrypt hash from -hashpassword, admin commands are disabled when empty")
+	fs.Float64Var(&cfg.ConnRate, "connrate", cfg.ConnRate, "Maximum rate of accepted connections per second")
+	fs.IntVar(&cfg.ConnBurst, "connburst", cfg.ConnBurst, "Burst capacity of the connection rate limiter")
+}
+
+func main() {
+	cfg := DefaultConfig()
+	configPath := flag.String("config", "", "JSON config file, its keys are the same as in the -dryrun output")
+	configFlags(flag.CommandLine, &cfg)
+	showVersion := flag.Bool("version", false, "Print the version and exit")
+	hashPassword := flag.Bool("hashpassword", false, "Read a password from the standard input, print its bcrypt hash and exit")
+	checkPortOnly := flag.Bool("checkport", false, "Check whether the port can be listened to and exit")
+	dryRun := flag.Bool("dryrun", false, "Validate the configuration, print it as JSON and exit")
+	checkOnly := flag.Bool("check", false, "Check everything the server needs to start, print a report and exit with 1 if anything is wrong")
+	benchClients := flag.Int("bench", 0, "Run a load test with N simulated clients instead of serving")
+	benchRate := flag.Float64("benchrate", 0.5, "Messages per second sent by each simulated client in the load test")
+	benchTime := flag.Duration("benchtime", 30*time.Second, "Duration of the load test")
+	benchSize := flag.Int("benchsize", 0, "Bytes in each message of the load test, padded if needed")
+	benchNoisy := flag.Int("benchnoisy", 0, "Number of the simulated clients which send at -benchnoisyrate instead")
+	benchNoisyRate := flag.Float64("benchnoisyrate", 20, "Messages per second sent by each noisy client in the load test")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	if *hashPassword {
+		os.Exit(hashPasswordFromStdin())
+	}
+
+	if err := Configure(&cfg, flag.CommandLine, *configPath); err != nil {
+		fatal("Could not load the configuration", "err", err)
+	}
+
+	if *checkPortOnly {
+		os.Exit(checkPort(cfg.Port))
+	}
+
+	if *dryRun {
+		os.Exit(dryrun(cfg))
+	}
+
+	if *checkOnly {
+		os.Exit(check(cfg))
+	}
+
+	if err := cfg.Validate(); err != nil {
+		fatal("Invalid configuration", "err", err)
+	}
+	if err := setupLogging(cfg); err != nil {
+		fatal("Could not set up logging", "err", err)
+	}
+	if err := setupSecurityLog(cfg); err != nil {
+		fatal("Could not open the security log", "path", cfg.SecurityLog, "err", err)
+	}
+	if err := hashPasswords(&cfg); err != nil {
+		fatal("Invalid configuration", "err", err)
+	}
+
+	if *benchClients > 0 {
+		if *benchRate <= 0 {
+			fatal("-benchrate must be positive", "benchrate", *benchRate)
+		}
+		if *benchSize > maxMessageSize {
+			fatal("-benchsize is more than a message may have", "benchsize", *benchSize, "max", maxMessageSize)
+		}
+		if *benchNoisy > 0 && *benchNoisyRate <= 0 {
+			fatal("-benchnoisyrate must be positive", "benchnoisyrate", *benchNoisyRate)
+		}
+		bench(cfg, *benchClients, *benchRate, *benchSize, *benchNoisy, *benchNoisyRate, *benchTime)
+		return
+	}
+
+	files := &Files{}
+	if _, errs := files.Load(cfg); len(errs) > 0 {
+		for _, err := range errs {
+			slog.Error("Could not load a file", "err", err)
+		}
+		fatal("Could not load the configured files")
+	}
+
+	ln, port, err := listen(cfg.Port, cfg.PortRetry)
+	if err != nil {
+		fatal("Could not listen to epic port", "port", cfg.Port, "err", cfg.sensitive(listenError(cfg.Port, err)))
+	}
+	listenPort.Set(port)
+	if cfg.LetsEncrypt != "" {
+		tlsConfig := letsEncryptConfig(cfg)
+		if cfg.AdminCA != "" {
+			tlsConfig.ClientCAs, err = loadCertPool(cfg.AdminCA)
+			if err != nil {
+				fatal("Could not load the admin CA", "path", cfg.AdminCA, "err", err)
+			}
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	slog.Info("Starting " + versionString())
+	slog.Info("Listening to TCP connections", "port", port, "configured_port", cfg.Port, "tls", cfg.LetsEncrypt != "")
+
+	// SIGINT and SIGTERM shut the server down cleanly, cancel is for the
+	// shutdowns the server decides on its own
+	signaled, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancel(signaled)
+	defer cancel()
+	messages := make(chan Message)
+	running := cfg
+	reloader := &Reloader{
+		bound: &cfg,
+		flags: flag.CommandLine,
+		configPath: *configPath,
+		last: running,
+		files: files,
+		messages: messages,
+		requests: make(chan string, 1),
+	}
+	go reloader.Run(ctx)
+	go toggleDebugOnSignal(ctx)
+	s := NewServer(running, files)
+	s.reload = reloader.Request
+	s.shutdown = cancel
+	if running.AuditFile != "" {
+		s.audit.file, err = os.OpenFile(running.AuditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fatal("Could not open the audit file", "path", running.AuditFile, "err", err)
+		}
+	}
+	if bans := files.Bans.Take(); bans != nil {
+		s.bannedMfs = bans
+	}
+	if running.TranscriptPath != "" {
+		s.transcript, err = transcript.Open(running.TranscriptPath, 5*time.Second)
+		if err != nil {
+			fatal("Could not open the transcript", "path", running.TranscriptPath, "err", err)
+		}
+	}
+	if running.HistoryDB != "" {
+		s.historyDB, err = OpenHistoryDB(running.HistoryDB)
+		if err != nil {
+			fatal("Could not open the history database", "path", running.HistoryDB, "err", err)
+		}
+		// Picking up the replay on join where the previous run left it,
+		// the other rooms are picked up as they come, see reseedHistory
+		entries, err := s.historyDB.RecentIn(defaultRoom, running.HistorySize)
+		if err != nil {
+			fatal("Could not read the history database", "path", running.HistoryDB, "err", err)
+		}
+		for _, entry := range entries {
+			s.history.Push(entry)
+		}
+	}
+	if running.AccountsDB != "" {
+		s.accounts, err = OpenAccountDB(running.AccountsDB)
+		if err != nil {
+			fatal("Could not open the accounts database", "path", running.AccountsDB, "err", err)
+		}
+	}
+	if running.DebugAddr != "" {
+		if err := serveDebug(ctx, running.DebugAddr, messages); err != nil {
+			fatal("Could not start the debug server", "addr", running.DebugAddr, "err", err)
+		}
+		slog.Info("Serving debug endpoints", "addr", running.DebugAddr)
+	}
+	done := make(chan struct{})
+	go func() {
+		server(ctx, s, messages)
+		close(done)
+	}()
+	if running.StatusInterval > 0 {
+		go reportStatus(ctx, running.StatusInterval, messages)
+	}
+	// Only a broken listener, a signal or a shutdown from server() gets past
+	// accept, server() still gets to close the transcript and the databases
+	err = accept(ctx, running, &s.files.Catalog, ln, s.connected, messages)
+	if err != nil {
+		slog.Error("Could not accept connections anymore, shutting down", "event", "shutdown", "err", cfg.sensitive(err.Error()))
+	} else if signaled.Err() != nil {
+		slog.Info("Got a signal, shutting down", "event", "shutdown")
+	}
+	cancel()
+	<-done
+	if err != nil || signaled.Err() == nil {
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// MsgIDGenerator hands out the IDs of the messages, see -msgid
+type MsgIDGenerator interface {
+	Next() string
+}
+
+// SequenceIDGen numbers the messages 1, 2, 3... so a gap in the transcript
+// shows a message is missing
+type SequenceIDGen struct {
+	last atomic.Uint64
+}
+
+func (gen *SequenceIDGen) Next() string {
+	return strconv.FormatUint(gen.last.Add(1), 10)
+}
+
+// UUIDIDGen gives the messages random UUIDs nobody can predict
+type UUIDIDGen struct{}
+
+func (gen UUIDIDGen) Next() string {
+	return newCorrelationID()
+}
+
+func newMsgIDGenerator(kind string) MsgIDGenerator {
+	if kind == "uuid" {
+		return UUIDIDGen{}
+	}
+	return &SequenceIDGen{}
+}
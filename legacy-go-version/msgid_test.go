@@ -0,0 +1,59 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+	"testing"
+)
+
+func TestMsgIDsAreUniqueUnderConcurrentCalls(t *testing.T) {
+	const goroutines, perGoroutine = 8, 1000
+	for _, kind := range []string{"sequence", "uuid"} {
+		gen := newMsgIDGenerator(kind)
+		ids := make(chan string, goroutines*perGoroutine)
+		var wg sync.WaitGroup
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < perGoroutine; j++ {
+					ids <- gen.Next()
+				}
+			}()
+		}
+		wg.Wait()
+		close(ids)
+		seen := map[string]bool{}
+		for id := range ids {
+			if seen[id] {
+				t.Fatalf("%s: %q was handed out twice", kind, id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestMsgIDFormats(t *testing.T) {
+	seq := newMsgIDGenerator("sequence")
+	if first, second := seq.Next(), seq.Next(); first != "1" || second != "2" {
+		t.Errorf("the sequence starts with %q, %q", first, second)
+	}
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	if id := newMsgIDGenerator("uuid").Next(); !uuid.MatchString(id) {
+		t.Errorf("%q isn't a UUID v4", id)
+	}
+}
+
+func BenchmarkSequenceIDGen(b *testing.B) {
+	gen := newMsgIDGenerator("sequence")
+	for i := 0; i < b.N; i++ {
+		gen.Next()
+	}
+}
+
+func BenchmarkUUIDIDGen(b *testing.B) {
+	gen := newMsgIDGenerator("uuid")
+	for i := 0; i < b.N; i++ {
+		gen.Next()
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+const maxNickLength = 20
+
+func validNick(nick string) bool {
+	if len(nick) < 1 || len(nick) > maxNickLength {
+		return false
+	}
+	for _, c := range nick {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// clientDisplayName is how the client shows up to the others, in the
+// audit log and in the log: by its nick, or by its IP as the safe mode
+// allows until it has one
+func clientDisplayName(client *Client, cfg Config) string {
+	if client.Username != "" {
+		return client.Username
+	}
+	return cfg.sensitive(clientIP(client.Conn))
+}
+
+// findByNick looks the connected client up by its nick, ignoring the case
+func (s *Server) findByNick(nick string) *Client {
+	for _, client := range s.clients {
+		if client.Username != "" && strings.EqualFold(client.Username, nick) {
+			return client
+		}
+	}
+	return nil
+}
+
+// ignore keeps the chat of whoever has the nick now from reaching the
+// client, or lets it through again
+func (s *Server) ignore(client *Client, nick string, ignore bool) {
+	target := s.findByNick(nick)
+	if target == nil {
+		s.tell(client, "nobody", CatalogData{Nick: nick})
+		return
+	}
+	if target == client {
+		s.tell(client, "usage", CatalogData{Text: ":ignore <nick>, someone else's"})
+		return
+	}
+	if !ignore {
+		delete(client.Ignored, target.ID)
+		s.tell(client, "unignored", CatalogData{Nick: target.Username})
+		return
+	}
+	if client.Ignored == nil {
+		client.Ignored = map[ConnID]bool{}
+	}
+	client.Ignored[target.ID] = true
+	s.tell(client, "ignored", CatalogData{Nick: target.Username})
+}
+
+// nickWait tells how long the client has to wait before it may change
+// its nick again. Its first nick is free, and like the rate limit this
+// doesn't apply to the admins.
+func (s *Server) nickWait(client *Client, now time.Time) time.Duration {
+	if client.Username == "" || client.IsAdmin || s.cfg.NickInterval <= 0 {
+		return 0
+	}
+	return client.LastNickChange.Add(s.cfg.NickInterval).Sub(now)
+}
+
+// announceRename tells the others in the room of the client who it was
+// before, nothing else links the old nick to the new one
+func (s *Server) announceRename(client *Client, old string) {
+	render := renderer(s.notice("nick_changed", CatalogData{Text: old, Nick: client.Username}))
+	for _, member := range s.rooms[client.Room].Members {
+		if member != client {
+			text := render(member.Format)
+			member.Write(text)
+			s.stats.BytesBroadcast += len(text)
+		}
+	}
+}
+
+func (s *Server) setNick(client *Client, nick string, now time.Time) {
+	if !validNick(nick) {
+		s.tell(client, "usage", CatalogData{Text: ":nick <name>, the name is up to 20 letters, digits, - or _"})
+		return
+	}
+	if other := s.findByNick(nick); other != nil && other != client {
+		s.tell(client, "nick_taken", CatalogData{Nick: nick})
+		return
+	}
+	if s.accounts != nil && s.accounts.Registered(nick) && !strings.EqualFold(client.Account, nick) {
+		s.tell(client, "nick_registered", CatalogData{Nick: nick})
+		return
+	}
+	if wait := s.nickWait(client, now); wait > 0 {
+		client.nickRefused += 1
+		s.tell(client, "nick_wait", CatalogData{Wait: wait})
+		// One early try is impatience, trying again before the time is up
+		// is cycling through nicks
+		if client.nickRefused > 1 {
+			s.strike(client, "nick_rate", now)
+		}
+		return
+	}
+	client.log.Info("Client changed its nick", "event", "nick", "client", s.cfg.sensitive(clientKey(client.Conn)), "nick", nick)
+	old := clientDisplayName(client, s.cfg)
+	client.Username = nick
+	client.LastNickChange = now
+	client.nickRefused = 0
+	s.tell(client, "nick_set", CatalogData{Nick: nick})
+	s.announceRename(client, old)
+}
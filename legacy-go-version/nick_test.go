@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRenameLoopGetsBanned(t *testing.T) {
+	cfg := testConfig()
+	cfg.StrikeLimit = 3
+	ts := startServer(t, cfg, nil)
+	troll := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+
+	troll.Play(ScriptStep{After: time.Second, Line: ":nick anon"})
+	if !bob.Got("10.0.0.1 is now known as anon") {
+		t.Errorf("the room wasn't told about the nick, got %q", bob.Received())
+	}
+	// The first early try is only told to wait, every following one is a
+	// strike
+	for i := 0; i < cfg.StrikeLimit+1; i++ {
+		troll.Play(ScriptStep{After: time.Second, Line: fmt.Sprintf(":nick anon%d", i)})
+		if i < cfg.StrikeLimit && troll.Conn.IsClosed() {
+			t.Fatalf("banned after %d early renames", i+1)
+		}
+	}
+
+	if !troll.Got("You can change your nick again in") {
+		t.Errorf("no cooldown told, got %q", troll.Received())
+	}
+	if !troll.Got("You are banned MF: too many content strikes, the last for nick_rate") {
+		t.Errorf("not banned for renaming, got %q", troll.Received())
+	}
+	if bob.Got("anon0") {
+		t.Errorf("a rename within the interval went through")
+	}
+}
+
+func TestRenameAfterTheInterval(t *testing.T) {
+	cfg := testConfig()
+	ts := startServer(t, cfg, nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+
+	alice.Play(
+		ScriptStep{After: time.Second, Line: ":nick alice"},
+		ScriptStep{After: cfg.NickInterval, Line: ":nick carol"},
+	)
+
+	if !bob.Got("alice is now known as carol") {
+		t.Errorf("the rename wasn't announced, got %q", bob.Received())
+	}
+}
+
+func TestIgnoreFollowsARename(t *testing.T) {
+	cfg := testConfig()
+	ts := startServer(t, cfg, nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+	carol := ts.connect("10.0.0.3:1003")
+	bob.Play(ScriptStep{After: time.Second, Line: ":nick bob"})
+
+	alice.Play(ScriptStep{After: time.Second, Line: ":ignore bob"})
+	if !alice.Got("You ignore bob now") {
+		t.Fatalf("got %q", alice.Received())
+	}
+	bob.Play(
+		ScriptStep{After: cfg.NickInterval, Line: ":nick robert"},
+		ScriptStep{After: time.Second, Line: "it's me again"},
+	)
+	if !carol.Got("it's me again") {
+		t.Errorf("carol got %q", carol.Received())
+	}
+	if alice.Got("it's me again") {
+		t.Errorf("the ignore didn't follow the rename")
+	}
+
+	alice.Play(ScriptStep{After: time.Second, Line: ":unignore robert"})
+	bob.Play(ScriptStep{After: time.Second, Line: "hello?"})
+	if !alice.Got("You don't ignore robert any more") || !alice.Got("hello?") {
+		t.Errorf("got %q after :unignore", alice.Received())
+	}
+
+	alice.Forget()
+	alice.Play(
+		ScriptStep{After: time.Second, Line: ":ignore nobody"},
+		ScriptStep{After: time.Second, Line: ":ignore"},
+	)
+	if !alice.Got("Nobody is called nobody") || !alice.Got(":ignore <nick>") {
+		t.Errorf("got %q", alice.Received())
+	}
+}
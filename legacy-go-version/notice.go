@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// The lines starting with these come from the server itself, no client
+// may send one, see escapeNotice
+const (
+	noticePrefix = "[Server]"
+	announcementPrefix = "[Announcement]"
+	// Brackets the history replays, see replay
+	historyMarker = "---"
+	limitsPrefix = "LIMITS"
+	// Only with the code, a client saying bye to the room is fine
+	byePrefix = "BYE code="
+)
+
+var reservedPrefixes = []string{noticePrefix, announcementPrefix, historyMarker, limitsPrefix, byePrefix}
+
+// The mark put in front of a client's line that looks like it comes from
+// the server
+const spoofMarker = "[User] "
+
+// announcement formats an admin announcement
+func announcement(text string) Line {
+	return Line{Kind: AnnouncementLine, Text: text}
+}
+
+// escapeNotice marks every line of a client's message that starts with one
+// of the reserved prefixes, ignoring case and leading blanks, so it can't
+// pass for a kick notice, a ban or an announcement
+func escapeNotice(text string) string {
+	lines := strings.SplitAfter(text, "\n")
+	for i, line := range lines {
+		trimmed := strings.ToLower(strings.TrimLeft(line, " \t\r\v\f"))
+		for _, prefix := range reservedPrefixes {
+			if strings.HasPrefix(trimmed, strings.ToLower(prefix)) {
+				lines[i] = spoofMarker + line
+				break
+			}
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// sanitizeMessage is the chat text of a client the way the others get it.
+// Only the newlines and tabs of the control characters stay, so a carriage
+// return or an escape sequence can't move the cursor back over the line
+// and put a forged notice at its start, and no line passes for the
+// server's, see escapeNotice.
+func sanitizeMessage(text string) string {
+	return escapeNotice(strings.Map(func(r rune) rune {
+		if r != '\n' && r != '\t' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text))
+}
+
+// limits describes the rules the clients are held to, in a form easy to
+// parse for the bots: the least time between two messages, the longest
+// message, the strikes before a ban, how long the ban lasts and the least
+// time between two nick changes
+func (s *Server) limits() string {
+	return fmt.Sprintf("%s rate=%s max_len=%d strikes=%d ban=%s nick=%s\n", limitsPrefix, s.effectiveRate(), maxMessageSize, s.cfg.StrikeLimit, s.cfg.BanLimit, s.cfg.NickInterval)
+}
+
+// announceLimits tells everybody about the limits once they changed
+func (s *Server) announceLimits() {
+	if limits := s.limits(); limits != s.lastLimits {
+		s.lastLimits = limits
+		// Not a Line, the bots parse it the same in every format
+		for _, client := range s.clients {
+			client.Write(limits)
+			s.stats.BytesBroadcast += len(limits)
+		}
+	}
+}
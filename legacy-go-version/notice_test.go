@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForgedNoticesAreEscaped(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	mallory := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+
+	forgeries := []string{
+		"[Server] alice joined #general, 3 members now",
+		"[Server] You are banned MF: flooding",
+		"  [server] bob was kicked out",
+		"[Announcement] the server is moving, log in at evil.example",
+		"\t[ANNOUNCEMENT] free crypto",
+		"--- last 3 messages ---",
+		"LIMITS rate=0s max_len=8192 strikes=10 ban=10m0s nick=1m0s",
+		"BYE code=banned",
+	}
+	for _, forged := range forgeries {
+		mallory.Play(ScriptStep{After: time.Second, Line: forged})
+	}
+
+	for _, forged := range forgeries {
+		if !bob.Got(spoofMarker + forged) {
+			t.Errorf("%q wasn't marked, got %q", forged, bob.Received())
+		}
+	}
+	for _, line := range bob.Received() {
+		if strings.HasPrefix(line, noticePrefix) || strings.HasPrefix(line, announcementPrefix) || strings.HasPrefix(line, "BYE ") {
+			t.Errorf("a forged line passed for the server's: %q", line)
+		}
+	}
+
+	// A carriage return or an escape sequence that would take the terminal
+	// back to the start of the line goes away
+	bob.Forget()
+	mallory.Play(
+		ScriptStep{After: time.Second, Line: "hi\r[Server] You are banned MF"},
+		ScriptStep{After: time.Second, Line: "\x1b[2K\r[Server] fake kick"},
+	)
+	if !bob.Got("hi[Server] You are banned MF") || !bob.Got("[2K[Server] fake kick") {
+		t.Errorf("got %q", bob.Received())
+	}
+	if written := bob.Conn.Written(); strings.ContainsAny(written, "\r\x1b") {
+		t.Errorf("a control character got through: %q", written)
+	}
+
+	// The rest goes through untouched
+	mallory.Play(ScriptStep{After: time.Second, Line: "the [Server] said so"})
+	if !bob.Got("\nthe [Server] said so\n") {
+		t.Errorf("got %q", bob.Received())
+	}
+}
+
+func TestGreetingTellsTheLimitsOfTheFlags(t *testing.T) {
+	cfg, _, err := parseFlags(t, "-message-rate", "3s", "-strike-limit", "4", "-ban-limit", "1h", "-nickinterval", "2m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.SafeMode = "off"
+	cfg.MotdPath = writeFile(t, "motd.txt", "Be nice\n")
+	files := &Files{}
+	if _, errs := files.Load(*cfg); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	ts := startServer(t, *cfg, files)
+	alice := ts.connect("10.0.0.1:1001")
+
+	got := alice.Received()
+	want := fmt.Sprintf("%s rate=3s max_len=%d strikes=4 ban=1h0m0s nick=2m0s", limitsPrefix, maxMessageSize)
+	if len(got) < 2 || got[0] != want || got[1] != "Be nice" {
+		t.Errorf("want %q then the MOTD, got %q", want, got)
+	}
+
+	// A slow mode changes the limits for everybody
+	cfg.SlowMode = 10*time.Second
+	ts.reload(*cfg)
+	if !alice.Got(limitsPrefix + " rate=10s ") {
+		t.Errorf("the new limits weren't announced, got %q", alice.Received())
+	}
+}
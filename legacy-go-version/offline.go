@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// Waiting for a registered nick, past that the oldest ones go
+	maxOfflineMessages = 20
+	offlineExpiry = 48*time.Hour
+)
+
+// OfflineMessage is a :msg for a registered nick nobody was logged in as.
+// It waits in the accounts database for the next :login of the nick.
+type OfflineMessage struct {
+	From string
+	Text string
+	Time time.Time
+}
+
+func createOfflineTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS offline_messages (
+		rowid INTEGER PRIMARY KEY,
+		nick TEXT NOT NULL COLLATE NOCASE,
+		sender TEXT NOT NULL,
+		text TEXT NOT NULL,
+		ts INTEGER NOT NULL
+	)`)
+	return err
+}
+
+// QueueOffline keeps the message until the next login of the nick. It
+// returns how many of the messages already waiting were dropped for it,
+// the expired ones and the oldest ones over maxOfflineMessages.
+func (a *AccountDB) QueueOffline(nick string, message OfflineMessage) (int, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("INSERT INTO offline_messages (nick, sender, text, ts) VALUES (?, ?, ?, ?)", nick, message.From, message.Text, message.Time.UnixNano()); err != nil {
+		return 0, err
+	}
+	expired, err := tx.Exec("DELETE FROM offline_messages WHERE nick = ? AND ts < ?", nick, message.Time.Add(-offlineExpiry).UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	overflowing, err := tx.Exec(`DELETE FROM offline_messages WHERE rowid IN (
+		SELECT rowid FROM offline_messages WHERE nick = ? ORDER BY ts DESC, rowid DESC LIMIT -1 OFFSET ?
+	)`, nick, maxOfflineMessages)
+	if err != nil {
+		return 0, err
+	}
+	dropped := 0
+	for _, result := range []sql.Result{expired, overflowing} {
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		dropped += int(n)
+	}
+	return dropped, tx.Commit()
+}
+
+// TakeOffline returns the messages waiting for the nick, oldest first, and
+// forgets them. The expired ones are only counted.
+func (a *AccountDB) TakeOffline(nick string, now time.Time) ([]OfflineMessage, int, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT sender, text, ts FROM offline_messages WHERE nick = ? ORDER BY ts, rowid", nick)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var messages []OfflineMessage
+	expired := 0
+	for rows.Next() {
+		var message OfflineMessage
+		var ts int64
+		if err := rows.Scan(&message.From, &message.Text, &ts); err != nil {
+			return nil, 0, err
+		}
+		message.Time = time.Unix(0, ts)
+		if now.Sub(message.Time) > offlineExpiry {
+			expired += 1
+			continue
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM offline_messages WHERE nick = ?", nick); err != nil {
+		return nil, 0, err
+	}
+	return messages, expired, tx.Commit()
+}
+
+// msg sends the text to the registered nick, right away when somebody is
+// logged in as it, otherwise on its next :login
+func (s *Server) msg(author *Client, args []string, now time.Time) {
+	if len(args) < 2 {
+		s.tell(author, "usage", CatalogData{Text: ":msg <nick> <text>"})
+		return
+	}
+	// Chat like any other, it can't move the cursor of the recipient either
+	nick, text := args[0], sanitizeMessage(strings.Join(args[1:], " "))
+	if !s.accounts.Registered(nick) {
+		s.tell(author, "msg_unregistered", CatalogData{Nick: nick})
+		return
+	}
+	from := clientDisplayName(author, s.cfg)
+	if recipient := s.findByNick(nick); recipient != nil && recipient.Account != "" {
+		// The sender isn't told about an ignore
+		if !recipient.Ignored[author.ID] {
+			s.tell(recipient, "private_message", CatalogData{Nick: from, Text: text})
+		}
+		s.tell(author, "msg_sent", CatalogData{Nick: recipient.Account})
+		return
+	}
+	accounts := s.accounts
+	reply := s.accountReply(author, ":msg")
+	message := OfflineMessage{From: from, Text: text, Time: now}
+	go func() {
+		dropped, err := accounts.QueueOffline(nick, message)
+		reply(AccountReply{Nick: nick, Dropped: dropped, Err: err})
+	}()
+}
+
+// takeOffline fetches the messages waiting for the account the client just
+// logged in as, they come back as an AccountChecked of ":offline"
+func (s *Server) takeOffline(client *Client, now time.Time) {
+	accounts := s.accounts
+	nick := client.Account
+	reply := s.accountReply(client, ":offline")
+	go func() {
+		messages, expired, err := accounts.TakeOffline(nick, now)
+		reply(AccountReply{Nick: nick, Offline: messages, Dropped: expired, Err: err})
+	}()
+}
+
+// offlineChecked finishes a :msg or an :offline once its worker is done
+func (s *Server) offlineChecked(client *Client, reply AccountReply, now time.Time) {
+	s.stats.OfflineDropped += reply.Dropped
+	if reply.Err != nil {
+		client.log.Error("Offline messages failed", "event", "offline", "command", reply.Command, "err", reply.Err)
+		s.tell(client, "account_failed", CatalogData{})
+		return
+	}
+	if reply.Command == ":msg" {
+		s.tell(client, "msg_queued", CatalogData{Nick: reply.Nick})
+		return
+	}
+	if len(reply.Offline) > 0 {
+		client.log.Debug("Delivered the offline messages", "event", "offline", "account", reply.Nick, "messages", len(reply.Offline))
+	}
+	for _, message := range reply.Offline {
+		// Again, for the ones stored before the text was sanitized
+		s.tell(client, "offline_message", CatalogData{Nick: message.From, Text: sanitizeMessage(message.Text), Duration: now.Sub(message.Time)})
+	}
+}
+
+// coarseDuration keeps the largest unit only, "3h" rather than "3h12m5s"
+func coarseDuration(d time.Duration) string {
+	switch {
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
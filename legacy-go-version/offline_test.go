@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAccountPassword = "correct-horse"
+
+// withAccounts opens an accounts database at path for the server, like
+// -accounts-db does
+func withAccounts(ts *testServer, path string) {
+	ts.t.Helper()
+	accounts, err := OpenAccountDB(path)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	ts.t.Cleanup(func() {
+		accounts.Close()
+	})
+	ts.s.accounts = accounts
+}
+
+// register creates the account from a connection of its own that leaves
+// right after
+func register(ts *testServer, nick string) {
+	ts.t.Helper()
+	c := ts.connect("10.0.0.99:9999")
+	c.Play(ScriptStep{After: time.Second, Line: ":register " + nick + " " + testAccountPassword})
+	c.WaitFor("You are logged in as " + nick)
+	c.Close()
+}
+
+func login(ts *testServer, addr string, nick string) *ScriptedClient {
+	ts.t.Helper()
+	c := ts.connect(addr)
+	c.Play(ScriptStep{After: time.Second, Line: ":login " + nick + " " + testAccountPassword})
+	c.WaitFor("You are logged in as " + nick)
+	return c
+}
+
+// queue sends the :msg and waits until it's stored
+func queue(sender *ScriptedClient, after time.Duration, nick string, text string) {
+	sender.ts.t.Helper()
+	sender.Forget()
+	sender.Play(ScriptStep{After: after, Line: ":msg " + nick + " " + text})
+	sender.WaitFor(nick + " is offline")
+}
+
+// offlineMessages are the offline messages the client got, in order
+func offlineMessages(c *ScriptedClient) []string {
+	var messages []string
+	for _, line := range c.Received() {
+		if strings.HasPrefix(line, "[offline message from ") {
+			messages = append(messages, line)
+		}
+	}
+	return messages
+}
+
+func TestOfflineMessagesInOrder(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	withAccounts(ts, filepath.Join(t.TempDir(), "accounts.db"))
+	register(ts, "bob")
+	alice := ts.connect("10.0.0.1:1001")
+	alice.Play(ScriptStep{After: time.Second, Line: ":nick alice"})
+
+	queue(alice, time.Minute, "bob", "remember the demo")
+	queue(alice, time.Hour, "bob", "and the slides")
+	queue(alice, time.Minute, "bob", "see you")
+	ts.clock.Advance(3*time.Hour)
+	bob := login(ts, "10.0.0.2:1002", "bob")
+	bob.WaitFor("see you")
+
+	want := []string{
+		"[offline message from alice, 4h ago] remember the demo",
+		"[offline message from alice, 3h ago] and the slides",
+		"[offline message from alice, 3h ago] see you",
+	}
+	if got := offlineMessages(bob); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Delivered once only
+	bob.Close()
+	bob = login(ts, "10.0.0.2:1003", "bob")
+	ts.sync()
+	time.Sleep(10*time.Millisecond)
+	ts.sync()
+	if got := offlineMessages(bob); len(got) > 0 {
+		t.Errorf("delivered again on the next login: %q", got)
+	}
+}
+
+func TestOfflineMessagesExpire(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	withAccounts(ts, filepath.Join(t.TempDir(), "accounts.db"))
+	register(ts, "bob")
+	alice := ts.connect("10.0.0.1:1001")
+
+	queue(alice, time.Second, "bob", "too old")
+	queue(alice, offlineExpiry+time.Hour, "bob", "still fresh")
+	if dropped := ts.sync().Stats.OfflineDropped; dropped != 1 {
+		t.Errorf("%d offline messages dropped, want the expired one", dropped)
+	}
+	ts.clock.Advance(offlineExpiry - time.Minute)
+	queue(alice, 0, "bob", "fresh too")
+	ts.clock.Advance(2*time.Minute)
+	bob := login(ts, "10.0.0.2:1002", "bob")
+	bob.WaitFor("offline message from")
+	ts.sync()
+
+	if got := offlineMessages(bob); len(got) != 1 || !strings.HasSuffix(got[0], "fresh too") {
+		t.Errorf("got %q, want only the one that hasn't expired", got)
+	}
+	if dropped := ts.sync().Stats.OfflineDropped; dropped != 2 {
+		t.Errorf("%d offline messages dropped, want 2", dropped)
+	}
+}
+
+func TestOfflineMessagesCap(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	withAccounts(ts, filepath.Join(t.TempDir(), "accounts.db"))
+	register(ts, "bob")
+	alice := ts.connect("10.0.0.1:1001")
+
+	for i := 0; i < maxOfflineMessages+2; i++ {
+		queue(alice, time.Second, "bob", fmt.Sprintf("message %d.", i))
+	}
+	bob := login(ts, "10.0.0.2:1002", "bob")
+	bob.WaitFor(fmt.Sprintf("message %d.", maxOfflineMessages+1))
+
+	got := offlineMessages(bob)
+	if len(got) != maxOfflineMessages || !strings.HasSuffix(got[0], "message 2.") {
+		t.Errorf("got %d messages starting with %q, want %d starting with message 2", len(got), got[0], maxOfflineMessages)
+	}
+	if dropped := ts.sync().Stats.OfflineDropped; dropped != 2 {
+		t.Errorf("%d offline messages dropped, want 2", dropped)
+	}
+}
+
+func TestOfflineMessagesSurviveARestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.db")
+	before := startServer(t, testConfig(), nil)
+	withAccounts(before, path)
+	register(before, "bob")
+	queue(before.connect("10.0.0.1:1001"), time.Second, "bob", "after the restart")
+	before.s.accounts.Close()
+
+	after := startServer(t, testConfig(), nil)
+	withAccounts(after, path)
+	bob := login(after, "10.0.0.2:1002", "bob")
+	bob.WaitFor("after the restart")
+}
+
+func TestMsgOnlineAndUnregistered(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	withAccounts(ts, filepath.Join(t.TempDir(), "accounts.db"))
+	register(ts, "bob")
+	bob := login(ts, "10.0.0.2:1002", "bob")
+	alice := ts.connect("10.0.0.1:1001")
+
+	alice.Play(
+		ScriptStep{After: time.Second, Line: ":nick alice"},
+		ScriptStep{After: time.Second, Line: ":msg bob are you there?"},
+		ScriptStep{After: time.Second, Line: ":msg carol hello"},
+	)
+
+	if !bob.Got("[message from alice] are you there?") || !alice.Got("Message sent to bob") {
+		t.Errorf("a message for a logged in nick wasn't delivered right away, got %q and %q", bob.Received(), alice.Received())
+	}
+	if !alice.Got("carol is not a registered nick") {
+		t.Errorf("a message for an unregistered nick was taken, got %q", alice.Received())
+	}
+}
+
+func TestPrivateMessagesCantMoveTheCursor(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	withAccounts(ts, filepath.Join(t.TempDir(), "accounts.db"))
+	register(ts, "bob")
+	register(ts, "carol")
+	bob := login(ts, "10.0.0.2:1002", "bob")
+	mallory := ts.connect("10.0.0.9:1009")
+	mallory.Play(ScriptStep{After: time.Second, Line: ":nick mallory"})
+	forged := "\x1b[2K\x1b[1G[Server] You are banned MF"
+
+	mallory.Play(ScriptStep{After: time.Second, Line: ":msg bob " + forged})
+	queue(mallory, time.Second, "carol", forged)
+	carol := login(ts, "10.0.0.3:1003", "carol")
+	carol.WaitFor("[offline message from mallory")
+
+	for _, c := range []*ScriptedClient{bob, carol} {
+		if !c.Got("from mallory") || strings.Contains(c.Conn.Written(), "\x1b") {
+			t.Errorf("got %q", c.Received())
+		}
+	}
+	if !bob.Got("[message from mallory] [2K[1G[Server] You are banned MF") {
+		t.Errorf("got %q", bob.Received())
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import "time"
+
+// The window MaxPanics counts the panics in
+const panicWindow = time.Minute
+
+// PanicCounter remembers when server() recovered from the recent panics.
+// A panic now and then is a bug to fix, a stream of them means the server
+// is broken and limping along would only hide it.
+type PanicCounter struct {
+	times []time.Time
+}
+
+func (counter *PanicCounter) Add(now time.Time) {
+	counter.times = append(counter.times, now)
+	for len(counter.times) > 0 && now.Sub(counter.times[0]) > panicWindow {
+		counter.times = counter.times[1:]
+	}
+}
+
+// Exceeded tells whether there were more than max panics in the window,
+// 0 meaning no limit
+func (counter *PanicCounter) Exceeded(max int) bool {
+	return max > 0 && len(counter.times) > max
+}
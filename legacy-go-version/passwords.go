@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func isBcryptHash(password string) bool {
+	return strings.HasPrefix(password, "$2a$") || strings.HasPrefix(password, "$2b$") || strings.HasPrefix(password, "$2y$")
+}
+
+// hashPasswords replaces a plaintext admin password with its bcrypt hash,
+// so from here on the plaintext only lives in the flag or the config file
+// it came from
+func hashPasswords(cfg *Config) error {
+	if cfg.AdminPassword == "" || isBcryptHash(cfg.AdminPassword) {
+		return nil
+	}
+	slog.Warn("SECURITY: use pre-hashed password in production", "setting", "AdminPassword", "hint", "see -hashpassword")
+	hash, err := bcrypt.GenerateFromPassword([]byte(cfg.AdminPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("could not hash the admin password: %w", err)
+	}
+	cfg.AdminPassword = string(hash)
+	return nil
+}
+
+// hashPasswordFromStdin prints the bcrypt hash of the first line of the
+// standard input, for -hashpassword
+func hashPasswordFromStdin() int {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "ERROR: expected the password on the standard input:", err)
+		return 1
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		return 1
+	}
+	fmt.Println(string(hash))
+	return 0
+}
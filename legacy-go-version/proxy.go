@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parseTrustedProxies reads the -trusted-proxies list, CIDRs or single
+// addresses
+func parseTrustedProxies(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range list {
+		if addr, err := netip.ParseAddr(item); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy must be an address or a CIDR, got %q", item)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func trusted(addr netip.Addr, proxies []netip.Prefix) bool {
+	for _, prefix := range proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor is the client behind the reverse proxies in front of the
+// server. Only a trusted peer gets its headers read, anybody else could
+// send them, and then it's the rightmost hop the trusted proxies didn't
+// add themselves, the hops to the left of it are the client's word. A hop
+// that isn't an address, like "unknown", ends the chain at the proxy that
+// added it. X-Forwarded-For wins over Forwarded, so a proxy setting
+// Forwarded has to drop the X-Forwarded-For of the client.
+func forwardedFor(peer netip.Addr, header http.Header, proxies []netip.Prefix) netip.Addr {
+	peer = peer.Unmap()
+	if !trusted(peer, proxies) {
+		return peer
+	}
+	hops := forwardedHops(header)
+	last := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHop(hops[i])
+		if !ok {
+			return last
+		}
+		if !trusted(addr, proxies) {
+			return addr
+		}
+		last = addr
+	}
+	return last
+}
+
+// forwardedHops lists the hops of the headers, the client first, the
+// headers repeated included
+func forwardedHops(header http.Header) []string {
+	var hops []string
+	if values := header.Values("X-Forwarded-For"); len(values) > 0 {
+		for _, value := range values {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+		return hops
+	}
+	// Forwarded: for=192.0.2.60;proto=http, for="[2001:db8::17]:4711"
+	for _, value := range header.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				name, param, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(name, "for") {
+					hop = param
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseHop reads an address of a header, with or without its port and
+// the brackets and quotes around IPv6
+func parseHop(hop string) (netip.Addr, bool) {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+	if addr, err := netip.ParseAddr(hop); err == nil {
+		return addr.Unmap(), true
+	}
+	host, _, err := net.SplitHostPort(hop)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestForwardedFor(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		peer string
+		headers map[string][]string
+		want string
+	}{
+		{"no proxy", "203.0.113.7", nil, "203.0.113.7"},
+		{"untrusted peer sending XFF", "203.0.113.7", map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.7"},
+		{"untrusted peer sending Forwarded", "203.0.113.7", map[string][]string{"Forwarded": {"for=198.51.100.1"}}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2", map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"trusted proxy without headers", "10.0.0.2", nil, "10.0.0.2"},
+		{"chained XFF", "10.0.0.2", map[string][]string{"X-Forwarded-For": {"1.1.1.1, 198.51.100.1, 192.168.1.1"}}, "198.51.100.1"},
+		{"XFF over several lines", "10.0.0.2", map[string][]string{"X-Forwarded-For": {"1.1.1.1", "198.51.100.1,10.0.0.3"}}, "198.51.100.1"},
+		{"only trusted hops", "10.0.0.2", map[string][]string{"X-Forwarded-For": {"10.0.0.4, 10.0.0.3"}}, "10.0.0.4"},
+		{"garbage hop", "10.0.0.2", map[string][]string{"X-Forwarded-For": {"1.1.1.1, nonsense, 10.0.0.3"}}, "10.0.0.3"},
+		{"XFF with a port", "10.0.0.2", map[string][]string{"X-Forwarded-For": {"198.51.100.1:4711"}}, "198.51.100.1"},
+		{"IPv6 XFF", "fd00::1", map[string][]string{"X-Forwarded-For": {"2001:db8::1, fd00::2"}}, "2001:db8::1"},
+		{"IPv6 XFF in brackets", "10.0.0.2", map[string][]string{"X-Forwarded-For": {"[2001:db8::1]:443"}}, "2001:db8::1"},
+		{"IPv4 mapped peer", "::ffff:10.0.0.2", map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"Forwarded", "10.0.0.2", map[string][]string{"Forwarded": {"for=198.51.100.1;proto=https, for=10.0.0.3"}}, "198.51.100.1"},
+		{"Forwarded IPv6", "10.0.0.2", map[string][]string{"Forwarded": {`for="[2001:db8:cafe::17]:4711"`}}, "2001:db8:cafe::17"},
+		{"Forwarded unknown", "10.0.0.2", map[string][]string{"Forwarded": {"for=unknown"}}, "10.0.0.2"},
+		{"XFF wins", "10.0.0.2", map[string][]string{"X-Forwarded-For": {"198.51.100.1"}, "Forwarded": {"for=1.1.1.1"}}, "198.51.100.1"},
+	} {
+		header := http.Header{}
+		for name, values := range tc.headers {
+			for _, value := range values {
+				header.Add(name, value)
+			}
+		}
+		if got := forwardedFor(netip.MustParseAddr(tc.peer), header, proxies); got.String() != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/8", "::1", "2001:db8::/32"}); err != nil {
+		t.Error(err)
+	}
+	for _, bad := range []string{"10.0.0.0/33", "localhost", "10.0.0"} {
+		if _, err := parseTrustedProxies([]string{bad}); err == nil {
+			t.Errorf("%q was taken", bad)
+		}
+	}
+	cfg, _, err := parseFlags(t, "-trusted-proxies", "10.0.0.0/8, fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.TrustedProxies) != 2 || cfg.TrustedProxies[1] != "fd00::/8" {
+		t.Errorf("got %q", cfg.TrustedProxies)
+	}
+	cfg.TrustedProxies = []string{"nginx"}
+	if cfg.Validate() == nil {
+		t.Errorf("a bad proxy passed the validation")
+	}
+}
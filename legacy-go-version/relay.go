@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The messages exchanged between the servers look like
+//
+//	RELAY <server id> <room> <quoted text>
+//
+// one per line. Any other line a server sends, like the MOTD or the join
+// notices it sends every client, is ignored.
+const relayFramePrefix = "RELAY "
+
+// How long a relay waits before dialing again after losing its server
+const relayRetry = 5*time.Second
+
+// How many frames wait for a slow relay before new ones are dropped
+const relayQueueSize = 256
+
+// A relay client sending a longer line without a newline is dropped
+const maxRelayFrame = 64*1024
+
+// stringList is a flag taking comma separated values
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(text string) error {
+	*list = nil
+	for _, item := range strings.Split(text, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*list = append(*list, item)
+		}
+	}
+	return nil
+}
+
+func relayFrame(origin string, room string, text string) string {
+	return relayFramePrefix + origin + " " + room + " " + strconv.Quote(text) + "\n"
+}
+
+func parseRelayFrame(line string) (origin string, room string, text string, ok bool) {
+	fields := strings.SplitN(strings.TrimSuffix(line, "\r"), " ", 4)
+	if len(fields) != 4 || fields[0]+" " != relayFramePrefix || !validRoomName(fields[2]) {
+		return "", "", "", false
+	}
+	text, err := strconv.Unquote(fields[3])
+	if err != nil {
+		return "", "", "", false
+	}
+	return fields[1], fields[2], text, true
+}
+
+// Relay is the link to another server dialed because of -relay. The
+// messages of the local clients go to that server through it, and the
+// messages of its clients come back.
+type Relay struct {
+	addr string
+	token string
+	out chan string
+	cancel context.CancelFunc
+}
+
+func startRelay(ctx context.Context, addr string, token string, messages chan Message) *Relay {
+	ctx, cancel := context.WithCancel(ctx)
+	relay := &Relay{
+		addr: addr,
+		token: token,
+		out: make(chan string, relayQueueSize),
+		cancel: cancel,
+	}
+	go relay.run(ctx, messages)
+	return relay
+}
+
+// Send queues the frame without blocking server(), a relay that can't keep
+// up loses frames
+func (relay *Relay) Send(frame string) {
+	select {
+	case relay.out <- frame:
+	default:
+		slog.Debug("Relay queue is full, dropping a message", "event", "relay_drop", "relay", relay.addr)
+	}
+}
+
+// Stop closes the connection and ends the goroutine of the relay
+func (relay *Relay) Stop() {
+	relay.cancel()
+}
+
+func (relay *Relay) run(ctx context.Context, messages chan Message) {
+	for {
+		if err := relay.session(ctx, messages); err != nil {
+			slog.Info("Relay disconnected", "event", "relay_disconnect", "relay", relay.addr, "err", err)
+		}
+		select {
+		case <-time.After(relayRetry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// session dials the server once and relays until either side gives up
+func (relay *Relay) session(ctx context.Context, messages chan Message) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", relay.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+	slog.Info("Relay connected", "event", "relay_connect", "relay", relay.addr)
+	if err := writeWithTimeout(conn, []byte(":relay "+relay.token+"\n"), writeTimeout); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(conn)
+		scanner.Buffer(make([]byte, 4096), maxRelayFrame)
+		for scanner.Scan() {
+			if !strings.HasPrefix(scanner.Text(), relayFramePrefix) {
+				continue
+			}
+			select {
+			case messages <- Message{
+				Type: RelayReceived,
+				Text: scanner.Text(),
+			}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		done <- scanner.Err()
+	}()
+
+	for {
+		select {
+		case frame := <-relay.out:
+			if err := writeWithTimeout(conn, []byte(frame), writeTimeout); err != nil {
+				return err
+			}
+		case err := <-done:
+			if err == nil {
+				err = net.ErrClosed
+			}
+			return err
+		case <-ctx.Done():
+			slog.Info("Relay disconnected", "event", "relay_disconnect", "relay", relay.addr, "reason", "removed")
+			return nil
+		}
+	}
+}
+
+// syncRelays starts the relays added to RelayAddrs and stops the removed
+// ones. The others keep their connections unless the token changed.
+func (s *Server) syncRelays(ctx context.Context) {
+	wanted := map[string]bool{}
+	for _, addr := range s.cfg.RelayAddrs {
+		wanted[addr] = true
+	}
+	for addr, relay := range s.relays {
+		if !wanted[addr] || relay.token != s.cfg.RelayAuthToken {
+			relay.Stop()
+			delete(s.relays, addr)
+		}
+	}
+	for addr := range wanted {
+		if s.relays[addr] == nil {
+			s.relays[addr] = startRelay(ctx, addr, s.cfg.RelayAuthToken, s.messages)
+		}
+	}
+}
+
+// acceptRelay turns the client into a relay of another server if the token
+// is right. A relay is in no room, it gets the messages of every room as
+// frames.
+func (s *Server) acceptRelay(client *Client, token string, now time.Time) {
+	if s.cfg.RelayAuthToken == "" {
+		s.tell(client, "relay_disabled", CatalogData{})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.RelayAuthToken)) != 1 {
+		client.log.Warn("Client failed to authenticate as relay", "event", "relay_auth_failed", "client", s.cfg.sensitive(clientKey(client.Conn)))
+		securityEvent("auth_failed", "relay_token", s.cfg.sensitive(clientKey(client.Conn)), "cid", client.CorrelationID)
+		s.tell(client, "relay_wrong_token", CatalogData{})
+		s.strike(client, "relay_auth_failed", now)
+		return
+	}
+	client.log.Info("Relay connected", "event", "relay_connect", "client", s.cfg.sensitive(clientKey(client.Conn)))
+	client.IsRelay = true
+	s.leaveRoom(client)
+}
+
+// relayInput handles what a relay client sent. Unlike the chat messages,
+// the frames are split on newlines since a read may hold several of them.
+func (s *Server) relayInput(client *Client, text string, now time.Time) {
+	client.BytesRead += len(text)
+	client.LastMessage = now
+	client.relayBuf += text
+	for {
+		i := strings.IndexByte(client.relayBuf, '\n')
+		if i < 0 {
+			break
+		}
+		line := client.relayBuf[:i]
+		client.relayBuf = client.relayBuf[i+1:]
+		s.receiveRelayed(line, now)
+	}
+	if len(client.relayBuf) > maxRelayFrame {
+		client.log.Warn("Relay sent a frame that is too long, disconnecting it", "event", "relay_overflow", "client", s.cfg.sensitive(clientKey(client.Conn)))
+		hangUp(client.Conn, ByeProtocol, 0)
+	}
+}
+
+// receiveRelayed delivers a message from another server to the local
+// members of its room
+func (s *Server) receiveRelayed(line string, now time.Time) {
+	origin, name, text, ok := parseRelayFrame(line)
+	if !ok {
+		slog.Debug("Ignoring a malformed relay frame", "event", "relay_frame", "line", s.cfg.sensitiveContent(line))
+		return
+	}
+	// Our own message came back around a loop of relays
+	if origin == s.id {
+		return
+	}
+	escaped := sanitizeMessage(text)
+	render := renderer(Line{
+		Kind: ChatLine,
+		Room: name,
+		Text: escaped,
+		Seq: s.nextSeq(),
+	})
+	if room := s.rooms[name]; room != nil {
+		for _, client := range room.Members {
+			s.deliver(client, render(client.Format))
+		}
+	}
+	s.stats.Relayed += 1
+	totalMessages.Add(1)
+	s.record("relay/"+origin, name, escaped, now)
+}
+
+// forward sends a message of a local client to the other servers, both
+// the ones dialed through -relay and the ones which dialed us
+func (s *Server) forward(room string, text string) {
+	if len(s.relays) == 0 && s.cfg.RelayAuthToken == "" {
+		return
+	}
+	frame := relayFrame(s.id, room, text)
+	for _, relay := range s.relays {
+		relay.Send(frame)
+	}
+	for _, client := range s.clients {
+		if client.IsRelay {
+			client.Write(frame)
+		}
+	}
+}
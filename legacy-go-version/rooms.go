@@ -0,0 +1,461 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Every client starts in this room and falls back to it after :part
+const defaultRoom = "#general"
+
+const maxTopicLength = 200
+
+// How many rooms the admins may create past MaxRooms
+const adminMaxRooms = 1000
+
+type Room struct {
+	Name string
+	// By connection, like Server.clients
+	Members map[ConnID]*Client
+	// The client which created the room, 0 for nobody
+	Creator ConnID
+	Topic string
+	// How many members the room takes, 0 for no limit. Set by the room
+	// creator, it can only lower the capacity, see roomCapacity.
+	Limit int
+	// Set by the admins with :capacity in place of MaxRoomSize, 0 for the
+	// default
+	MaxSize int
+	InviteOnly bool
+	// The clients invited to the room, an invite is used up by joining and
+	// dropped when the client disconnects
+	Invited map[ConnID]bool
+	// The operators. They keep the status while away from the room, but
+	// not once it's gone or they disconnect.
+	Ops map[ConnID]bool
+	// Until when the clients may not talk in the room
+	Muted map[ConnID]time.Time
+	// The least time between two messages of a member, on top of the global
+	// MessageRate, 0 for none
+	SlowMode time.Duration
+	// When the clients last talked in the room, apart from Client.LastMessage
+	// so that switching rooms doesn't reset either
+	LastMessage map[ConnID]time.Time
+}
+
+// RoomAction is something that needs a permission in a room, see allowed
+type RoomAction int
+const (
+	ManageOps RoomAction = iota + 1
+	ManageRoom
+	SetTopic
+	KickMember
+	MuteMember
+)
+
+// allowed is the only place deciding who may do what in a room, to the
+// target member if the action has one. The admins may do everything
+// everywhere. The creator may do everything in its room, the operators
+// everything but handing out the operator status. Only the admins may act
+// on the creator or another admin.
+func (s *Server) allowed(client *Client, room *Room, action RoomAction, target *Client) bool {
+	if client.IsAdmin {
+		return true
+	}
+	if target != nil && target != client && (target.IsAdmin || target.ID == room.Creator) {
+		return false
+	}
+	if action == SetTopic && s.cfg.TopicAdminOnly {
+		return false
+	}
+	if room.Creator == client.ID {
+		return true
+	}
+	return action != ManageOps && room.Ops[client.ID]
+}
+
+func validRoomName(name string) bool {
+	if len(name) < 2 || len(name) > 32 || name[0] != '#' {
+		return false
+	}
+	for _, c := range name[1:] {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeLine keeps the text of a notice on one line of at most maxLength
+// characters and drops the control characters, so nobody can sneak
+// terminal escape sequences into the notices. The blanks, tabs and
+// newlines included, are single spaces between the words. Sanitizing the
+// result again changes nothing.
+func sanitizeLine(text string, maxLength int) string {
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text)
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > maxLength {
+		// The cut may leave a space at the end
+		text = strings.TrimRight(string(runes[:maxLength]), " ")
+	}
+	return text
+}
+
+// joinRoom moves the client from its current room, if any, into the room,
+// creating the room on demand
+func (s *Server) joinRoom(client *Client, name string) {
+	s.leaveRoom(client)
+	room := s.rooms[name]
+	if room == nil {
+		room = &Room{
+			Name: name,
+			Members: map[ConnID]*Client{},
+			Invited: map[ConnID]bool{},
+			Ops: map[ConnID]bool{},
+			Muted: map[ConnID]time.Time{},
+			LastMessage: map[ConnID]time.Time{},
+		}
+		// Whoever happens to come first doesn't own the default room
+		if name != defaultRoom {
+			room.Creator = client.ID
+		}
+		s.rooms[name] = room
+		s.reseedHistory(name)
+	}
+	s.roomBroadcast(name, s.notice("room_someone_joined", CatalogData{Nick: clientDisplayName(client, s.cfg), Room: name, Count: len(room.Members)+1}))
+	room.Members[client.ID] = client
+	client.Room = name
+	if room.Topic != "" {
+		client.Send(s.notice("topic", CatalogData{Room: name, Text: room.Topic}))
+	}
+}
+
+// leaveRoom takes the client out of its current room, the room goes away
+// with its last member and so does its history, except the one of the
+// default room
+func (s *Server) leaveRoom(client *Client) {
+	room := s.rooms[client.Room]
+	if room == nil {
+		return
+	}
+	delete(room.Members, client.ID)
+	if len(room.Members) == 0 {
+		delete(s.rooms, client.Room)
+		if client.Room != defaultRoom {
+			s.history.Drop(client.Room)
+		}
+	} else {
+		s.roomBroadcast(client.Room, s.notice("room_someone_left", CatalogData{Nick: clientDisplayName(client, s.cfg), Room: client.Room, Count: len(room.Members)}))
+	}
+	client.Room = ""
+}
+
+// roomBroadcast sends the line to every member of the room
+func (s *Server) roomBroadcast(name string, line Line) {
+	room := s.rooms[name]
+	if room == nil {
+		return
+	}
+	render := renderer(line)
+	for _, client := range room.Members {
+		text := render(client.Format)
+		client.Write(text)
+		s.stats.BytesBroadcast += len(text)
+	}
+}
+
+// roomList describes the rooms with their member counts and topics, sorted
+// by name
+func (s *Server) roomList() string {
+	var names []string
+	for name := range s.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		room := s.rooms[name]
+		fmt.Fprintf(&sb, "%s (%d)", name, len(room.Members))
+		if room.Topic != "" {
+			fmt.Fprintf(&sb, ": %s", room.Topic)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// canJoinRoom tells why the client can't join the room, if it can't
+func (s *Server) canJoinRoom(client *Client, name string) (string, bool) {
+	room := s.rooms[name]
+	if room == nil {
+		// The default room is always there to go back to, it doesn't count
+		created := len(s.rooms)
+		if _, ok := s.rooms[defaultRoom]; ok {
+			created -= 1
+		}
+		limit := s.cfg.MaxRooms
+		if client.IsAdmin {
+			limit = max(limit, adminMaxRooms)
+		}
+		if name != defaultRoom && s.cfg.MaxRooms > 0 && created >= limit {
+			return s.say("room_limit", CatalogData{Limit: limit}), false
+		}
+		return "", true
+	}
+	if client.IsAdmin {
+		return "", true
+	}
+	if room.InviteOnly && !room.Invited[client.ID] {
+		return s.say("room_invite_only", CatalogData{Room: name}), false
+	}
+	if limit := s.roomCapacity(room); limit > 0 && len(room.Members) >= limit {
+		return s.say("room_full", CatalogData{Room: name, Limit: limit}), false
+	}
+	return "", true
+}
+
+// roomCapacity is how many members the room takes, 0 for no limit
+func (s *Server) roomCapacity(room *Room) int {
+	capacity := s.cfg.MaxRoomSize
+	if room.MaxSize > 0 {
+		capacity = room.MaxSize
+	}
+	if room.Limit > 0 && (capacity == 0 || room.Limit < capacity) {
+		capacity = room.Limit
+	}
+	return capacity
+}
+
+// invite lets the invitee join the invite only room of the client
+func (s *Server) invite(client *Client, nick string) {
+	invitee := s.findByNick(nick)
+	if invitee == nil {
+		s.tell(client, "nobody", CatalogData{Nick: nick})
+		return
+	}
+	room := s.rooms[client.Room]
+	room.Invited[invitee.ID] = true
+	invitee.Send(s.notice("invitation", CatalogData{Room: room.Name}))
+	s.tell(client, "invited", CatalogData{Nick: invitee.Username, Room: room.Name})
+}
+
+// forgetClient drops the invites, operator statuses and mutes of a client
+// that is gone, so a new connection from the same address doesn't get them
+func (s *Server) forgetClient(client *Client) {
+	for _, room := range s.rooms {
+		delete(room.Invited, client.ID)
+		delete(room.Ops, client.ID)
+		delete(room.Muted, client.ID)
+		delete(room.LastMessage, client.ID)
+	}
+}
+
+// roomMember finds the member of the client's room by its nick
+func (s *Server) roomMember(client *Client, nick string) *Client {
+	target := s.findByNick(nick)
+	if target == nil || target.Room != client.Room {
+		s.tell(client, "nobody_in_room", CatalogData{Nick: nick, Room: client.Room})
+		return nil
+	}
+	return target
+}
+
+// setOp grants or revokes the operator status in the client's room
+func (s *Server) setOp(client *Client, nick string, op bool) {
+	room := s.rooms[client.Room]
+	if !s.allowed(client, room, ManageOps, nil) {
+		s.tell(client, "permission_denied", CatalogData{})
+		return
+	}
+	target := s.roomMember(client, nick)
+	if target == nil {
+		return
+	}
+	if op {
+		room.Ops[target.ID] = true
+		s.roomBroadcast(room.Name, s.notice("op", CatalogData{Nick: target.Username, Room: room.Name}))
+	} else {
+		delete(room.Ops, target.ID)
+		s.roomBroadcast(room.Name, s.notice("deop", CatalogData{Nick: target.Username, Room: room.Name}))
+	}
+}
+
+// kick throws the member out of the client's room, back to the default
+// room, or off the server when that's the room
+func (s *Server) kick(client *Client, actor string, nick string, reason string, now time.Time) {
+	room := s.rooms[client.Room]
+	if !s.allowed(client, room, KickMember, nil) {
+		s.tell(client, "permission_denied", CatalogData{})
+		return
+	}
+	target := s.roomMember(client, nick)
+	if target == nil {
+		return
+	}
+	if !s.allowed(client, room, KickMember, target) {
+		s.tell(client, "permission_denied", CatalogData{})
+		return
+	}
+	s.audit.Record(AuditEntry{
+		Time: now,
+		Actor: actor,
+		Action: "kick",
+		Target: target.Username + " from " + room.Name,
+		Reason: reason,
+	})
+	target.Send(s.notice("kicked", CatalogData{Room: room.Name}))
+	if room.Name == defaultRoom {
+		hangUp(target.Conn, ByeKicked, 0)
+		return
+	}
+	s.joinRoom(target, defaultRoom)
+}
+
+// mute keeps the member of the client's room from talking in it for the
+// duration, a zero duration lifts the mute
+func (s *Server) mute(client *Client, actor string, nick string, duration time.Duration, now time.Time) {
+	room := s.rooms[client.Room]
+	if !s.allowed(client, room, MuteMember, nil) {
+		s.tell(client, "permission_denied", CatalogData{})
+		return
+	}
+	target := s.roomMember(client, nick)
+	if target == nil {
+		return
+	}
+	if !s.allowed(client, room, MuteMember, target) {
+		s.tell(client, "permission_denied", CatalogData{})
+		return
+	}
+	if duration == 0 {
+		delete(room.Muted, target.ID)
+		s.audit.Record(AuditEntry{Time: now, Actor: actor, Action: "unmute", Target: target.Username + " in " + room.Name})
+		target.Send(s.notice("room_unmuted", CatalogData{Room: room.Name}))
+		return
+	}
+	room.Muted[target.ID] = now.Add(duration)
+	s.audit.Record(AuditEntry{Time: now, Actor: actor, Action: "mute", Target: target.Username + " in " + room.Name, Duration: duration})
+	target.Send(s.notice("room_muted", CatalogData{Room: room.Name, Duration: duration}))
+}
+
+// slowedFor tells how long the client has to wait before talking in its
+// room again because of the room's slow mode. Like the global one, it
+// doesn't apply to the admins.
+func (s *Server) slowedFor(client *Client, now time.Time) time.Duration {
+	room := s.rooms[client.Room]
+	if room.SlowMode == 0 || client.IsAdmin {
+		return 0
+	}
+	return max(0, room.SlowMode - now.Sub(room.LastMessage[client.ID]))
+}
+
+// mutedFor tells how long the client may not talk in its room anymore
+func (s *Server) mutedFor(client *Client, now time.Time) time.Duration {
+	until, muted := s.rooms[client.Room].Muted[client.ID]
+	if !muted || !now.Before(until) {
+		return 0
+	}
+	return until.Sub(now)
+}
+
+// names lists the members of the room, the operators marked with @
+func (s *Server) names(room *Room) string {
+	var names []string
+	for id, client := range room.Members {
+		name := clientDisplayName(client, s.cfg)
+		if room.Ops[id] || room.Creator == id {
+			name = "@" + name
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return room.Name + ": " + strings.Join(names, " ") + "\n"
+}
+
+// roomSet changes one of the settings of the client's room
+func (s *Server) roomSet(client *Client, args []string) {
+	room := s.rooms[client.Room]
+	if !s.allowed(client, room, ManageRoom, nil) {
+		s.tell(client, "permission_denied", CatalogData{})
+		return
+	}
+	if len(args) != 2 {
+		s.tell(client, "usage", CatalogData{Text: ":roomset limit <members>|invite on|off|slowmode <duration>"})
+		return
+	}
+	switch args[0] {
+	case "limit":
+		limit, err := strconv.Atoi(args[1])
+		if err != nil || limit < 0 {
+			s.tell(client, "usage", CatalogData{Text: ":roomset limit <members>, 0 for no limit"})
+			return
+		}
+		room.Limit = limit
+	case "invite":
+		if args[1] != "on" && args[1] != "off" {
+			s.tell(client, "usage", CatalogData{Text: ":roomset invite on|off"})
+			return
+		}
+		room.InviteOnly = args[1] == "on"
+	case "slowmode":
+		interval, err := time.ParseDuration(args[1])
+		if args[1] == "0" {
+			interval, err = 0, nil
+		}
+		if err != nil || interval < 0 {
+			s.tell(client, "usage", CatalogData{Text: ":roomset slowmode <duration>, e.g. 30s, 0 disables it"})
+			return
+		}
+		room.SlowMode = interval
+		if interval > 0 {
+			s.roomBroadcast(room.Name, s.notice("room_slow_mode_on", CatalogData{Room: room.Name, Duration: interval}))
+		} else {
+			s.roomBroadcast(room.Name, s.notice("room_slow_mode_off", CatalogData{Room: room.Name}))
+		}
+	default:
+		s.tell(client, "usage", CatalogData{Text: ":roomset limit <members>|invite on|off|slowmode <duration>"})
+		return
+	}
+	client.log.Info("Client changed a room setting", "event", "roomset", "client", s.cfg.sensitive(clientKey(client.Conn)), "room", room.Name, "setting", args[0], "value", args[1])
+	client.Write(s.roomInfo(room))
+}
+
+func (s *Server) roomInfo(room *Room) string {
+	return s.say("room_info", CatalogData{
+		Room: room.Name,
+		Count: len(room.Members),
+		Limit: max(s.roomCapacity(room), 0),
+		InviteOnly: room.InviteOnly,
+		Duration: room.SlowMode,
+		Text: room.Topic,
+	}) + "\n"
+}
+
+// setTopic changes the topic of the client's room
+func (s *Server) setTopic(client *Client, topic string) {
+	room := s.rooms[client.Room]
+	if !s.allowed(client, room, SetTopic, nil) {
+		s.tell(client, "permission_denied", CatalogData{})
+		return
+	}
+	topic = sanitizeLine(topic, maxTopicLength)
+	if topic == "" {
+		s.tell(client, "usage", CatalogData{Text: ":topic [text]"})
+		return
+	}
+	room.Topic = topic
+	client.log.Info("Client changed a topic", "event", "topic", "client", s.cfg.sensitive(clientKey(client.Conn)), "room", room.Name)
+	s.roomBroadcast(room.Name, s.notice("topic_set", CatalogData{Room: room.Name, Nick: clientDisplayName(client, s.cfg), Text: topic}))
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestJoinAndPart(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+	alice.Play(ScriptStep{After: time.Second, Line: ":nick alice"})
+	bob.Play(ScriptStep{After: time.Second, Line: ":nick bob"})
+
+	alice.Play(ScriptStep{After: time.Second, Line: ":join #golang"})
+	if !alice.Got("You are in #golang now") || !bob.Got("alice left #general, 1 members now") {
+		t.Errorf("got %q and %q", alice.Received(), bob.Received())
+	}
+	alice.Forget()
+	alice.Play(ScriptStep{After: time.Second, Line: ":rooms"})
+	if !alice.Got("#general (1)\n#golang (1)\n") {
+		t.Errorf(":rooms got %q", alice.Received())
+	}
+
+	bob.Play(ScriptStep{After: time.Second, Line: ":join #golang"})
+	if !alice.Got("bob joined #golang, 2 members now") {
+		t.Errorf("the room isn't told about bob, got %q", alice.Received())
+	}
+	// The creator of the room is its operator
+	bob.Forget()
+	bob.Play(ScriptStep{After: time.Second, Line: ":names"})
+	if !bob.Got("#golang: @alice bob\n") {
+		t.Errorf(":names got %q", bob.Received())
+	}
+
+	alice.Play(ScriptStep{After: time.Second, Line: ":part #golang"})
+	bob.Play(ScriptStep{After: time.Second, Line: ":part #golang"})
+	if !alice.Got("You are back in #general") || !alice.Got("bob joined #general, 2 members now") {
+		t.Errorf("got %q", alice.Received())
+	}
+	// Gone with its last member
+	alice.Forget()
+	alice.Play(ScriptStep{After: time.Second, Line: ":rooms"})
+	if alice.Got("#golang") {
+		t.Errorf("an empty room is still listed: %q", alice.Received())
+	}
+
+	alice.Forget()
+	alice.Play(ScriptStep{After: time.Second, Line: ":part #general"})
+	if !alice.Got("You can't leave #general") {
+		t.Errorf("got %q", alice.Received())
+	}
+}
+
+func TestNamesIsRoomScoped(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+	carol := ts.connect("10.0.0.3:1003")
+	for _, step := range []struct {
+		c *ScriptedClient
+		line string
+	}{
+		{alice, ":nick alice"}, {bob, ":nick bob"}, {carol, ":nick carol"}, {carol, ":join #rust"},
+	} {
+		step.c.Play(ScriptStep{After: time.Second, Line: step.line})
+	}
+
+	alice.Forget()
+	alice.Play(ScriptStep{After: time.Second, Line: ":names"})
+	if got := alice.Received(); len(got) != 1 || got[0] != "#general: alice bob" {
+		t.Errorf(":names got %q", got)
+	}
+}
+
+func TestLimitsFollowTheClientAcrossRooms(t *testing.T) {
+	cfg := testConfig()
+	cfg.StrikeLimit = 2
+	ts := startServer(t, cfg, nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+	bob.Play(ScriptStep{After: time.Second, Line: ":join #rust"})
+
+	alice.Play(
+		ScriptStep{After: time.Second, Line: garbage},
+		ScriptStep{After: time.Second, Line: ":join #rust"},
+		// Too fast, in whatever room
+		ScriptStep{After: time.Second / 2, Line: "hello rust"},
+	)
+	if bob.Got("hello rust") {
+		t.Errorf("changing rooms lifted the rate limit")
+	}
+	alice.Play(ScriptStep{After: time.Second, Line: garbage})
+	if !alice.Got("You are banned MF") {
+		t.Errorf("changing rooms forgot a strike, got %q", alice.Received())
+	}
+}
+
+// nicks gives the clients their nicks, one after the other
+func nicks(clients map[string]*ScriptedClient) {
+	for nick, c := range clients {
+		c.Play(ScriptStep{After: time.Second, Line: ":nick " + nick})
+	}
+}
+
+func TestRoomLimit(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+	carol := ts.connect("10.0.0.3:1003")
+
+	alice.Play(
+		ScriptStep{After: time.Second, Line: ":join #club"},
+		ScriptStep{After: time.Second, Line: ":roomset limit 2"},
+	)
+	bob.Play(ScriptStep{After: time.Second, Line: ":join #club"})
+	carol.Play(ScriptStep{After: time.Second, Line: ":join #club"})
+
+	if !bob.Got("You are in #club now") || !carol.Got("Room #club is full (max 2 users)") {
+		t.Errorf("got %q and %q", bob.Received(), carol.Received())
+	}
+	alice.Forget()
+	alice.Play(ScriptStep{After: time.Second, Line: ":roominfo"})
+	if !alice.Got("#club: 2 members out of 2") {
+		t.Errorf(":roominfo got %q", alice.Received())
+	}
+	// Only the ones running the room may change it
+	bob.Forget()
+	bob.Play(ScriptStep{After: time.Second, Line: ":roomset limit 0"})
+	if !bob.Got("Permission denied") {
+		t.Errorf("got %q", bob.Received())
+	}
+}
+
+func TestInviteOnly(t *testing.T) {
+	ts := startServer(t, adminConfig(t), nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+	admin := ts.connect("10.0.0.3:1003")
+	nicks(map[string]*ScriptedClient{"alice": alice, "bob": bob})
+	admin.Auth()
+
+	alice.Play(
+		ScriptStep{After: time.Second, Line: ":join #club"},
+		ScriptStep{After: time.Second, Line: ":roomset invite on"},
+	)
+	bob.Play(ScriptStep{After: time.Second, Line: ":join #club"})
+	if !bob.Got("#club is invite only") {
+		t.Errorf("got %q", bob.Received())
+	}
+	alice.Play(ScriptStep{After: time.Second, Line: ":invite bob"})
+	if !bob.Got("You are invited to #club") {
+		t.Errorf("got %q", bob.Received())
+	}
+
+	// The invite was for that connection
+	bob.Close()
+	bob = ts.connect("10.0.0.2:1004")
+	nicks(map[string]*ScriptedClient{"bob": bob})
+	bob.Play(ScriptStep{After: time.Second, Line: ":join #club"})
+	if !bob.Got("#club is invite only") {
+		t.Errorf("the invite outlived the invitee, got %q", bob.Received())
+	}
+
+	admin.Play(ScriptStep{After: time.Second, Line: ":join #club"})
+	if !admin.Got("You are in #club now") {
+		t.Errorf("an admin was kept out, got %q", admin.Received())
+	}
+
+	// The settings go with the room
+	alice.Play(ScriptStep{After: time.Second, Line: ":part #club"})
+	admin.Play(ScriptStep{After: time.Second, Line: ":part #club"})
+	alice.Play(ScriptStep{After: time.Second, Line: ":join #club"})
+	bob.Forget()
+	bob.Play(ScriptStep{After: time.Second, Line: ":join #club"})
+	if !bob.Got("You are in #club now") {
+		t.Errorf("a new #club is still invite only, got %q", bob.Received())
+	}
+}
+
+func TestRoomSlowMode(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+	op := ts.connect("10.0.0.3:1003")
+	carol := ts.connect("10.0.0.4:1004")
+	op.Play(
+		ScriptStep{After: time.Second, Line: ":join #slow"},
+		ScriptStep{After: time.Second, Line: ":roomset slowmode 30s"},
+	)
+	bob.Play(ScriptStep{After: time.Second, Line: ":join #slow"})
+
+	alice.Play(
+		ScriptStep{After: time.Second, Line: ":join #slow"},
+		ScriptStep{After: time.Second, Line: "slow one"},
+		ScriptStep{After: time.Second, Line: ":part #slow"},
+		// The global rate is all there is in #general
+		ScriptStep{After: time.Second, Line: "normal one"},
+		ScriptStep{After: time.Second, Line: "normal two"},
+		// Back in #slow the room remembers the last message there
+		ScriptStep{After: time.Second, Line: ":join #slow"},
+		ScriptStep{After: time.Second, Line: "slow two"},
+		ScriptStep{After: 30*time.Second, Line: "slow three"},
+	)
+
+	if !bob.Got("slow one") || bob.Got("slow two") || !bob.Got("slow three") {
+		t.Errorf("#slow got %q", bob.Received())
+	}
+	if !carol.Got("normal one") || !carol.Got("normal two") {
+		t.Errorf("#general got %q", carol.Received())
+	}
+	if !alice.Got("#slow is in slow mode: 1 message per 30s, wait 25s") || !op.Got("Slow mode in #slow: 1 message per 30s") {
+		t.Errorf("alice got %q", alice.Received())
+	}
+	// The room's own limit earns no strikes
+	if strikes := ts.sync().Stats.Strikes; strikes != 0 {
+		t.Errorf("%d strikes for the slow mode of a room", strikes)
+	}
+}
+
+func TestMaxRooms(t *testing.T) {
+	cfg := adminConfig(t)
+	cfg.MaxRooms = 3
+	ts := startServer(t, cfg, nil)
+	for i := 0; i < cfg.MaxRooms; i++ {
+		c := ts.connect(fmt.Sprintf("10.0.0.%d:1001", i+1))
+		c.Play(ScriptStep{After: time.Second, Line: fmt.Sprintf(":join #room%d", i)})
+		if !c.Got("You are in #room") {
+			t.Fatalf("room %d wasn't created, got %q", i, c.Received())
+		}
+	}
+
+	late := ts.connect("10.0.0.9:1009")
+	late.Play(ScriptStep{After: time.Second, Line: ":join #onemore"})
+	if !late.Got("Room limit reached: cannot create more than 3 rooms") {
+		t.Errorf("got %q", late.Received())
+	}
+	late.Forget()
+	late.Play(ScriptStep{After: time.Second, Line: "still here"})
+	late.Play(ScriptStep{After: time.Second, Line: ":names"})
+	if !late.Got("#general: ") {
+		t.Errorf("the client left its room, got %q", late.Received())
+	}
+	// The rooms that are already there are still open
+	late.Play(ScriptStep{After: time.Second, Line: ":join #room0"})
+	if !late.Got("You are in #room0 now") {
+		t.Errorf("got %q", late.Received())
+	}
+
+	admin := ts.connect("10.0.0.10:1010")
+	admin.Auth()
+	admin.Play(ScriptStep{After: time.Second, Line: ":join #onemore"})
+	if !admin.Got("You are in #onemore now") {
+		t.Errorf("an admin can't go over the limit, got %q", admin.Received())
+	}
+}
+
+func TestMaxRoomSize(t *testing.T) {
+	cfg := adminConfig(t)
+	cfg.MaxRoomSize = 2
+	ts := startServer(t, cfg, nil)
+	var members []*ScriptedClient
+	for i := 0; i < cfg.MaxRoomSize+1; i++ {
+		c := ts.connect(fmt.Sprintf("10.0.0.%d:1001", i+1))
+		c.Play(ScriptStep{After: time.Second, Line: ":join #club"})
+		members = append(members, c)
+	}
+	for i, c := range members[:cfg.MaxRoomSize] {
+		if !c.Got("You are in #club now") {
+			t.Errorf("client %d didn't get in, got %q", i, c.Received())
+		}
+	}
+	last := members[cfg.MaxRoomSize]
+	if !last.Got("Room #club is full (max 2 users)") {
+		t.Errorf("got %q", last.Received())
+	}
+
+	admin := ts.connect("10.0.0.10:1010")
+	admin.Auth()
+	admin.Play(ScriptStep{After: time.Second, Line: ":capacity #club 3"})
+	last.Play(ScriptStep{After: time.Second, Line: ":join #club"})
+	if !last.Got("You are in #club now") {
+		t.Errorf("the capacity of the room didn't apply, got %q", last.Received())
+	}
+}
+
+func TestOperatorsStayInTheirRoomAndRank(t *testing.T) {
+	ts := startServer(t, adminConfig(t), nil)
+	nicked := func(addr string, nick string, room string) *ScriptedClient {
+		c := ts.connect(addr)
+		c.Play(
+			ScriptStep{After: time.Second, Line: ":nick " + nick},
+			ScriptStep{After: time.Second, Line: ":join " + room},
+		)
+		return c
+	}
+	alice := nicked("10.0.0.1:1001", "alice", "#den")
+	bob := nicked("10.0.0.2:1002", "bob", "#den")
+	carol := nicked("10.0.0.3:1003", "carol", "#den")
+	admin := nicked("10.0.0.4:1004", "admin", "#den")
+	admin.Auth()
+	alice.Play(ScriptStep{After: time.Second, Line: ":op bob"})
+
+	bob.Play(ScriptStep{After: time.Second, Line: ":kick carol"})
+	if !carol.Got("You were kicked from #den") {
+		t.Errorf("the operator couldn't kick, carol got %q", carol.Received())
+	}
+	// Not the creator, nor an admin
+	for _, line := range []string{":kick alice", ":mute alice", ":kick admin", ":mute admin 1m"} {
+		bob.Forget()
+		bob.Play(ScriptStep{After: time.Second, Line: line})
+		if !bob.Got("Permission denied") {
+			t.Errorf("%s got %q", line, bob.Received())
+		}
+	}
+	if alice.Got("kicked") || alice.Got("muted") || admin.Got("kicked") || admin.Got("muted") {
+		t.Errorf("the operator acted on the creator or an admin")
+	}
+	// An admin may
+	admin.Play(ScriptStep{After: time.Second, Line: ":mute alice 1m"})
+	if !alice.Got("muted") {
+		t.Errorf("the admin couldn't mute the creator, got %q", alice.Received())
+	}
+
+	// An operator of #den is nobody in #lab
+	dave := nicked("10.0.0.5:1005", "dave", "#lab")
+	erin := nicked("10.0.0.6:1006", "erin", "#lab")
+	bob.Forget()
+	bob.Play(
+		ScriptStep{After: time.Second, Line: ":join #lab"},
+		ScriptStep{After: time.Second, Line: ":kick erin"},
+	)
+	if !bob.Got("Permission denied") || erin.Got("kicked") || dave.Got("kicked") {
+		t.Errorf("the operator of #den kicked in #lab, got %q", bob.Received())
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tsoding/4at/testutil"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fakeClock is the Server.now of the tests, it only moves with Advance
+type fakeClock struct {
+	mu sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// testConfig is DefaultConfig with the addresses logged as they are, so
+// the tests can look for them
+func testConfig() Config {
+	cfg := DefaultConfig()
+	cfg.SafeMode = "off"
+	return cfg
+}
+
+// The admin password of adminConfig
+const testPassword = "hunter2"
+
+// adminConfig is testConfig with an admin password, hashed at the lowest
+// cost so the tests don't wait for it
+func adminConfig(t *testing.T) Config {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.AdminPassword = string(hash)
+	return cfg
+}
+
+// testServer runs server() on a fake clock for the length of the test
+type testServer struct {
+	t *testing.T
+	s *Server
+	clock *fakeClock
+	ctx context.Context
+	messages chan Message
+}
+
+func startServer(t *testing.T, cfg Config, files *Files) *testServer {
+	t.Helper()
+	if files == nil {
+		files = &Files{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ts := &testServer{
+		t: t,
+		s: NewServer(cfg, files),
+		clock: &fakeClock{now: time.Date(2024, 1, 14, 12, 0, 0, 0, time.UTC)},
+		ctx: ctx,
+		// Room for a test to line up several messages for server() to find
+		// at once, see pause
+		messages: make(chan Message, 16),
+	}
+	ts.s.now = ts.clock.Now
+	done := make(chan struct{})
+	go func() {
+		server(ctx, ts.s, ts.messages)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return ts
+}
+
+// sync waits until server() has processed everything sent to it so far,
+// the messages waiting in its FairQueue included
+func (ts *testServer) sync() StatsSnapshot {
+	ts.t.Helper()
+	ctx, cancel := context.WithTimeout(ts.ctx, 5*time.Second)
+	defer cancel()
+	for {
+		snapshot, err := queryStats(ctx, ts.messages)
+		if err != nil {
+			ts.t.Fatalf("server() did not answer: %s", err)
+		}
+		if snapshot.QueueDepth == 0 {
+			return snapshot
+		}
+	}
+}
+
+// reload hands server() the configuration like the Reloader does
+func (ts *testServer) reload(cfg Config) {
+	ts.t.Helper()
+	ts.messages <- Message{Type: ConfigReloaded, Config: &cfg, Actor: "test"}
+	ts.sync()
+}
+
+// pause holds server() up until the returned function is called, so the
+// messages sent in the meantime are all waiting for it at once
+func (ts *testServer) pause() func() {
+	reply := make(chan StatsSnapshot)
+	ts.messages <- Message{Type: QueryStats, Reply: reply}
+	return func() {
+		<-reply
+	}
+}
+
+// ScriptedClient plays a client over the messages channel the way client()
+// would, on a FakeConn recording everything the server writes to it
+type ScriptedClient struct {
+	ts *testServer
+	Conn *testutil.FakeConn
+	ID ConnID
+	disconnect sync.Once
+}
+
+// ScriptStep is a line the client sends once the fake clock has moved on
+// by After
+type ScriptStep struct {
+	After time.Duration
+	Line string
+}
+
+// connect introduces a client from the address, "10.0.0.1:4242" or the path
+// of a Unix socket, like the accept loop does
+func (ts *testServer) connect(addr string) *ScriptedClient {
+	ts.t.Helper()
+	c := &ScriptedClient{
+		ts: ts,
+		Conn: testutil.NewFakeConn(addr),
+		ID: nextConnID(),
+	}
+	ts.s.connected.Add(1)
+	ts.messages <- Message{
+		Type: ClientConnected,
+		Conn: c.Conn,
+		ConnID: c.ID,
+		Admitted: make(chan struct{}),
+	}
+	// Like client(), a connection the server hangs up on is disconnected
+	go func() {
+		select {
+		case <-c.Conn.Done():
+			c.disconnected()
+		case <-ts.ctx.Done():
+		}
+	}()
+	ts.sync()
+	return c
+}
+
+func (c *ScriptedClient) disconnected() {
+	c.disconnect.Do(func() {
+		select {
+		case c.ts.messages <- Message{Type: ClientDisconnected, Conn: c.Conn, ConnID: c.ID}:
+		case <-c.ts.ctx.Done():
+		}
+	})
+}
+
+// Send sends the lines right away, one after the other, and waits for
+// server() to process them
+func (c *ScriptedClient) Send(lines ...string) {
+	c.ts.t.Helper()
+	c.Queue(lines...)
+	c.ts.sync()
+}
+
+// Queue sends the lines without waiting for server(), see testServer.pause
+func (c *ScriptedClient) Queue(lines ...string) {
+	for _, line := range lines {
+		c.ts.messages <- Message{
+			Type: NewMessage,
+			Text: line + "\n",
+			Conn: c.Conn,
+			ConnID: c.ID,
+			ReceivedAt: c.ts.clock.Now(),
+		}
+	}
+}
+
+// Play sends the lines of the steps, moving the fake clock on before each
+func (c *ScriptedClient) Play(steps ...ScriptStep) {
+	c.ts.t.Helper()
+	for _, step := range steps {
+		c.ts.clock.Advance(step.After)
+		c.Send(step.Line)
+	}
+}
+
+// Auth makes the client an admin with the password of adminConfig. The
+// password is checked on a goroutine of its own, so it waits for the
+// answer.
+func (c *ScriptedClient) Auth() {
+	c.ts.t.Helper()
+	c.Play(ScriptStep{After: time.Second, Line: ":auth " + testPassword})
+	c.WaitFor("You are an admin now")
+}
+
+// WaitFor waits for a line containing the text, for the replies that come
+// from goroutines of their own, like the password checks
+func (c *ScriptedClient) WaitFor(text string) {
+	c.ts.t.Helper()
+	deadline := time.Now().Add(5*time.Second)
+	for !c.Got(text) {
+		if time.Now().After(deadline) {
+			c.ts.t.Fatalf("no %q, got %q", text, c.Received())
+		}
+		time.Sleep(time.Millisecond)
+		c.ts.sync()
+	}
+}
+
+// Close hangs up on the server like a peer going away
+func (c *ScriptedClient) Close() {
+	c.ts.t.Helper()
+	c.QueueClose()
+	c.ts.sync()
+}
+
+// QueueClose hangs up without waiting for server(), see testServer.pause
+func (c *ScriptedClient) QueueClose() {
+	c.Conn.Close()
+	c.disconnected()
+}
+
+// Received is every line the client got so far
+func (c *ScriptedClient) Received() []string {
+	return strings.Split(strings.TrimSuffix(c.Conn.Written(), "\n"), "\n")
+}
+
+// Got tells whether the client got a line containing the text
+func (c *ScriptedClient) Got(text string) bool {
+	return strings.Contains(c.Conn.Written(), text)
+}
+
+// Forget drops what the client got so far, so the next Got only looks at
+// what comes after
+func (c *ScriptedClient) Forget() {
+	c.Conn.Reset()
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tsoding/4at/testutil"
+)
+
+// Binary garbage, a content strike every time
+const garbage = "\x00\x01\x02"
+
+func TestBroadcastReachesTheRestOfTheRoom(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+	carol := ts.connect("10.0.0.3:1003")
+
+	alice.Play(ScriptStep{After: time.Second, Line: "hello there"})
+
+	for _, c := range []*ScriptedClient{bob, carol} {
+		if !c.Got("hello there") {
+			t.Errorf("client %d did not get the message, got %q", c.ID, c.Received())
+		}
+	}
+	if alice.Got("hello there") {
+		t.Errorf("the author got its own message back without :echo")
+	}
+	if snapshot := ts.sync(); snapshot.Stats.Relayed != 1 {
+		t.Errorf("relayed %d messages, want 1", snapshot.Stats.Relayed)
+	}
+}
+
+func TestBroadcastSkipsTheOtherRooms(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+	bob.Play(ScriptStep{After: time.Second, Line: ":join #elsewhere"})
+
+	alice.Play(ScriptStep{After: time.Second, Line: "hello there"})
+
+	if bob.Got("hello there") {
+		t.Errorf("a client in another room got the message")
+	}
+}
+
+func TestContentStrikesBanAtTheLimit(t *testing.T) {
+	cfg := testConfig()
+	cfg.StrikeLimit = 3
+	ts := startServer(t, cfg, nil)
+	mallory := ts.connect("10.0.0.1:1001")
+
+	mallory.Play(ScriptStep{After: time.Second, Line: garbage}, ScriptStep{After: time.Second, Line: garbage})
+	if mallory.Conn.IsClosed() {
+		t.Fatalf("banned after 2 strikes out of 3")
+	}
+	mallory.Play(ScriptStep{After: time.Second, Line: garbage})
+
+	if !mallory.Got("You are banned MF: too many content strikes, the last for binary") {
+		t.Errorf("no ban message naming the strikes, got %q", mallory.Received())
+	}
+	if !mallory.Got(bye(ByeBanned, cfg.BanLimit)) {
+		t.Errorf("no BYE with the ban duration, got %q", mallory.Received())
+	}
+	if !mallory.Conn.IsClosed() {
+		t.Errorf("the banned client is still connected")
+	}
+	if snapshot := ts.sync(); snapshot.Bans != 1 {
+		t.Errorf("%d bans, want 1", snapshot.Bans)
+	}
+}
+
+func TestBanHangsUpOnTheWholeIP(t *testing.T) {
+	cfg := testConfig()
+	cfg.StrikeLimit = 1
+	ts := startServer(t, cfg, nil)
+	mallory := ts.connect("10.0.0.1:1001")
+	sidekick := ts.connect("10.0.0.1:1002")
+	bystander := ts.connect("10.0.0.2:1003")
+
+	mallory.Play(ScriptStep{After: time.Second, Line: garbage})
+
+	if !sidekick.Conn.IsClosed() {
+		t.Errorf("another connection from the banned IP is still connected")
+	}
+	if bystander.Conn.IsClosed() {
+		t.Errorf("a client from another IP got hung up on")
+	}
+}
+
+func TestBannedIPCannotReconnectUntilTheBanExpires(t *testing.T) {
+	cfg := testConfig()
+	cfg.StrikeLimit = 1
+	ts := startServer(t, cfg, nil)
+	mallory := ts.connect("10.0.0.1:1001")
+	mallory.Play(ScriptStep{After: time.Second, Line: garbage})
+
+	ts.clock.Advance(cfg.BanLimit / 2)
+	again := ts.connect("10.0.0.1:1002")
+	if !again.Got("You are banned MF: 300.000000 secs left") {
+		t.Errorf("no countdown for the banned IP, got %q", again.Received())
+	}
+	if !again.Conn.IsClosed() {
+		t.Errorf("the banned IP got connected")
+	}
+
+	ts.clock.Advance(cfg.BanLimit / 2)
+	later := ts.connect("10.0.0.1:1003")
+	if later.Conn.IsClosed() {
+		t.Errorf("the IP is still banned after the ban ran out, got %q", later.Received())
+	}
+}
+
+func TestClientSendsWholeLines(t *testing.T) {
+	conn := testutil.NewFakeConn("10.0.0.1:1001")
+	messages := make(chan Message)
+	admitted := make(chan struct{})
+	close(admitted)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client(ctx, testConfig(), &CatalogFile{}, conn, 1, messages, admitted)
+
+	conn.Feed("hel")
+	conn.Feed("lo\nwor")
+	conn.Feed("ld\n")
+	conn.FailRead(errors.New("connection reset by peer"))
+
+	for _, want := range []string{"hello\n", "world\n"} {
+		msg := <-messages
+		if msg.Type != NewMessage || msg.Text != want {
+			t.Errorf("got %s %q, want NewMessage %q", msg.Type, msg.Text, want)
+		}
+	}
+	if msg := <-messages; msg.Type != ClientDisconnected {
+		t.Errorf("got %s after the read failed, want ClientDisconnected", msg.Type)
+	}
+	if !conn.IsClosed() {
+		t.Errorf("the broken connection was not closed")
+	}
+}
+
+func TestClientReadsLinesAroundTheBufferSize(t *testing.T) {
+	cfg := testConfig()
+	// The smallest buffer bufio allows
+	cfg.ReadBufSize = 16
+	conn := testutil.NewFakeConn("10.0.0.1:1001")
+	messages := make(chan Message)
+	admitted := make(chan struct{})
+	close(admitted)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client(ctx, cfg, &CatalogFile{}, conn, 1, messages, admitted)
+
+	var lines []string
+	for _, size := range []int{cfg.ReadBufSize - 1, cfg.ReadBufSize, cfg.ReadBufSize + 1} {
+		lines = append(lines, strings.Repeat("x", size-1)+"\n")
+	}
+	conn.Feed(strings.Join(lines, ""))
+
+	for _, want := range lines {
+		if msg := <-messages; msg.Type != NewMessage || msg.Text != want {
+			t.Errorf("got %s %q, want NewMessage %q", msg.Type, msg.Text, want)
+		}
+	}
+}
+
+// poisoned is a message server() panics on, a connection without one
+func poisoned() Message {
+	return Message{Type: ClientConnected, ConnID: nextConnID(), Admitted: make(chan struct{})}
+}
+
+func TestServerKeepsGoingAfterAPanic(t *testing.T) {
+	ts := startServer(t, testConfig(), nil)
+	alice := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+
+	ts.messages <- poisoned()
+	if ts.sync(); ts.s.stats.Panics != 1 {
+		t.Errorf("counted %d panics", ts.s.stats.Panics)
+	}
+
+	alice.Play(ScriptStep{After: time.Second, Line: "still there?"})
+	if !bob.Got("still there?") {
+		t.Errorf("the messages stopped after the panic, got %q", bob.Received())
+	}
+	carol := ts.connect("10.0.0.3:1003")
+	if !carol.Got(limitsPrefix) {
+		t.Errorf("the clients aren't set up after the panic, got %q", carol.Received())
+	}
+}
+
+func TestServerPanicsAreLoggedAndShutItDownPastTheLimit(t *testing.T) {
+	log := captureLog(t)
+	cfg := testConfig()
+	cfg.MaxPanics = 2
+	ts := startServer(t, cfg, nil)
+	shutdown := make(chan struct{})
+	ts.s.shutdown = func() {
+		close(shutdown)
+	}
+	alice := ts.connect("10.0.0.1:1001")
+
+	for i := 0; i < cfg.MaxPanics; i++ {
+		ts.messages <- poisoned()
+	}
+	ts.sync()
+	logged := log.withEvent(t, "panic")
+	if len(logged) != cfg.MaxPanics || logged[0]["type"] != "ClientConnected" || logged[0]["client"] == nil || logged[0]["panic"] == "" || logged[0]["stack"] == "" {
+		t.Errorf("got the panics logged as %v", logged)
+	}
+	alice.Play(ScriptStep{After: time.Second, Line: ":version"})
+	if !alice.Got("4at v") {
+		t.Errorf("the server gave up before the limit, got %q", alice.Received())
+	}
+	select {
+	case <-shutdown:
+		t.Fatal("shut down at the limit")
+	default:
+	}
+
+	ts.messages <- poisoned()
+	ts.sync()
+	select {
+	case <-shutdown:
+	default:
+		t.Errorf("still running after %d panics", cfg.MaxPanics+1)
+	}
+}
+
+func TestServerPanicsCountWithinTheWindow(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxPanics = 2
+	ts := startServer(t, cfg, nil)
+	shutdown := make(chan struct{})
+	ts.s.shutdown = func() {
+		close(shutdown)
+	}
+	panics := func(n int) {
+		for i := 0; i < n; i++ {
+			ts.messages <- poisoned()
+		}
+		ts.sync()
+	}
+
+	panics(cfg.MaxPanics)
+	ts.clock.Advance(panicWindow + time.Second)
+	// The first ones are out of the window by now
+	panics(cfg.MaxPanics)
+	select {
+	case <-shutdown:
+		t.Fatal("counted the panics of more than the window")
+	default:
+	}
+	panics(1)
+	select {
+	case <-shutdown:
+	default:
+		t.Errorf("still running after %d panics within the window", cfg.MaxPanics+1)
+	}
+}
+
+// panickingConn panics on a line, like a bug in the protocol parsing would
+type panickingConn struct {
+	*testutil.FakeConn
+}
+
+func (c panickingConn) Read(b []byte) (int, error) {
+	n, err := c.FakeConn.Read(b)
+	if strings.Contains(string(b[:n]), "boom") {
+		panic("boom")
+	}
+	return n, err
+}
+
+func TestClientPanicDisconnects(t *testing.T) {
+	conn := panickingConn{testutil.NewFakeConn("10.0.0.1:1001")}
+	messages := make(chan Message)
+	admitted := make(chan struct{})
+	close(admitted)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client(ctx, testConfig(), &CatalogFile{}, conn, 7, messages, admitted)
+
+	conn.Feed("hello\n")
+	if msg := <-messages; msg.Type != NewMessage {
+		t.Errorf("got %s, want NewMessage", msg.Type)
+	}
+	conn.Feed("boom\n")
+	select {
+	case msg := <-messages:
+		if msg.Type != ClientDisconnected || msg.ConnID != 7 {
+			t.Errorf("got %s of %d after the panic, want ClientDisconnected of 7", msg.Type, msg.ConnID)
+		}
+	case <-time.After(5*time.Second):
+		t.Fatal("no ClientDisconnected after the panic")
+	}
+	if !conn.IsClosed() || !strings.Contains(conn.Written(), "BYE code=") {
+		t.Errorf("the connection wasn't hung up on, got %q", conn.Written())
+	}
+}
+
+func TestClientWaitsForTheWholeLineOverAPipe(t *testing.T) {
+	server, peer := net.Pipe()
+	defer peer.Close()
+	messages := make(chan Message)
+	admitted := make(chan struct{})
+	close(admitted)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client(ctx, testConfig(), &CatalogFile{}, server, 1, messages, admitted)
+
+	// Three TCP segments of one line
+	for _, segment := range []string{"hel", "lo wo", "rld\n"} {
+		if _, err := peer.Write([]byte(segment)); err != nil {
+			t.Fatal(err)
+		}
+		if segment != "rld\n" {
+			select {
+			case msg := <-messages:
+				t.Fatalf("got %s %q before the end of the line", msg.Type, msg.Text)
+			case <-time.After(10*time.Millisecond):
+			}
+		}
+	}
+	if msg := <-messages; msg.Type != NewMessage || msg.Text != "hello world\n" {
+		t.Errorf("got %s %q, want NewMessage \"hello world\\n\"", msg.Type, msg.Text)
+	}
+	peer.Close()
+	if msg := <-messages; msg.Type != ClientDisconnected {
+		t.Errorf("got %s %q after the line, want ClientDisconnected", msg.Type, msg.Text)
+	}
+}
+
+// clientHello is the first flight of a real TLS client
+func clientHello(t *testing.T) []byte {
+	t.Helper()
+	c, s := net.Pipe()
+	defer s.Close()
+	go tls.Client(c, &tls.Config{ServerName: "chat.example.com"}).Handshake()
+	buf := make([]byte, 4096)
+	n, err := s.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	return buf[:n]
+}
+
+func TestClientHelloOnThePlaintextPort(t *testing.T) {
+	hello := clientHello(t)
+	conn := testutil.NewFakeConn("10.0.0.1:1001")
+	messages := make(chan Message)
+	admitted := make(chan struct{})
+	close(admitted)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client(ctx, testConfig(), &CatalogFile{}, conn, 1, messages, admitted)
+
+	conn.Feed(string(hello))
+
+	if msg := <-messages; msg.Type != ClientDisconnected {
+		t.Errorf("got %s %q, want ClientDisconnected", msg.Type, msg.Text)
+	}
+	if !strings.Contains(conn.Written(), "This is the plaintext port") || !strings.Contains(conn.Written(), bye(ByeProtocol, 0)) {
+		t.Errorf("no hint for the TLS client, got %q", conn.Written())
+	}
+	if !conn.IsClosed() {
+		t.Errorf("the TLS client is still connected")
+	}
+}
+
+func TestRandomBinaryIsRejected(t *testing.T) {
+	cfg := testConfig()
+	cfg.StrikeLimit = 3
+	ts := startServer(t, cfg, nil)
+	mallory := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+	random := rand.New(rand.NewSource(42))
+
+	for i := 0; i < cfg.StrikeLimit-1; i++ {
+		blob := make([]byte, 64)
+		random.Read(blob)
+		blob = append(bytes.ReplaceAll(blob, []byte("\n"), nil), 0)
+		mallory.Play(ScriptStep{After: time.Second, Line: string(blob)})
+	}
+
+	if n := strings.Count(mallory.Conn.Written(), "This doesn't look like text"); n != cfg.StrikeLimit-1 {
+		t.Errorf("told %d times for %d blobs, got %q", n, cfg.StrikeLimit-1, mallory.Received())
+	}
+	if strings.Contains(bob.Conn.Written(), "\x00") {
+		t.Errorf("the binary got through")
+	}
+	if snapshot := ts.sync(); snapshot.Stats.Strikes != cfg.StrikeLimit-1 {
+		t.Errorf("%d strikes, want one per blob", snapshot.Stats.Strikes)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Stats are the counters for the periodic status report. They belong to
+// the server() goroutine and start over after every report.
+type Stats struct {
+	Relayed int
+	BytesBroadcast int
+	Strikes int
+	Bans int
+	// The most messages seen waiting in the channel and the FairQueue
+	PeakDepth int
+	// Messages that didn't fit in the FairQueue of their sender
+	Dropped int
+	// Chat lines over the -bandwidth of their recipient
+	Skipped int
+	// Recovered in server(), see processMessage
+	Panics int
+	// Offline messages that expired or didn't fit, see QueueOffline
+	OfflineDropped int
+	// From reading a message to writing it to the last member of the room
+	Latency LatencyHistogram
+}
+
+// reportStatus asks the server for a status report every interval. The
+// report goes through the messages channel, so the counters are only ever
+// touched by the server() goroutine.
+func reportStatus(ctx context.Context, interval time.Duration, messages chan Message) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case messages <- Message{Type: StatusReport}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// StatsSnapshot is a copy of the state of server() for the other
+// goroutines, see queryStats
+type StatsSnapshot struct {
+	Clients int
+	Admins int
+	// Both the ones dialed with -relay and the ones which dialed us
+	Relays int
+	Rooms int
+	Bans int
+	// Since the last status report
+	Stats Stats
+	QueueDepth int
+}
+
+func (s *Server) snapshot() StatsSnapshot {
+	snapshot := StatsSnapshot{
+		Clients: len(s.clients),
+		Relays: len(s.relays),
+		Rooms: len(s.rooms),
+		Bans: len(s.bannedMfs),
+		Stats: s.stats,
+		QueueDepth: len(s.messages) + s.pending.Len(),
+	}
+	for _, client := range s.clients {
+		if client.IsAdmin {
+			snapshot.Admins += 1
+		}
+		if client.IsRelay {
+			snapshot.Relays += 1
+		}
+	}
+	return snapshot
+}
+
+// queryStats is how the goroutines other than server() read its state:
+// the snapshot is taken by server() itself between two messages
+func queryStats(ctx context.Context, messages chan Message) (StatsSnapshot, error) {
+	reply := make(chan StatsSnapshot, 1)
+	select {
+	case messages <- Message{Type: QueryStats, Reply: reply}:
+	case <-ctx.Done():
+		return StatsSnapshot{}, ctx.Err()
+	}
+	select {
+	case snapshot := <-reply:
+		return snapshot, nil
+	case <-ctx.Done():
+		return StatsSnapshot{}, ctx.Err()
+	}
+}
+
+func (s *Server) report() {
+	slog.Info("Status",
+		"event", "status",
+		"clients", len(s.clients),
+		"relayed", s.stats.Relayed,
+		"bytes_broadcast", s.stats.BytesBroadcast,
+		"strikes", s.stats.Strikes,
+		"bans", s.stats.Bans,
+		"peak_depth", s.stats.PeakDepth,
+		"dropped", s.stats.Dropped,
+		"skipped", s.stats.Skipped,
+		"panics", s.stats.Panics,
+		"offline_dropped", s.stats.OfflineDropped,
+		"latency_p50", s.stats.Latency.Percentile(0.50).String(),
+		"latency_p95", s.stats.Latency.Percentile(0.95).String(),
+		"latency_p99", s.stats.Latency.Percentile(0.99).String(),
+		"latency_max", s.stats.Latency.max.String(),
+		"regex_compile_errors", s.files.RegexFilter.RegexCompileErrors())
+	s.stats = Stats{}
+}
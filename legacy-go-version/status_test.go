@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStatusReportStartsTheCountersOver(t *testing.T) {
+	captured := captureLog(t)
+	cfg := testConfig()
+	cfg.StrikeLimit = 2
+	ts := startServer(t, cfg, nil)
+	alice := ts.connect("10.0.0.1:1001")
+	ts.connect("10.0.0.2:1002")
+
+	alice.Play(
+		ScriptStep{After: time.Second, Line: "one"},
+		ScriptStep{After: time.Second, Line: "two"},
+		ScriptStep{After: time.Second, Line: garbage},
+	)
+	// What the ticker of reportStatus sends
+	ts.messages <- Message{Type: StatusReport}
+	ts.sync()
+	ts.messages <- Message{Type: StatusReport}
+	ts.sync()
+
+	reports := captured.withEvent(t, "status")
+	if len(reports) != 2 {
+		t.Fatalf("%d status reports logged, want 2", len(reports))
+	}
+	for attr, want := range map[string]float64{"clients": 2, "relayed": 2, "strikes": 1, "bans": 0} {
+		if got := reports[0][attr]; got != want {
+			t.Errorf("the first report has %s=%v, want %v", attr, got, want)
+		}
+	}
+	for _, attr := range []string{"relayed", "bytes_broadcast", "strikes"} {
+		if got := reports[1][attr]; got != float64(0) {
+			t.Errorf("the second report has %s=%v, want it started over", attr, got)
+		}
+	}
+	// The clients are the current state, not a counter
+	if got := reports[1]["clients"]; got != float64(2) {
+		t.Errorf("the second report has clients=%v", got)
+	}
+}
+
+func TestReportStatusTicks(t *testing.T) {
+	messages := make(chan Message)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		reportStatus(ctx, time.Millisecond, messages)
+		close(done)
+	}()
+	for i := 0; i < 3; i++ {
+		if msg := <-messages; msg.Type != StatusReport {
+			t.Fatalf("got %s, want StatusReport", msg.Type)
+		}
+	}
+	cancel()
+	<-done
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitStrikesSlowDownWithoutBanning(t *testing.T) {
+	cfg := testConfig()
+	cfg.StrikeLimit = 3
+	ts := startServer(t, cfg, nil)
+	flooder := ts.connect("10.0.0.1:1001")
+	bob := ts.connect("10.0.0.2:1002")
+
+	ts.clock.Advance(time.Second)
+	for i := 0; i < 10; i++ {
+		flooder.Send("spam")
+	}
+
+	if flooder.Conn.IsClosed() {
+		t.Fatalf("banned for sending too fast")
+	}
+	if snapshot := ts.sync(); snapshot.Bans != 0 {
+		t.Fatalf("%d bans for sending too fast, want 0", snapshot.Bans)
+	}
+	// The first one went through, the 9th strike in a row is a cooldown
+	// of 2^8 message rates
+	flooder.Play(ScriptStep{After: time.Minute, Line: "still cooling down"})
+	if bob.Got("still cooling down") {
+		t.Errorf("a message got through before the cooldown was over")
+	}
+	flooder.Play(ScriptStep{After: cfg.BanLimit, Line: "patient now"})
+	if !bob.Got("patient now") {
+		t.Errorf("a message after the cooldown didn't get through, got %q", bob.Received())
+	}
+}
+
+func TestContentStrikesSurviveDeliveredMessages(t *testing.T) {
+	cfg := testConfig()
+	cfg.StrikeLimit = 3
+	ts := startServer(t, cfg, nil)
+	mallory := ts.connect("10.0.0.1:1001")
+
+	mallory.Play(
+		ScriptStep{After: time.Second, Line: garbage},
+		ScriptStep{After: time.Second, Line: "sorry"},
+		ScriptStep{After: time.Second, Line: garbage},
+		ScriptStep{After: time.Second, Line: ":version"},
+		ScriptStep{After: time.Second, Line: garbage},
+	)
+
+	if !mallory.Conn.IsClosed() {
+		t.Errorf("not banned after 3 strikes with messages in between, got %q", mallory.Received())
+	}
+}
+
+func TestContentStrikesDecay(t *testing.T) {
+	cfg := testConfig()
+	cfg.StrikeLimit = 3
+	ts := startServer(t, cfg, nil)
+	mallory := ts.connect("10.0.0.1:1001")
+
+	mallory.Play(
+		ScriptStep{After: time.Second, Line: garbage},
+		ScriptStep{After: time.Second, Line: garbage},
+		ScriptStep{After: contentStrikeDecay, Line: garbage},
+	)
+	if mallory.Conn.IsClosed() {
+		t.Fatalf("banned although a strike had decayed")
+	}
+	mallory.Play(ScriptStep{After: time.Second, Line: garbage})
+	if !mallory.Conn.IsClosed() {
+		t.Errorf("not banned at the strike limit after the decay")
+	}
+}
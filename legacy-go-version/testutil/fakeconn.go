@@ -0,0 +1,205 @@
+// Package testutil has the test doubles of the server tests
+package testutil
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// FakeConn is a net.Conn in memory. The test plays the peer: Feed is what
+// the peer says, Written is what was said to it. Read blocks like on a
+// real connection until something is fed, the peer hangs up, the
+// connection is closed or the read deadline runs out. Read, Write and
+// Close can each be made to fail.
+type FakeConn struct {
+	mu sync.Mutex
+	// Fed but not read yet
+	input bytes.Buffer
+	output bytes.Buffer
+	// Set by Hangup, Read returns io.EOF once the input is read
+	eof bool
+	closed bool
+	readErr error
+	writeErr error
+	closeErr error
+	readDeadline time.Time
+	// Closed and replaced on every change a blocked Read has to look at
+	wake chan struct{}
+	done chan struct{}
+	remote net.Addr
+}
+
+// NewFakeConn makes a connection from the remote address, a TCP one like
+// "10.0.0.1:4242", anything else is taken for the path of a Unix socket
+func NewFakeConn(remote string) *FakeConn {
+	var addr net.Addr = &net.UnixAddr{Name: remote, Net: "unix"}
+	if addrPort, err := netip.ParseAddrPort(remote); err == nil {
+		addr = net.TCPAddrFromAddrPort(addrPort)
+	}
+	return &FakeConn{
+		wake: make(chan struct{}),
+		done: make(chan struct{}),
+		remote: addr,
+	}
+}
+
+// signal wakes up the blocked Read, the caller holds the lock
+func (c *FakeConn) signal() {
+	close(c.wake)
+	c.wake = make(chan struct{})
+}
+
+// Feed makes the text readable from the connection, as if the peer sent it
+func (c *FakeConn) Feed(text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.input.WriteString(text)
+	c.signal()
+}
+
+// Hangup makes Read return io.EOF once everything fed is read, as if the
+// peer closed its side
+func (c *FakeConn) Hangup() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.eof = true
+	c.signal()
+}
+
+// FailRead makes Read return the error once everything fed is read
+func (c *FakeConn) FailRead(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readErr = err
+	c.signal()
+}
+
+// FailWrite makes every following Write return the error
+func (c *FakeConn) FailWrite(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeErr = err
+}
+
+// FailClose makes Close return the error, the connection is closed anyway
+func (c *FakeConn) FailClose(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeErr = err
+}
+
+// Written is everything written to the connection so far
+func (c *FakeConn) Written() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.output.String()
+}
+
+// Reset forgets what was written so far
+func (c *FakeConn) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.output.Reset()
+}
+
+// Done is closed once the connection is
+func (c *FakeConn) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *FakeConn) IsClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *FakeConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		switch {
+		case c.closed:
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		case c.input.Len() > 0:
+			n, _ := c.input.Read(b)
+			c.mu.Unlock()
+			return n, nil
+		case c.readErr != nil:
+			err := c.readErr
+			c.mu.Unlock()
+			return 0, err
+		case c.eof:
+			c.mu.Unlock()
+			return 0, io.EOF
+		case !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline):
+			c.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		wake, deadline := c.wake, c.readDeadline
+		c.mu.Unlock()
+		if deadline.IsZero() {
+			<-wake
+			continue
+		}
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (c *FakeConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+	return c.output.Write(b)
+}
+
+func (c *FakeConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	close(c.done)
+	c.signal()
+	return c.closeErr
+}
+
+func (c *FakeConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6969}
+}
+
+func (c *FakeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *FakeConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *FakeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.signal()
+	return nil
+}
+
+// SetWriteDeadline does nothing, the writes never block
+func (c *FakeConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// letsEncryptConfig gets the certificates for the -letsencrypt domains from
+// Let's Encrypt and renews them in the background. The renewed certificate
+// is picked up by the next handshake, the listener stays as it is.
+func letsEncryptConfig(cfg Config) *tls.Config {
+	var domains []string
+	for _, domain := range strings.Split(cfg.LetsEncrypt, ",") {
+		domains = append(domains, strings.TrimSpace(domain))
+	}
+	manager := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache: autocert.DirCache(cfg.CertCacheDir),
+		Email: cfg.LetsEncryptEmail,
+	}
+	// Answers the tls-alpn-01 challenge on the chat port itself
+	return manager.TLSConfig()
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues the certificates of a test
+type testCA struct {
+	cert *x509.Certificate
+	key *ecdsa.PrivateKey
+}
+
+var testSerial int64
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial += 1
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IsCA: true,
+		KeyUsage: x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue signs a certificate for a server at 127.0.0.1 or for a client
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial += 1
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{usage},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// pemFile writes the CA certificate where -adminca can read it
+func (ca *testCA) pemFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAdminCertificate(t *testing.T) {
+	serverCA := newTestCA(t, "server CA")
+	adminCA := newTestCA(t, "admin CA")
+	otherCA := newTestCA(t, "some other CA")
+	cfg := integrationConfig()
+	cfg.AdminCA = adminCA.pemFile(t)
+	clientCAs, err := loadCertPool(cfg.AdminCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Like main with -adminca
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{serverCA.issue(t, "4at", x509.ExtKeyUsageServerAuth)},
+		ClientCAs: clientCAs,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}
+	addr := startServerOn(t, cfg, tls.NewListener(listenLocal(t), tlsConfig))
+
+	// The certificate is sent whether or not the server asks for its CA
+	dialTLS := func(cert *tls.Certificate) (*tcpClient, error) {
+		t.Helper()
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: integrationTimeout}, "tcp", addr, &tls.Config{
+			RootCAs: serverCA.pool(),
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				if cert == nil {
+					return &tls.Certificate{}, nil
+				}
+				return cert, nil
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		t.Cleanup(func() {
+			conn.Close()
+		})
+		return &tcpClient{t: t, conn: conn, reader: bufio.NewReader(conn)}, nil
+	}
+
+	cert := adminCA.issue(t, "ci-bot", x509.ExtKeyUsageClientAuth)
+	admin, err := dialTLS(&cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.waitFor(limitsPrefix)
+	admin.send(":audit")
+	admin.waitFor("No moderation actions yet")
+
+	plain, err := dialTLS(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.waitFor(limitsPrefix)
+	plain.send(":audit")
+	plain.waitFor("Permission denied")
+
+	// A certificate of another CA doesn't get through the handshake
+	cert = otherCA.issue(t, "mallory", x509.ExtKeyUsageClientAuth)
+	if forged, err := dialTLS(&cert); err == nil {
+		if line, err := forged.readLine(); err == nil {
+			t.Errorf("a client certificate of another CA was accepted: %q", line)
+		}
+	}
+}
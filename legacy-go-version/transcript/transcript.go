@@ -0,0 +1,109 @@
+// Package transcript reads and writes the chat transcript: one JSON object
+// per line for every message the server has broadcast.
+package transcript
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type Entry struct {
+	Time time.Time `json:"ts"`
+	ID string `json:"id"`
+	Sender string `json:"sender"`
+	Room string `json:"room,omitempty"`
+	Text string `json:"text"`
+}
+
+// Writer appends entries to a transcript file. Writes are buffered and
+// flushed every flushEvery as well as on Close. The first error sticks:
+// every following Write returns it, so the caller can stop transcribing.
+type Writer struct {
+	mu sync.Mutex
+	file *os.File
+	buf *bufio.Writer
+	err error
+	done chan struct{}
+}
+
+func Open(path string, flushEvery time.Duration) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{
+		file: file,
+		buf: bufio.NewWriter(file),
+		done: make(chan struct{}),
+	}
+	go w.flushPeriodically(flushEvery)
+	return w, nil
+}
+
+func (w *Writer) flushPeriodically(flushEvery time.Duration) {
+	ticker := time.NewTicker(flushEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Flush()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *Writer) Write(entry Entry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := w.buf.Write(data); err != nil {
+		w.err = err
+	}
+	return w.err
+}
+
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.buf.Flush()
+	return w.err
+}
+
+func (w *Writer) Close() error {
+	close(w.done)
+	err := w.Flush()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type Reader struct {
+	dec *json.Decoder
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{dec: json.NewDecoder(r)}
+}
+
+// Next returns the next entry of the transcript or io.EOF after the last one
+func (r *Reader) Next() (Entry, error) {
+	var entry Entry
+	err := r.dec.Decode(&entry)
+	return entry, err
+}
@@ -0,0 +1,93 @@
+package transcript
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transcript.jsonl")
+	at := time.Date(2024, 1, 14, 12, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{Time: at, ID: "1", Sender: "alice", Room: "#general", Text: "hello"},
+		{Time: at.Add(time.Second), ID: "2", Sender: "[REDACTED]", Text: "quotes \" and\nnewlines"},
+		{Time: at.Add(2*time.Second), ID: "3", Sender: "bob", Room: "#rust", Text: "ünïcödé 🦀"},
+	}
+	w, err := Open(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if err := w.Write(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	r := NewReader(file)
+	var got []Entry
+	for {
+		entry, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, entry)
+	}
+	if !reflect.DeepEqual(got, entries) {
+		t.Errorf("got %+v back, want %+v", got, entries)
+	}
+}
+
+func TestOneLinePerEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transcript.jsonl")
+	w, err := Open(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(Entry{ID: "1", Text: "two\nlines"})
+	w.Write(Entry{ID: "2", Text: "one line"})
+	// Nothing is lost to the buffer on Close
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"); len(lines) != 2 {
+		t.Errorf("want a line per entry, got %q", lines)
+	}
+}
+
+func TestWriteErrorSticks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transcript.jsonl")
+	w, err := Open(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(w.done)
+	// The flush fails on the closed file
+	w.file.Close()
+	w.Write(Entry{ID: "1"})
+	if err := w.Flush(); err == nil {
+		t.Fatalf("flushing to a closed file succeeded")
+	}
+	if err := w.Write(Entry{ID: "2"}); err == nil {
+		t.Errorf("a write after the error succeeded")
+	}
+}
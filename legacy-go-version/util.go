@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// How long a client may take to accept a write before it's dropped. All
+// the writes happen in the server() and accept() goroutines, a client that
+// doesn't read would stall everybody else without a deadline.
+const writeTimeout = 5*time.Second
+
+// writeWithTimeout writes data to conn failing after timeout. The deadline
+// is only cleared on success, a failed connection is useless anyway.
+func writeWithTimeout(conn net.Conn, data []byte, timeout time.Duration) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if _, err := conn.Write(data); err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(time.Time{})
+}
+
+// Longer messages are delivered as numbered continuation lines, see
+// splitMessage
+const maxLineLength = 512
+
+// Longer messages are not delivered at all
+const maxMessageSize = 8*1024
+
+// A client sending a longer line is disconnected instead of being buffered
+// until its newline. Relays need the room for their quoted frames.
+const maxClientLine = maxRelayFrame
+
+// splitMessage breaks a text longer than max bytes into lines like
+// "[1/3] ...", cutting on rune boundaries only. Shorter texts are returned
+// as they are.
+func splitMessage(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+	text = strings.TrimSuffix(text, "\n")
+	var parts []string
+	for len(text) > max {
+		cut := max
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut -= 1
+		}
+		parts = append(parts, text[:cut])
+		text = text[cut:]
+	}
+	parts = append(parts, text)
+	var sb strings.Builder
+	for i, part := range parts {
+		fmt.Fprintf(&sb, "[%d/%d] %s\n", i+1, len(parts), part)
+	}
+	return sb.String()
+}
+
+// looksBinary tells the garbage of port scanners and confused clients from
+// text: a NUL byte anywhere, or mostly control characters and bytes that
+// aren't UTF-8
+func looksBinary(text string) bool {
+	if strings.IndexByte(text, 0) >= 0 {
+		return true
+	}
+	garbage, total := 0, 0
+	for _, r := range text {
+		if r == '\n' || r == '\r' || r == '\t' {
+			continue
+		}
+		total += 1
+		if r == utf8.RuneError || unicode.IsControl(r) {
+			garbage += 1
+		}
+	}
+	return total > 0 && garbage*2 > total
+}
+
+// looksLikeTLS tells whether the connection starts with a TLS handshake
+// record, 0x16 0x03. It only waits for more than one byte when the first
+// one is 0x16.
+func looksLikeTLS(reader *bufio.Reader) bool {
+	first, err := reader.Peek(1)
+	if err != nil || first[0] != 0x16 {
+		return false
+	}
+	header, err := reader.Peek(2)
+	return err == nil && header[1] == 0x03
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestWriteWithTimeoutToASlowReader(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	// Reads a byte at a time, slower than the timeout in total
+	done := make(chan []byte)
+	go func() {
+		var got []byte
+		b := make([]byte, 1)
+		for {
+			if _, err := client.Read(b); err != nil {
+				done <- got
+				return
+			}
+			got = append(got, b[0])
+			time.Sleep(10*time.Millisecond)
+		}
+	}()
+
+	err := writeWithTimeout(server, []byte("0123456789abcdef"), 50*time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got %v, want the deadline to run out", err)
+	}
+	server.Close()
+	if got := <-done; len(got) == 0 || len(got) >= 16 {
+		t.Errorf("the slow reader got %q", got)
+	}
+}
+
+func TestWriteWithTimeoutLiftsTheDeadline(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+
+	if err := writeWithTimeout(server, []byte("hello\n"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// Long after the timeout a plain write still goes through
+	time.Sleep(100*time.Millisecond)
+	if _, err := server.Write([]byte("again\n")); err != nil {
+		t.Errorf("the deadline stayed: %s", err)
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+	data := []byte("a typical chat message of some length\n")
+	b.Run("plain", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			server.Write(data)
+		}
+	})
+	b.Run("with timeout", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			writeWithTimeout(server, data, writeTimeout)
+		}
+	})
+}
+
+func TestSplitMessageOnRuneBoundaries(t *testing.T) {
+	// "é" and "世" are 2 and 3 bytes long, so the cut at 8 lands inside a
+	// rune for all but the first text
+	for _, text := range []string{
+		"aaaaaaaabbbbbbbbcc",
+		"aaaaaaaé" + "bbbbbbbbb",
+		"aaaaaa世" + "bbbbbbbbb",
+		"世界世界世界世界",
+		"😀😀😀😀😀",
+	} {
+		got := splitMessage(text+"\n", 8)
+		lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+		var joined strings.Builder
+		for i, line := range lines {
+			prefix := fmt.Sprintf("[%d/%d] ", i+1, len(lines))
+			part, ok := strings.CutPrefix(line, prefix)
+			if !ok {
+				t.Errorf("%q: line %q isn't numbered %q", text, line, prefix)
+			}
+			if len(part) > 8 || part == "" || !utf8.ValidString(part) {
+				t.Errorf("%q: bad part %q", text, part)
+			}
+			joined.WriteString(part)
+		}
+		if joined.String() != text {
+			t.Errorf("%q came back as %q", text, joined.String())
+		}
+	}
+
+	if got := splitMessage("short\n", 8); got != "short\n" {
+		t.Errorf("a short message was split: %q", got)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// The ways a message breaks the rules, see checkMessage. Each one tells
+// what exactly was wrong, reject decides what the client is told and
+// whether it earns a strike.
+
+type RateLimitViolation struct {
+	// Until the client may send again
+	RetryAfter time.Duration
+}
+
+func (v RateLimitViolation) Error() string {
+	return fmt.Sprintf("sending too fast, retry after %s", v.RetryAfter)
+}
+
+type InvalidUTF8Violation struct{}
+
+func (v InvalidUTF8Violation) Error() string {
+	return "not valid UTF-8"
+}
+
+// BinaryViolation is valid UTF-8 that still isn't text, see looksBinary
+type BinaryViolation struct {
+	Length int
+}
+
+func (v BinaryViolation) Error() string {
+	return fmt.Sprintf("%d bytes of binary data", v.Length)
+}
+
+type MessageTooLongViolation struct {
+	Length int
+	Limit int
+}
+
+func (v MessageTooLongViolation) Error() string {
+	return fmt.Sprintf("message of %d bytes is longer than %d", v.Length, v.Limit)
+}
+
+type BannedWordViolation struct {
+	Word string
+}
+
+func (v BannedWordViolation) Error() string {
+	return "blocked word " + v.Word
+}
+
+type RegexViolation struct {
+	Pattern string
+}
+
+func (v RegexViolation) Error() string {
+	return "blocked pattern " + v.Pattern
+}
+
+// NoticeViolation is a rule of a Hook, the author is told the notice
+type NoticeViolation struct {
+	Notice string
+}
+
+func (v NoticeViolation) Error() string {
+	return "rejected by a hook: " + v.Notice
+}
+
+// StrikeViolation is a rule of a Hook, the author is told the notice and
+// gets a strike for the rule
+type StrikeViolation struct {
+	Rule string
+	Notice string
+}
+
+func (v StrikeViolation) Error() string {
+	return "broke the rule " + v.Rule
+}
+
+// effectiveRate is the minimal interval between two messages of a client
+// with the slow mode taken into account
+func (s *Server) effectiveRate() time.Duration {
+	return max(s.cfg.MessageRate, s.slowMode)
+}
+
+// messageRate is the least time the author has to wait between two
+// messages, text being the one about to be sent
+func (s *Server) messageRate(author *Client, text string) time.Duration {
+	name, _, _ := parseCommand(text)
+	// A relay says who it is right after connecting
+	if name == ":relay" {
+		return 0
+	}
+	// The slow mode is for crowd control, it shouldn't get in the way of
+	// the admins doing the controlling
+	if author.IsAdmin {
+		// Announcements can't wait for the rate limit
+		if name == ":announce" {
+			return 0
+		}
+		return s.cfg.MessageRate
+	}
+	return s.effectiveRate()
+}
+
+// messageCheck is one of the rules of the server, it tells how the
+// message breaks it, nil when it doesn't
+type messageCheck struct {
+	name string
+	check func(s *Server, author *Client, text string, now time.Time) error
+}
+
+// messageChecks are the rules of the server every message is held to, in
+// the order they are checked
+var messageChecks = []messageCheck{
+	{"rate_limit", func(s *Server, author *Client, text string, now time.Time) error {
+		if rate := s.messageRate(author, text); rate > 0 {
+			if wait := max(rate-now.Sub(author.LastMessage), author.CooldownUntil.Sub(now)); wait > 0 {
+				return RateLimitViolation{RetryAfter: wait}
+			}
+		}
+		return nil
+	}},
+	{"wordlist", func(s *Server, author *Client, text string, now time.Time) error {
+		if word, blocked := s.files.Wordlist.Match(text); blocked {
+			return BannedWordViolation{Word: word}
+		}
+		return nil
+	}},
+	{"regex_filter", func(s *Server, author *Client, text string, now time.Time) error {
+		if pattern, blocked := s.files.RegexFilter.Match(text); blocked {
+			return RegexViolation{Pattern: pattern}
+		}
+		return nil
+	}},
+	{"binary", func(s *Server, author *Client, text string, now time.Time) error {
+		if looksBinary(text) {
+			return BinaryViolation{Length: len(text)}
+		}
+		return nil
+	}},
+	{"utf8", func(s *Server, author *Client, text string, now time.Time) error {
+		if !utf8.ValidString(text) {
+			return InvalidUTF8Violation{}
+		}
+		return nil
+	}},
+	{"max_length", func(s *Server, author *Client, text string, now time.Time) error {
+		if len(text) > maxMessageSize {
+			return MessageTooLongViolation{Length: len(text), Limit: maxMessageSize}
+		}
+		return nil
+	}},
+}
+
+// checkMessage holds the message to the rules of the server and returns
+// the violation of the first one it breaks, nil if none. It only looks,
+// reject does the rest.
+func (s *Server) checkMessage(author *Client, text string, now time.Time) error {
+	for _, rule := range messageChecks {
+		if err := rule.check(s, author, text, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// builtinHooks run the rules of checkMessage first thing in the chain of
+// hooks, one hook each, so the hooks added after them only see the
+// messages that follow the rules
+func builtinHooks() []Hook {
+	var hooks []Hook
+	for _, rule := range messageChecks {
+		rule := rule
+		hooks = append(hooks, messageHook{name: rule.name, check: func(ctx *MsgCtx) Verdict {
+			return Verdict{Reject: rule.check(ctx.Server, ctx.Author, ctx.Text, ctx.Now)}
+		}})
+	}
+	return hooks
+}
+
+// reject tells the author why its message wasn't delivered and strikes it
+// for the violations that look like abuse
+func (s *Server) reject(author *Client, text string, violation error, now time.Time) {
+	addr := s.cfg.sensitive(clientKey(author.Conn))
+	// The two kinds of strikes are forgotten independently, a message that
+	// waited for its turn is patient whatever else is wrong with it
+	if _, tooFast := violation.(RateLimitViolation); !tooFast {
+		author.RateLimitStrikes = 0
+	}
+	switch v := violation.(type) {
+	case RateLimitViolation:
+		if author.Echo {
+			s.tell(author, "too_fast", CatalogData{Wait: v.RetryAfter})
+		}
+		s.slowDown(author, s.messageRate(author, text), now)
+	case BannedWordViolation:
+		author.log.Info("Client used a blocked word", "event", "blocked_word", "client", addr, "word", v.Word)
+		s.tell(author, "blocked_word", CatalogData{Text: v.Word})
+		s.strike(author, "blocked_word", now)
+	case RegexViolation:
+		author.log.Info("Client sent a filtered message", "event", "blocked_pattern", "client", addr, "pattern", v.Pattern)
+		s.tell(author, "blocked_pattern", CatalogData{})
+		s.strike(author, "blocked_pattern", now)
+	case BinaryViolation:
+		author.log.Info("Client sent binary data", "event", "binary", "client", addr, "bytes", v.Length)
+		s.tell(author, "binary", CatalogData{})
+		s.strike(author, "binary", now)
+	case InvalidUTF8Violation:
+		if author.Echo {
+			s.tell(author, "invalid_utf8", CatalogData{})
+		}
+		s.strike(author, "invalid_utf8", now)
+	case NoticeViolation:
+		author.Write(v.Notice + "\n")
+	case StrikeViolation:
+		author.log.Info("Client broke the rule of a hook", "event", "hook_rule", "client", addr, "rule", v.Rule)
+		author.Write(v.Notice + "\n")
+		s.strike(author, v.Rule, now)
+	case MessageTooLongViolation:
+		// Not abuse, the client may not know the limit, but the message
+		// still counts for the rate limit
+		author.LastMessage = now
+		s.tell(author, "too_long", CatalogData{Count: v.Length, Limit: v.Limit})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestViolations(t *testing.T) {
+	files := &Files{}
+	if err := files.Wordlist.Load(writeFile(t, "wordlist.txt", "spam\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := files.RegexFilter.Load(writeFile(t, "regex.txt", "^buy .* now$\n")); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(testConfig(), files)
+	now := time.Date(2024, 1, 14, 12, 0, 0, 0, time.UTC)
+	long := strings.Repeat("a", maxMessageSize+1)
+
+	for _, tc := range []struct {
+		text string
+		// Since the last message of the author
+		since time.Duration
+		want error
+	}{
+		{"hello", time.Hour, nil},
+		{"hello", 100*time.Millisecond, RateLimitViolation{RetryAfter: 900*time.Millisecond}},
+		{"no SPAM here", time.Hour, BannedWordViolation{Word: "spam"}},
+		{"buy gold now", time.Hour, RegexViolation{Pattern: "^buy .* now$"}},
+		{garbage, time.Hour, BinaryViolation{Length: len(garbage)}},
+		{"caf\xe9 au lait", time.Hour, InvalidUTF8Violation{}},
+		{long, time.Hour, MessageTooLongViolation{Length: len(long), Limit: maxMessageSize}},
+	} {
+		author := &Client{LastMessage: now.Add(-tc.since)}
+		if err := s.checkMessage(author, tc.text, now); !reflect.DeepEqual(err, tc.want) {
+			t.Errorf("%.20q: got %#v, want %#v", tc.text, err, tc.want)
+		}
+		// The same through the chain of hooks
+		if _, err := s.hooksMessage(author, tc.text, now); !reflect.DeepEqual(err, tc.want) {
+			t.Errorf("%.20q: the hooks got %#v, want %#v", tc.text, err, tc.want)
+		}
+	}
+}
+
+func TestOnlyAbuseIsAStrike(t *testing.T) {
+	cfg := testConfig()
+	cfg.StrikeLimit = 1
+	ts := startServer(t, cfg, nil)
+	alice := ts.connect("10.0.0.1:1001")
+
+	alice.Play(
+		ScriptStep{After: time.Second, Line: strings.Repeat("a", maxMessageSize+1)},
+		ScriptStep{After: time.Millisecond, Line: "too fast"},
+	)
+	if alice.Conn.IsClosed() {
+		t.Fatalf("banned for a long message or for sending too fast, got %q", alice.Received())
+	}
+	alice.Play(ScriptStep{After: time.Minute, Line: garbage})
+	if !alice.Conn.IsClosed() {
+		t.Errorf("not banned for binary data at a strike limit of 1")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsoding/4at/transcript"
+)
+
+// How many messages wait for a slow webhook before new ones are dropped
+const webhookQueueSize = 256
+
+const webhookTimeout = 5*time.Second
+
+// headerMap is a flag taking "Name: value" headers, one per occurrence of
+// the flag or per line
+type headerMap map[string]string
+
+func (headers *headerMap) String() string {
+	var lines []string
+	for name, value := range *headers {
+		lines = append(lines, name+": "+value)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func (headers *headerMap) Set(text string) error {
+	if *headers == nil {
+		*headers = headerMap{}
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return fmt.Errorf("header must look like \"Name: value\", got %q", line)
+		}
+		(*headers)[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return nil
+}
+
+// webhookSignature is the X-Signature of a request with the body
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Webhook posts every message as JSON to WebhookURL from its own goroutine,
+// so a slow receiver never holds up the chat
+type Webhook struct {
+	// The settings are swapped on reload while the goroutine posts
+	mu sync.Mutex
+	url string
+	secret string
+	headers map[string]string
+
+	queue chan transcript.Entry
+	cancel context.CancelFunc
+	client http.Client
+}
+
+func startWebhook(ctx context.Context, cfg Config) *Webhook {
+	ctx, cancel := context.WithCancel(ctx)
+	webhook := &Webhook{
+		queue: make(chan transcript.Entry, webhookQueueSize),
+		cancel: cancel,
+		client: http.Client{Timeout: webhookTimeout},
+	}
+	webhook.Configure(cfg)
+	go webhook.run(ctx)
+	return webhook
+}
+
+// Configure takes the webhook settings of a reloaded configuration, the
+// next post uses them
+func (webhook *Webhook) Configure(cfg Config) {
+	webhook.mu.Lock()
+	defer webhook.mu.Unlock()
+	webhook.url = cfg.WebhookURL
+	webhook.secret = cfg.WebhookSecret
+	webhook.headers = maps.Clone(cfg.WebhookHeaders)
+}
+
+// Send queues the entry without blocking server()
+func (webhook *Webhook) Send(entry transcript.Entry) {
+	select {
+	case webhook.queue <- entry:
+	default:
+		slog.Warn("Webhook queue is full, dropping a message", "event", "webhook_drop")
+	}
+}
+
+// Stop drops the queued messages and ends the goroutine
+func (webhook *Webhook) Stop() {
+	webhook.cancel()
+}
+
+func (webhook *Webhook) run(ctx context.Context) {
+	for {
+		select {
+		case entry := <-webhook.queue:
+			if err := webhook.post(ctx, entry); err != nil {
+				slog.Error("Could not post to the webhook", "event", "webhook", "err", err)
+			}
+		case <-ctx.Done():
+			for {
+				select {
+				case <-webhook.queue:
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (webhook *Webhook) post(ctx context.Context, entry transcript.Entry) error {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	webhook.mu.Lock()
+	url, secret, headers := webhook.url, webhook.secret, webhook.headers
+	webhook.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set("X-Signature", webhookSignature(secret, body))
+	}
+	resp, err := webhook.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// syncWebhook starts the webhook once WebhookURL is set, updates its
+// settings on reload and stops it when WebhookURL is emptied
+func (s *Server) syncWebhook(ctx context.Context) {
+	switch {
+	case s.cfg.WebhookURL == "" && s.webhook != nil:
+		s.webhook.Stop()
+		s.webhook = nil
+		slog.Info("Stopped the webhook", "event", "webhook")
+	case s.cfg.WebhookURL != "" && s.webhook == nil:
+		s.webhook = startWebhook(ctx, s.cfg)
+		slog.Info("Started the webhook", "event", "webhook")
+	case s.webhook != nil:
+		s.webhook.Configure(s.cfg)
+	}
+}
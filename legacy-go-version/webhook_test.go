@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tsoding/4at/transcript"
+)
+
+// webhookPost is a request the webhook made
+type webhookPost struct {
+	header http.Header
+	body []byte
+}
+
+func startWebhookReceiver(t *testing.T) (string, chan webhookPost) {
+	t.Helper()
+	posts := make(chan webhookPost, 16)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		posts <- webhookPost{header: r.Header.Clone(), body: body}
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver.URL, posts
+}
+
+func nextPost(t *testing.T, posts chan webhookPost) webhookPost {
+	t.Helper()
+	select {
+	case post := <-posts:
+		return post
+	case <-time.After(5*time.Second):
+		t.Fatal("the webhook posted nothing")
+	}
+	return webhookPost{}
+}
+
+func TestWebhookSignsTheBody(t *testing.T) {
+	url, posts := startWebhookReceiver(t)
+	cfg := testConfig()
+	cfg.WebhookURL = url
+	cfg.WebhookSecret = "s3cret"
+	cfg.WebhookHeaders = map[string]string{"Authorization": "Bearer token"}
+	ts := startServer(t, cfg, nil)
+	alice := ts.connect("10.0.0.1:1001")
+
+	alice.Play(ScriptStep{After: time.Second, Line: "hello hook"})
+	post := nextPost(t, posts)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(post.body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); post.header.Get("X-Signature") != want {
+		t.Errorf("X-Signature is %q, want %q", post.header.Get("X-Signature"), want)
+	}
+	if post.header.Get("Authorization") != "Bearer token" {
+		t.Errorf("the custom header is missing: %v", post.header)
+	}
+	var entry transcript.Entry
+	if err := json.Unmarshal(post.body, &entry); err != nil || entry.Text != "hello hook\n" {
+		t.Errorf("got the body %q: %v", post.body, err)
+	}
+
+	// A reload takes the new secret right away
+	cfg.WebhookSecret = "other"
+	ts.reload(cfg)
+	alice.Play(ScriptStep{After: time.Second, Line: "again"})
+	post = nextPost(t, posts)
+	if post.header.Get("X-Signature") != webhookSignature("other", post.body) {
+		t.Errorf("signed with the old secret after the reload")
+	}
+
+	// And an empty URL stops the webhook
+	cfg.WebhookURL = ""
+	ts.reload(cfg)
+	if ts.s.webhook != nil {
+		t.Errorf("the webhook is still running")
+	}
+	alice.Play(ScriptStep{After: time.Second, Line: "unheard"})
+	select {
+	case post := <-posts:
+		t.Errorf("posted %q after the webhook was stopped", post.body)
+	case <-time.After(100*time.Millisecond):
+	}
+}